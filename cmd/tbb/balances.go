@@ -19,8 +19,8 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/IacopoMelani/the-blockchain-pub/consensus"
 	"github.com/IacopoMelani/the-blockchain-pub/database"
-	"github.com/IacopoMelani/the-blockchain-pub/node"
 	"github.com/spf13/cobra"
 )
 
@@ -45,7 +45,13 @@ func balancesListCmd() *cobra.Command {
 		Use:   "list",
 		Short: "Lists all balances.",
 		Run: func(cmd *cobra.Command, args []string) {
-			state, err := database.NewStateFromDisk(getDataDirFromCmd(cmd), node.DefaultMiningDifficulty)
+			engine, err := consensus.NewFromDataDir(getDataDirFromCmd(cmd), consensus.Config{})
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			state, err := database.NewStateFromDisk(getDataDirFromCmd(cmd), engine)
 			if err != nil {
 				fmt.Fprintln(os.Stderr, err)
 				os.Exit(1)
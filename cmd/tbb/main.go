@@ -37,6 +37,28 @@ const flagAmount = "amount"
 const flagToAddress = "to"
 const flagPassword = "pwd"
 const flagConfirm = "confirm"
+const flagMinerThreads = "miner-threads"
+const flagNode = "node"
+const flagAdminToken = "admin-token"
+const flagNetworkSecret = "network-secret"
+const flagP2PPort = "p2p-port"
+const flagP2PEncrypt = "p2p-encrypt"
+const flagListenAddr = "listen-addr"
+const flagAdvertiseAddr = "advertise-addr"
+const flagPeer = "peer"
+const flagPeersFile = "peers-file"
+const flagMaxInboundPeers = "max-inbound-peers"
+const flagMaxOutboundPeers = "max-outbound-peers"
+const flagTxHash = "tx"
+const flagFee = "fee"
+const flagMempoolSlots = "mempool-slots"
+const flagMempoolQueue = "mempool-queue"
+const flagMempoolAccountSlots = "mempool-account-slots"
+const flagMempoolAccountQueue = "mempool-account-queue"
+const flagMempoolLifetime = "mempool-lifetime"
+const flagWait = "wait"
+const flagWaitTimeout = "wait-timeout"
+const flagWsOrigin = "ws-origin"
 
 func main() {
 	var tbbCmd = &cobra.Command{
@@ -50,6 +72,8 @@ func main() {
 	tbbCmd.AddCommand(balancesCmd())
 	tbbCmd.AddCommand(walletCmd())
 	tbbCmd.AddCommand(runCmd())
+	tbbCmd.AddCommand(mineCmd())
+	tbbCmd.AddCommand(miningCmd())
 
 	err := tbbCmd.Execute()
 	if err != nil {
@@ -68,6 +92,14 @@ func addKeystoreFlag(cmd *cobra.Command) {
 	cmd.MarkFlagRequired(flagKeystoreFile)
 }
 
+func addNodeFlag(cmd *cobra.Command) {
+	cmd.Flags().String(flagNode, "http://localhost:8110", "URL of the TBB node HTTP API")
+}
+
+func addAdminTokenFlag(cmd *cobra.Command) {
+	cmd.Flags().String(flagAdminToken, "", "token authenticating the node's admin endpoints, only local requests are accepted without it")
+}
+
 func addAmountFlag(cmd *cobra.Command) {
 	cmd.Flags().Uint(flagAmount, 0, "Amount to send")
 }
@@ -0,0 +1,52 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/IacopoMelani/the-blockchain-pub/database"
+	"github.com/IacopoMelani/the-blockchain-pub/node"
+	"github.com/spf13/cobra"
+)
+
+func mineCmd() *cobra.Command {
+	var mineCmd = &cobra.Command{
+		Use:   "mine",
+		Short: "Mines the blocks of a remote TBB node.",
+		Run: func(cmd *cobra.Command, args []string) {
+			nodeUrl, _ := cmd.Flags().GetString(flagNode)
+			miner, _ := cmd.Flags().GetString(flagMiner)
+			minerThreads, _ := cmd.Flags().GetInt(flagMinerThreads)
+
+			fmt.Printf("Mining the blocks of node %s...\n", nodeUrl)
+
+			err := node.MineRemotely(context.Background(), nodeUrl, database.NewAccount(miner), minerThreads)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	addNodeFlag(mineCmd)
+	mineCmd.Flags().String(flagMiner, node.DefaultMiner, "your miner account to receive the block rewards")
+	mineCmd.Flags().Int(flagMinerThreads, 0, "number of threads mining in parallel (default all CPUs)")
+
+	return mineCmd
+}
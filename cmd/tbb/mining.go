@@ -0,0 +1,118 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+func miningCmd() *cobra.Command {
+	var miningCmd = &cobra.Command{
+		Use:   "mining",
+		Short: "Controls the mining of a running TBB node (start, stop, set-miner, stats...).",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return incorrectUsageErr()
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+		},
+	}
+
+	miningCmd.AddCommand(miningAdminCmd("start", "Resumes the mining.", "/admin/mining/start"))
+	miningCmd.AddCommand(miningAdminCmd("stop", "Pauses the mining, cancelling the block being mined.", "/admin/mining/stop"))
+	miningCmd.AddCommand(miningSetMinerCmd())
+	miningCmd.AddCommand(miningStatsCmd())
+
+	return miningCmd
+}
+
+func miningAdminCmd(use, short, endpoint string) *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   use,
+		Short: short,
+		Run: func(cmd *cobra.Command, args []string) {
+			nodeUrl, _ := cmd.Flags().GetString(flagNode)
+			token, _ := cmd.Flags().GetString(flagAdminToken)
+
+			body, err := makeAuthRequest(nodeUrl+endpoint, http.MethodPost, token, nil)
+			if err != nil {
+				fmt.Println(err.Error())
+				os.Exit(1)
+			}
+
+			fmt.Printf("%s\n", body)
+		},
+	}
+
+	addNodeFlag(cmd)
+	addAdminTokenFlag(cmd)
+
+	return cmd
+}
+
+func miningSetMinerCmd() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   "set-miner",
+		Short: "Changes the account receiving the rewards of the next mined blocks.",
+		Run: func(cmd *cobra.Command, args []string) {
+			nodeUrl, _ := cmd.Flags().GetString(flagNode)
+			token, _ := cmd.Flags().GetString(flagAdminToken)
+			miner, _ := cmd.Flags().GetString(flagMiner)
+
+			body, err := makeAuthRequest(nodeUrl+"/admin/mining/miner", http.MethodPost, token, map[string]interface{}{
+				"account": miner,
+			})
+			if err != nil {
+				fmt.Println(err.Error())
+				os.Exit(1)
+			}
+
+			fmt.Printf("%s\n", body)
+		},
+	}
+
+	addNodeFlag(cmd)
+	addAdminTokenFlag(cmd)
+	cmd.Flags().String(flagMiner, "", "the miner account to receive the block rewards")
+	cmd.MarkFlagRequired(flagMiner)
+
+	return cmd
+}
+
+func miningStatsCmd() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   "stats",
+		Short: "Prints the live mining statistics.",
+		Run: func(cmd *cobra.Command, args []string) {
+			nodeUrl, _ := cmd.Flags().GetString(flagNode)
+
+			body, err := makeRequest(nodeUrl+"/mining/stats", http.MethodGet, nil)
+			if err != nil {
+				fmt.Println(err.Error())
+				os.Exit(1)
+			}
+
+			fmt.Printf("%s\n", body)
+		},
+	}
+
+	addNodeFlag(cmd)
+
+	return cmd
+}
@@ -18,10 +18,15 @@ package main
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/IacopoMelani/the-blockchain-pub/database"
+	"github.com/IacopoMelani/the-blockchain-pub/mempool"
 	"github.com/IacopoMelani/the-blockchain-pub/node"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
 	"github.com/spf13/cobra"
 )
 
@@ -38,6 +43,24 @@ func runCmd() *cobra.Command {
 			bootstrapIp, _ := cmd.Flags().GetString(flagBootstrapIp)
 			bootstrapPort, _ := cmd.Flags().GetUint64(flagBootstrapPort)
 			bootstrapAcc, _ := cmd.Flags().GetString(flagBootstrapAcc)
+			minerThreads, _ := cmd.Flags().GetInt(flagMinerThreads)
+			adminToken, _ := cmd.Flags().GetString(flagAdminToken)
+			networkSecret, _ := cmd.Flags().GetString(flagNetworkSecret)
+			p2pPort, _ := cmd.Flags().GetUint64(flagP2PPort)
+			p2pEncrypt, _ := cmd.Flags().GetBool(flagP2PEncrypt)
+			listenAddr, _ := cmd.Flags().GetString(flagListenAddr)
+			advertiseAddr, _ := cmd.Flags().GetString(flagAdvertiseAddr)
+			peerAddrs, _ := cmd.Flags().GetStringArray(flagPeer)
+			peersFile, _ := cmd.Flags().GetString(flagPeersFile)
+			wsOrigins, _ := cmd.Flags().GetStringArray(flagWsOrigin)
+			maxInboundPeers, _ := cmd.Flags().GetInt(flagMaxInboundPeers)
+			maxOutboundPeers, _ := cmd.Flags().GetInt(flagMaxOutboundPeers)
+			mempoolCfg := mempool.DefaultConfig
+			mempoolCfg.GlobalSlots, _ = cmd.Flags().GetInt(flagMempoolSlots)
+			mempoolCfg.GlobalQueue, _ = cmd.Flags().GetInt(flagMempoolQueue)
+			mempoolCfg.AccountSlots, _ = cmd.Flags().GetInt(flagMempoolAccountSlots)
+			mempoolCfg.AccountQueue, _ = cmd.Flags().GetInt(flagMempoolAccountQueue)
+			mempoolCfg.Lifetime, _ = cmd.Flags().GetDuration(flagMempoolLifetime)
 
 			fmt.Println("Launching TBB node and its HTTP API...")
 
@@ -54,9 +77,78 @@ func runCmd() *cobra.Command {
 				port = node.HttpSSLPort
 			}
 
+			staticPeers := make([]node.PeerNode, 0)
+			for _, addr := range peerAddrs {
+				peer, err := node.ParsePeerAddress(addr)
+				if err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+
+				staticPeers = append(staticPeers, peer)
+			}
+
+			if peersFile != "" {
+				filePeers, err := node.LoadPeersFile(peersFile)
+				if err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+
+				staticPeers = append(staticPeers, filePeers...)
+			}
+
 			version := fmt.Sprintf("%s.%s.%s-alpha %s %s", Major, Minor, Fix, shortGitCommit(GitCommit), Verbal)
 			n := node.New(getDataDirFromCmd(cmd), ip, port, database.NewAccount(miner), bootstrap, version, node.DefaultMiningDifficulty)
-			err := n.Run(context.Background(), isSSLDisabled, sslEmail)
+			n.SetMinerThreads(minerThreads)
+			n.SetAdminToken(adminToken)
+			n.SetWsOrigins(wsOrigins)
+			n.SetNetworkSecret(networkSecret)
+			n.SetP2P(p2pPort, p2pEncrypt)
+			n.SetListenAddr(listenAddr)
+
+			// Nodes behind a NAT or in a container advertise their public address to the peers
+			if advertiseAddr != "" {
+				advertised, err := node.ParsePeerAddress(advertiseAddr)
+				if err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+
+				n.SetAdvertiseAddr(advertised.IP, advertised.Port)
+			}
+
+			n.SetPeerLimits(maxInboundPeers, maxOutboundPeers)
+			n.SetMempoolConfig(mempoolCfg)
+			n.AddStaticPeers(staticPeers)
+
+			// Proof of Authority signers seal the blocks with their keystore account
+			if ksFile, _ := cmd.Flags().GetString(flagKeystoreFile); ksFile != "" {
+				password, _ := cmd.Flags().GetString(flagPassword)
+				if password == "" {
+					password = getPassPhrase("Please enter a password to decrypt the signer wallet:", false)
+				}
+
+				keyJson, err := ioutil.ReadFile(ksFile)
+				if err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+
+				key, err := keystore.DecryptKey(keyJson, password)
+				if err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+
+				n.SetSignerKey(key.PrivateKey)
+			}
+
+			// The node shuts down gracefully on Ctrl+C or when its service is stopped
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			err := n.Run(ctx, isSSLDisabled, sslEmail)
 			if err != nil {
 				fmt.Println(err)
 				os.Exit(1)
@@ -73,6 +165,25 @@ func runCmd() *cobra.Command {
 	runCmd.Flags().String(flagBootstrapIp, node.DefaultBootstrapIp, "default bootstrap Web3Coach's server to interconnect peers")
 	runCmd.Flags().Uint64(flagBootstrapPort, node.HttpSSLPort, "default bootstrap Web3Coach's server port to interconnect peers")
 	runCmd.Flags().String(flagBootstrapAcc, node.DefaultBootstrapAcc, "default bootstrap Web3Coach's Genesis account with 1M TBB tokens")
+	runCmd.Flags().Int(flagMinerThreads, 0, "number of threads mining in parallel (default all CPUs)")
+	addAdminTokenFlag(runCmd)
+	runCmd.Flags().Uint64(flagP2PPort, 0, "your node's public TCP port for the peer to peer protocol, HTTP only if 0 (default 0)")
+	runCmd.Flags().Bool(flagP2PEncrypt, false, "should the peer to peer connections be encrypted? (default false)")
+	runCmd.Flags().String(flagListenAddr, "", "host:port the HTTP API binds to (default all interfaces on --port)")
+	runCmd.Flags().String(flagAdvertiseAddr, "", "public host:port advertised to the peers, the node keeps listening on --port (default --ip:--port)")
+	runCmd.Flags().StringArray(flagPeer, nil, "host:port of a static peer the node always keeps syncing with, repeatable")
+	runCmd.Flags().StringArray(flagWsOrigin, nil, "origin of a web page allowed to open the WebSocket subscriptions, e.g: https://example.com or * for any, repeatable")
+	runCmd.Flags().String(flagPeersFile, "", "absolute path to a file of static peers, one host:port per line")
+	runCmd.Flags().Int(flagMaxInboundPeers, 0, "maximum number of peers registering with your node, unlimited if 0 (default 0)")
+	runCmd.Flags().Int(flagMaxOutboundPeers, 0, "maximum number of peers your node syncs with, unlimited if 0 (default 0)")
+	runCmd.Flags().Int(flagMempoolSlots, mempool.DefaultConfig.GlobalSlots, "maximum number of executable pending TXs")
+	runCmd.Flags().Int(flagMempoolQueue, mempool.DefaultConfig.GlobalQueue, "maximum number of future TXs waiting for a missing nonce or funds")
+	runCmd.Flags().Int(flagMempoolAccountSlots, mempool.DefaultConfig.AccountSlots, "maximum number of executable pending TXs of a single sender")
+	runCmd.Flags().Int(flagMempoolAccountQueue, mempool.DefaultConfig.AccountQueue, "maximum number of future TXs of a single sender")
+	runCmd.Flags().Duration(flagMempoolLifetime, mempool.DefaultConfig.Lifetime, "how long a TX stays pending before it expires, never if 0")
+	runCmd.Flags().String(flagNetworkSecret, "", "shared secret the peers must authenticate their handshake with (default none)")
+	runCmd.Flags().String(flagKeystoreFile, "", "Proof of Authority networks: absolute path to the encrypted keystore file of your signer account")
+	addPwdFlag(runCmd)
 
 	return runCmd
 }
@@ -23,8 +23,10 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/IacopoMelani/the-blockchain-pub/database"
+	"github.com/IacopoMelani/the-blockchain-pub/mempool"
 	"github.com/IacopoMelani/the-blockchain-pub/node"
 	"github.com/IacopoMelani/the-blockchain-pub/wallet"
 	"github.com/davecgh/go-spew/spew"
@@ -49,6 +51,8 @@ func walletCmd() *cobra.Command {
 	walletCmd.AddCommand(walletNewAccountCmd())
 	walletCmd.AddCommand(walletPrintPrivKeyCmd())
 	walletCmd.AddCommand(walletSendTransaction())
+	walletCmd.AddCommand(walletReplaceTransaction("speed-up", "Re-sends a stuck pending transaction paying a higher fee.", false))
+	walletCmd.AddCommand(walletReplaceTransaction("cancel", "Cancels a stuck pending transaction replacing it with a self-transfer paying a higher fee.", true))
 
 	return walletCmd
 }
@@ -112,6 +116,7 @@ func walletSendTransaction() *cobra.Command {
 		Short: "Sends a transaction to the blockchain.",
 		Run: func(cmd *cobra.Command, args []string) {
 			ksFile, _ := cmd.Flags().GetString(flagKeystoreFile)
+			nodeUrl, _ := cmd.Flags().GetString(flagNode)
 
 			password, _ := cmd.Flags().GetString(flagPassword)
 			if password == "" {
@@ -150,7 +155,7 @@ func walletSendTransaction() *cobra.Command {
 				}
 			}
 
-			nextNonceRawBody, err := makeRequest("http://localhost:8110/node/nonce/next", "POST", map[string]interface{}{
+			nextNonceRawBody, err := makeRequest(nodeUrl+"/node/nonce/next", "POST", map[string]interface{}{
 				"account": key.Address.Hex(),
 			})
 			if err != nil {
@@ -182,7 +187,7 @@ func walletSendTransaction() *cobra.Command {
 			fmt.Printf("\nSending transaction: %s 🚀🚀🚀\n", txHash.Hex())
 			fmt.Printf("\tAmount: '%v'\n", signedTx.Value)
 			fmt.Printf("\tTo: '%v'\n", signedTx.To.Hex())
-			fmt.Printf("\tFees: '%v'\n", database.TxFee)
+			fmt.Printf("\tFees: '%v'\n", signedTx.EffectiveFee())
 
 			if confirm, _ := cmd.Flags().GetBool(flagConfirm); !confirm {
 
@@ -206,7 +211,7 @@ func walletSendTransaction() *cobra.Command {
 
 			fmt.Printf("Sending transaction to the blockchain...\n")
 
-			body, err := makeRequest("http://localhost:8110/tx/add", "POST", map[string]interface{}{
+			body, err := makeRequest(nodeUrl+"/tx/add", "POST", map[string]interface{}{
 				"tx": rawTx,
 			})
 			if err != nil {
@@ -215,14 +220,185 @@ func walletSendTransaction() *cobra.Command {
 			}
 
 			fmt.Printf("%s\n", body)
+
+			confirmations, _ := cmd.Flags().GetUint64(flagWait)
+			if confirmations == 0 {
+				return
+			}
+
+			waitTimeout, _ := cmd.Flags().GetDuration(flagWaitTimeout)
+
+			fmt.Printf("Waiting for %d confirmations...\n", confirmations)
+
+			txRes, err := waitTransaction(nodeUrl, txHash, confirmations, waitTimeout)
+			if err != nil {
+				fmt.Println(err.Error())
+				os.Exit(1)
+			}
+
+			if txRes.Status != node.TxStatusMined || txRes.Confirmations < confirmations {
+				fmt.Printf("Transaction is %s, not confirmed\n", txRes.Status)
+				os.Exit(1)
+			}
+
+			fmt.Printf("Transaction mined in Block %d '%s' with %d confirmations\n", txRes.BlockNumber, txRes.BlockHash.Hex(), txRes.Confirmations)
 		},
 	}
 
 	addKeystoreFlag(cmd)
+	addNodeFlag(cmd)
 	addToAddressFlag(cmd)
 	addAmountFlag(cmd)
 	addPwdFlag(cmd)
 	addConfirmFlag(cmd)
+	cmd.Flags().Uint64(flagWait, 0, "wait for the transaction to be mined with the given confirmations, as --wait=N, 1 if no value")
+	cmd.Flags().Lookup(flagWait).NoOptDefVal = "1"
+	cmd.Flags().Duration(flagWaitTimeout, 5*time.Minute, "how long to wait for the confirmations")
+
+	return cmd
+}
+
+// waitTransaction long polls the node until the transaction has the confirmations, is dropped or the timeout expires.
+func waitTransaction(nodeUrl string, txHash database.Hash, confirmations uint64, timeout time.Duration) (node.TxRes, error) {
+	res, err := http.Get(fmt.Sprintf("%s/tx/%s/wait?confirmations=%d&timeout=%s", nodeUrl, txHash.Hex(), confirmations, timeout))
+	if err != nil {
+		return node.TxRes{}, err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return node.TxRes{}, err
+	}
+
+	txRes := node.TxRes{}
+	err = json.Unmarshal(body, &txRes)
+	if err != nil || txRes.Status == "" {
+		return node.TxRes{}, fmt.Errorf("unable to wait for the transaction: %s", body)
+	}
+
+	return txRes, nil
+}
+
+// walletReplaceTransaction re-signs a pending transaction with the same nonce and a higher fee,
+// as a self-transfer of 0 TBB if cancel. The nodes replace the pending transaction with the new one.
+func walletReplaceTransaction(use string, short string, cancel bool) *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   use,
+		Short: short,
+		Run: func(cmd *cobra.Command, args []string) {
+			ksFile, _ := cmd.Flags().GetString(flagKeystoreFile)
+			nodeUrl, _ := cmd.Flags().GetString(flagNode)
+			txHash, _ := cmd.Flags().GetString(flagTxHash)
+			fee, _ := cmd.Flags().GetUint(flagFee)
+
+			password, _ := cmd.Flags().GetString(flagPassword)
+			if password == "" {
+				password = getPassPhrase("Please enter a password to decrypt the wallet:", false)
+			}
+
+			keyJson, err := ioutil.ReadFile(ksFile)
+			if err != nil {
+				fmt.Println(err.Error())
+				os.Exit(1)
+			}
+
+			key, err := keystore.DecryptKey(keyJson, password)
+			if err != nil {
+				fmt.Println(err.Error())
+				os.Exit(1)
+			}
+
+			pendingRawBody, err := makeRequest(nodeUrl+"/node/tx/pending?hash="+txHash, http.MethodGet, nil)
+			if err != nil {
+				fmt.Println(err.Error())
+				os.Exit(1)
+			}
+
+			var pendingRes node.PendingTxRes
+			err = json.Unmarshal(pendingRawBody, &pendingRes)
+			if err != nil || pendingRes.Tx.Sig == nil {
+				fmt.Printf("TX '%s' is not pending. %s\n", txHash, pendingRawBody)
+				os.Exit(1)
+			}
+
+			pendingTx := pendingRes.Tx
+			if pendingTx.From != key.Address {
+				fmt.Printf("TX '%s' was sent by %s, not by %s\n", txHash, pendingTx.From.Hex(), key.Address.Hex())
+				os.Exit(1)
+			}
+
+			minFee := mempool.MinReplacementFee(pendingTx.EffectiveFee(), mempool.DefaultConfig.PriceBump)
+			if fee == 0 {
+				fee = minFee
+			}
+
+			if fee < minFee {
+				fmt.Printf("The fee must be at least %d TBB to replace the pending TX paying %d TBB\n", minFee, pendingTx.EffectiveFee())
+				os.Exit(1)
+			}
+
+			tx := database.NewTx(pendingTx.From, pendingTx.To, pendingTx.Value, pendingTx.Nonce, pendingTx.Data)
+			if cancel {
+				tx = database.NewTx(pendingTx.From, pendingTx.From, 0, pendingTx.Nonce, "")
+			}
+			tx.Fee = fee
+
+			signedTx, err := wallet.SignTxWithKey(tx, key)
+			if err != nil {
+				fmt.Println(err.Error())
+				os.Exit(1)
+			}
+
+			signedTxHash, err := signedTx.Hash()
+			if err != nil {
+				fmt.Println(err.Error())
+				os.Exit(1)
+			}
+
+			fmt.Printf("\nReplacing transaction %s with: %s 🚀🚀🚀\n", txHash, signedTxHash.Hex())
+			fmt.Printf("\tAmount: '%v'\n", signedTx.Value)
+			fmt.Printf("\tTo: '%v'\n", signedTx.To.Hex())
+			fmt.Printf("\tNonce: '%v'\n", signedTx.Nonce)
+			fmt.Printf("\tFees: '%v' (was '%v')\n", signedTx.EffectiveFee(), pendingTx.EffectiveFee())
+
+			if confirm, _ := cmd.Flags().GetBool(flagConfirm); !confirm {
+
+				fmt.Println("\n\nConfirm transaction? (y/n)")
+				var confirm string
+				fmt.Scanln(&confirm)
+
+				if confirm != "y" {
+					fmt.Println("\n\nAborting transaction...")
+					os.Exit(0)
+				}
+			}
+
+			rawBytes, err := rlp.EncodeToBytes(signedTx)
+			if err != nil {
+				fmt.Println(err.Error())
+				os.Exit(1)
+			}
+
+			body, err := makeRequest(nodeUrl+"/tx/add", http.MethodPost, map[string]interface{}{
+				"tx": hexutil.Encode(rawBytes),
+			})
+			if err != nil {
+				fmt.Println(err.Error())
+				os.Exit(1)
+			}
+
+			fmt.Printf("%s\n", body)
+		},
+	}
+
+	addKeystoreFlag(cmd)
+	addNodeFlag(cmd)
+	addPwdFlag(cmd)
+	addConfirmFlag(cmd)
+	cmd.Flags().String(flagTxHash, "", "hash of the pending transaction to replace")
+	cmd.MarkFlagRequired(flagTxHash)
+	cmd.Flags().Uint(flagFee, 0, "fee of the replacement transaction (default the minimum to replace the pending one)")
 
 	return cmd
 }
@@ -254,6 +430,11 @@ func GetToAddress() (string, error) {
 
 // make POST request with JSON body
 func makeRequest(url string, method string, data map[string]interface{}) ([]byte, error) {
+	return makeAuthRequest(url, method, "", data)
+}
+
+// make request with JSON body, authenticated with the bearer token if not empty
+func makeAuthRequest(url string, method string, token string, data map[string]interface{}) ([]byte, error) {
 
 	if data == nil {
 		data = make(map[string]interface{})
@@ -269,6 +450,9 @@ func makeRequest(url string, method string, data map[string]interface{}) ([]byte
 		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
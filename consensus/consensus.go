@@ -0,0 +1,92 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package consensus
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"fmt"
+
+	"github.com/IacopoMelani/the-blockchain-pub/consensus/poa"
+	"github.com/IacopoMelani/the-blockchain-pub/consensus/pow"
+	"github.com/IacopoMelani/the-blockchain-pub/database"
+)
+
+// Engine is an algorithm agnostic consensus engine.
+type Engine interface {
+	database.Consensus
+
+	// Name returns the engine identifier used in the genesis "consensus" field.
+	Name() string
+
+	// Prepare initializes the consensus fields of the header of the block to seal on top of the state.
+	Prepare(s *database.State, header *database.BlockHeader) error
+
+	// Seal generates a new sealing request for the given block and blocks until it's sealed or the ctx is done.
+	Seal(ctx context.Context, b database.Block) (database.Block, error)
+
+	// CalcDifficulty returns the difficulty the next block, on top of the state latest block, should have.
+	CalcDifficulty(s *database.State, current uint64) (uint64, error)
+}
+
+// Authorizer is implemented by the engines sealing blocks with the node's private key.
+type Authorizer interface {
+	Authorize(key *ecdsa.PrivateKey)
+}
+
+// HeaderVerifier is implemented by the engines able to verify a chain of headers without the blocks bodies,
+// letting the node reject a forged chain before downloading it.
+type HeaderVerifier interface {
+	VerifyHeaders(parents []database.BlockHeader, headers []database.HeaderFS) error
+}
+
+// Config holds the node-local settings of the consensus engines.
+type Config struct {
+	// Proof of Work only: number of goroutines mining in parallel, all CPUs if 0
+	MinerThreads int
+}
+
+// Miner is implemented by the engines sealing blocks by searching a nonce, reporting their progress.
+type Miner interface {
+	Attempts() uint64
+	Hashrate() float64
+}
+
+// New selects the consensus engine configured in the genesis, Proof of Work by default.
+func New(gen database.Genesis, cfg Config) (Engine, error) {
+	switch gen.Consensus {
+	case "", pow.Name:
+		return pow.NewWithThreads(cfg.MinerThreads), nil
+	case poa.Name:
+		if len(gen.Signers) == 0 {
+			return nil, fmt.Errorf("'%s' consensus requires at least one genesis signer", poa.Name)
+		}
+
+		return poa.New(gen.Period, gen.Signers), nil
+	default:
+		return nil, fmt.Errorf("unknown consensus engine '%s'", gen.Consensus)
+	}
+}
+
+// NewFromDataDir loads the genesis from the data dir and selects its consensus engine.
+func NewFromDataDir(dataDir string, cfg Config) (Engine, error) {
+	gen, err := database.LoadGenesis(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(gen, cfg)
+}
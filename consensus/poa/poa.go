@@ -0,0 +1,396 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package poa
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/IacopoMelani/the-blockchain-pub/database"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const Name = "poa"
+
+const DefaultPeriod = 5
+
+// Difficulties of blocks sealed in-turn and out-of-turn, they tell the blocks apart
+// but the nodes still sync the longest chain, whatever its in-turn blocks
+const DiffInTurn = 2
+const DiffNoTurn = 1
+
+// Out-of-turn signers wait up to wiggleTime per signer before sealing, to give the in-turn signer a head start
+const wiggleTime = 500 * time.Millisecond
+
+const maxSnapshots = 1024
+
+var ErrUnauthorizedSigner = errors.New("the node is not an authorized signer")
+
+// ErrRecentlySigned is returned preparing a block while the signer must wait for the others to seal theirs.
+var ErrRecentlySigned = errors.New("the signer sealed one of the recent blocks, waiting for the others")
+
+// PoA is a clique-like Proof of Authority consensus engine: blocks are sealed, in rotation, by a set of
+// authorized signers that can vote to add or drop other signers.
+type PoA struct {
+	period  uint64
+	genesis *Snapshot
+
+	snapshots     map[database.Hash]*Snapshot
+	snapshotsKeys []database.Hash
+
+	signer    common.Address
+	signerKey *ecdsa.PrivateKey
+
+	// The signers count at the latest prepared block, to compute the out-of-turn delay
+	signersCount int
+
+	// The votes this node will cast in the blocks it seals, candidate -> authorize
+	proposals map[common.Address]bool
+
+	lock sync.RWMutex
+}
+
+func New(period uint64, signers []common.Address) *PoA {
+	if period == 0 {
+		period = DefaultPeriod
+	}
+
+	return &PoA{
+		period:    period,
+		genesis:   newGenesisSnapshot(signers),
+		snapshots: make(map[database.Hash]*Snapshot),
+		proposals: make(map[common.Address]bool),
+	}
+}
+
+func (p *PoA) Name() string {
+	return Name
+}
+
+// Authorize injects the private key used to seal the new blocks.
+func (p *PoA) Authorize(key *ecdsa.PrivateKey) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.signer = crypto.PubkeyToAddress(key.PublicKey)
+	p.signerKey = key
+}
+
+// Propose schedules a vote to authorize or drop the candidate in the next blocks sealed by this node.
+func (p *PoA) Propose(candidate common.Address, authorize bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.proposals[candidate] = authorize
+}
+
+// Discard drops a pending proposal.
+func (p *PoA) Discard(candidate common.Address) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	delete(p.proposals, candidate)
+}
+
+func (p *PoA) Proposals() map[common.Address]bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	proposals := make(map[common.Address]bool)
+	for candidate, authorize := range p.proposals {
+		proposals[candidate] = authorize
+	}
+
+	return proposals
+}
+
+func (p *PoA) VerifyHeader(s *database.State, b database.Block) error {
+	snap, err := p.Snapshot(s)
+	if err != nil {
+		return err
+	}
+
+	signer, err := Ecrecover(b)
+	if err != nil {
+		return err
+	}
+
+	if !snap.isSigner(signer) {
+		return fmt.Errorf("unauthorized signer '%s'", signer.Hex())
+	}
+
+	if snap.recentlySigned(b.Header.Number, signer) {
+		return fmt.Errorf("signer '%s' recently sealed a block", signer.Hex())
+	}
+
+	if b.Header.Miner != signer {
+		return fmt.Errorf("block miner '%s' must be the signer '%s'", b.Header.Miner.Hex(), signer.Hex())
+	}
+
+	expectedDifficulty := uint64(DiffNoTurn)
+	if snap.inturn(b.Header.Number, signer) {
+		expectedDifficulty = DiffInTurn
+	}
+
+	if b.Header.Difficulty != expectedDifficulty {
+		return fmt.Errorf("invalid difficulty '%d', expected '%d'", b.Header.Difficulty, expectedDifficulty)
+	}
+
+	if !s.LatestBlockHash().IsEmpty() && b.Header.Time < s.LatestBlock().Header.Time+p.period {
+		return fmt.Errorf("block sealed before the '%d' seconds period", p.period)
+	}
+
+	return nil
+}
+
+func (p *PoA) Finalize(s *database.State, b database.Block) error {
+	snap, err := p.Snapshot(s)
+	if err != nil {
+		return err
+	}
+
+	signer, err := Ecrecover(b)
+	if err != nil {
+		return err
+	}
+
+	hash, err := b.Hash()
+	if err != nil {
+		return err
+	}
+
+	next, err := snap.apply(hash, b.Header, signer)
+	if err != nil {
+		return err
+	}
+
+	p.storeSnapshot(next)
+
+	s.Balances[b.Header.Miner] += database.BlockReward
+	s.Balances[b.Header.Miner] += b.Fees()
+
+	return nil
+}
+
+// Prepare sets the signer, difficulty, time and vote of the block this node is going to seal.
+func (p *PoA) Prepare(s *database.State, header *database.BlockHeader) error {
+	p.lock.RLock()
+	signer := p.signer
+	p.lock.RUnlock()
+
+	snap, err := p.Snapshot(s)
+	if err != nil {
+		return err
+	}
+
+	if !snap.isSigner(signer) {
+		return ErrUnauthorizedSigner
+	}
+
+	// VerifyHeader rejects the block, on this node and its peers alike
+	if snap.recentlySigned(header.Number, signer) {
+		return ErrRecentlySigned
+	}
+
+	header.Miner = signer
+
+	p.lock.Lock()
+	p.signersCount = len(snap.Signers)
+	p.lock.Unlock()
+
+	difficulty, err := p.CalcDifficulty(s, header.Difficulty)
+	if err != nil {
+		return err
+	}
+	header.Difficulty = difficulty
+
+	if !s.LatestBlockHash().IsEmpty() {
+		minTime := s.LatestBlock().Header.Time + p.period
+		if header.Time < minTime {
+			header.Time = minTime
+		}
+	}
+
+	header.Candidate = nil
+	header.Authorize = false
+
+	for candidate, authorize := range p.Proposals() {
+		if snap.validVote(candidate, authorize) {
+			c := candidate
+			header.Candidate = &c
+			header.Authorize = authorize
+			break
+		}
+	}
+
+	return nil
+}
+
+// Seal waits for the block time, plus a random delay when out-of-turn, and signs the block.
+func (p *PoA) Seal(ctx context.Context, b database.Block) (database.Block, error) {
+	p.lock.RLock()
+	signer, signerKey, signersCount := p.signer, p.signerKey, p.signersCount
+	p.lock.RUnlock()
+
+	if signerKey == nil || b.Header.Miner != signer {
+		return database.Block{}, ErrUnauthorizedSigner
+	}
+
+	delay := time.Until(time.Unix(int64(b.Header.Time), 0))
+	if b.Header.Difficulty == DiffNoTurn {
+		delay += time.Duration(rand.Int63n(int64((signersCount/2 + 1)) * int64(wiggleTime)))
+	}
+
+	select {
+	case <-ctx.Done():
+		fmt.Println("Sealing cancelled!")
+
+		return database.Block{}, fmt.Errorf("sealing cancelled. %s", ctx.Err())
+	case <-time.After(delay):
+	}
+
+	hash, err := SealHash(b)
+	if err != nil {
+		return database.Block{}, err
+	}
+
+	sig, err := crypto.Sign(hash[:], signerKey)
+	if err != nil {
+		return database.Block{}, err
+	}
+
+	block := b
+	block.Header.Signature = sig
+
+	blockHash, err := block.Hash()
+	if err != nil {
+		return database.Block{}, err
+	}
+
+	fmt.Printf("\nSealed new Block '%x' using PoA 🎉🎉🎉\n", blockHash)
+	fmt.Printf("\tHeight: '%v'\n", block.Header.Number)
+	fmt.Printf("\tDifficulty: '%v'\n", block.Header.Difficulty)
+	fmt.Printf("\tCreated: '%v'\n", block.Header.Time)
+	fmt.Printf("\tSigner: '%v'\n", block.Header.Miner.String())
+	fmt.Printf("\tParent: '%v'\n\n", block.Header.Parent.Hex())
+
+	return block, nil
+}
+
+// CalcDifficulty returns DiffInTurn if it's this node turn to seal the next block, DiffNoTurn otherwise.
+func (p *PoA) CalcDifficulty(s *database.State, current uint64) (uint64, error) {
+	p.lock.RLock()
+	signer := p.signer
+	p.lock.RUnlock()
+
+	snap, err := p.Snapshot(s)
+	if err != nil {
+		return 0, err
+	}
+
+	if snap.inturn(s.NextBlockNumber(), signer) {
+		return DiffInTurn, nil
+	}
+
+	return DiffNoTurn, nil
+}
+
+// Snapshot returns the authorization voting state at the state latest block.
+func (p *PoA) Snapshot(s *database.State) (*Snapshot, error) {
+	if s.LatestBlockHash().IsEmpty() {
+		return p.genesis, nil
+	}
+
+	p.lock.RLock()
+	snap, ok := p.snapshots[s.LatestBlockHash()]
+	p.lock.RUnlock()
+
+	if ok {
+		return snap, nil
+	}
+
+	// Not cached, e.g: after a chain reset, replay the headers from genesis
+	blocks, err := s.GetBlocksBefore(s.LatestBlockHash(), int64(s.LatestBlock().Header.Number+1))
+	if err != nil {
+		return nil, err
+	}
+
+	snap = p.genesis
+	for i := len(blocks) - 1; i >= 0; i-- {
+		signer, err := Ecrecover(blocks[i].Value)
+		if err != nil {
+			return nil, err
+		}
+
+		snap, err = snap.apply(blocks[i].Key, blocks[i].Value.Header, signer)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	p.storeSnapshot(snap)
+
+	return snap, nil
+}
+
+func (p *PoA) storeSnapshot(snap *Snapshot) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if _, ok := p.snapshots[snap.Hash]; ok {
+		return
+	}
+
+	p.snapshots[snap.Hash] = snap
+	p.snapshotsKeys = append(p.snapshotsKeys, snap.Hash)
+
+	if len(p.snapshotsKeys) > maxSnapshots {
+		delete(p.snapshots, p.snapshotsKeys[0])
+		p.snapshotsKeys = p.snapshotsKeys[1:]
+	}
+}
+
+// SealHash returns the hash of the block the signer signs, i.e: without the signature.
+func SealHash(b database.Block) (database.Hash, error) {
+	b.Header.Signature = nil
+
+	return b.Hash()
+}
+
+// Ecrecover extracts the account that signed the block.
+func Ecrecover(b database.Block) (common.Address, error) {
+	if len(b.Header.Signature) != crypto.SignatureLength {
+		return common.Address{}, errors.New("missing block signature")
+	}
+
+	hash, err := SealHash(b)
+	if err != nil {
+		return common.Address{}, err
+	}
+
+	pubKey, err := crypto.SigToPub(hash[:], b.Header.Signature)
+	if err != nil {
+		return common.Address{}, err
+	}
+
+	return crypto.PubkeyToAddress(*pubKey), nil
+}
@@ -0,0 +1,172 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package poa
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/IacopoMelani/the-blockchain-pub/database"
+	"github.com/IacopoMelani/the-blockchain-pub/fs"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestPoA_SealAndVote(t *testing.T) {
+	andrejKey, andrej := generateKey(t)
+	babaYagaKey, babaYaga := generateKey(t)
+	_, caesar := generateKey(t)
+
+	engine := New(1, []common.Address{andrej, babaYaga})
+
+	state, dataDir := newTestState(t, engine, []common.Address{andrej, babaYaga})
+	defer fs.RemoveDir(dataDir)
+	defer state.Close()
+
+	engine.Propose(caesar, true)
+
+	// Andrej votes to authorize Caesar
+	sealAndAdd(t, engine, state, andrejKey)
+
+	// Andrej can't seal two blocks in a row
+	engine.Authorize(andrejKey)
+	block := database.NewBlock(state.LatestBlockHash(), state.NextBlockNumber(), 0, uint64(time.Now().Unix()), andrej, 0, nil)
+	if err := engine.Prepare(state, &block.Header); err != ErrRecentlySigned {
+		t.Fatalf("expected '%v', got '%v'", ErrRecentlySigned, err)
+	}
+
+	// Nor seal it skipping the preparation
+	block.Header.Difficulty = DiffInTurn
+	block.Header.Time = state.LatestBlock().Header.Time + 1
+	block, err := engine.Seal(context.Background(), block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := state.AddBlock(block); err == nil {
+		t.Fatal("a signer is not suppose to seal a block so recently")
+	}
+
+	snap, err := engine.Snapshot(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.isSigner(caesar) {
+		t.Fatal("one vote out of two signers is not suppose to authorize Caesar")
+	}
+
+	// BabaYaga votes to authorize Caesar too, reaching the majority
+	sealAndAdd(t, engine, state, babaYagaKey)
+
+	snap, err = engine.Snapshot(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !snap.isSigner(caesar) {
+		t.Fatal("Caesar is suppose to be an authorized signer")
+	}
+
+	if state.Balances[andrej] != database.BlockReward || state.Balances[babaYaga] != database.BlockReward {
+		t.Fatal("the signers are suppose to receive the block rewards")
+	}
+}
+
+func TestPoA_UnauthorizedSigner(t *testing.T) {
+	_, andrej := generateKey(t)
+	mallory, _ := generateKey(t)
+
+	engine := New(1, []common.Address{andrej})
+
+	state, dataDir := newTestState(t, engine, []common.Address{andrej})
+	defer fs.RemoveDir(dataDir)
+	defer state.Close()
+
+	engine.Authorize(mallory)
+
+	block := database.NewBlock(database.Hash{}, 0, 0, uint64(time.Now().Unix()), andrej, DiffInTurn, nil)
+	if err := engine.Prepare(state, &block.Header); err != ErrUnauthorizedSigner {
+		t.Fatalf("expected '%v', got '%v'", ErrUnauthorizedSigner, err)
+	}
+
+	// Forge the block sealing it with a key outside of the signers set
+	hash, err := SealHash(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block.Header.Signature, err = crypto.Sign(hash[:], mallory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := state.AddBlock(block); err == nil {
+		t.Fatal("a block sealed by an unauthorized signer is not suppose to be valid")
+	}
+}
+
+func sealAndAdd(t *testing.T, engine *PoA, state *database.State, key *ecdsa.PrivateKey) {
+	engine.Authorize(key)
+
+	block := database.NewBlock(state.LatestBlockHash(), state.NextBlockNumber(), 0, uint64(time.Now().Unix()), common.Address{}, 0, nil)
+	if err := engine.Prepare(state, &block.Header); err != nil {
+		t.Fatal(err)
+	}
+
+	block, err := engine.Seal(context.Background(), block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := state.AddBlock(block); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestState(t *testing.T, engine *PoA, signers []common.Address) (*database.State, string) {
+	dataDir, err := ioutil.TempDir(os.TempDir(), "tbb_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	genesisJson, err := json.Marshal(database.Genesis{Balances: map[common.Address]uint{}, Consensus: Name, Signers: signers, Period: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = database.InitDataDirIfNotExists(dataDir, genesisJson)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := database.NewStateFromDisk(dataDir, engine)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return state, dataDir
+}
+
+func generateKey(t *testing.T) (*ecdsa.PrivateKey, common.Address) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key, crypto.PubkeyToAddress(key.PublicKey)
+}
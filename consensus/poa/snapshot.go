@@ -0,0 +1,197 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package poa
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/IacopoMelani/the-blockchain-pub/database"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Snapshot is the state of the authorization voting at a given block.
+type Snapshot struct {
+	Number  uint64                                     `json:"number"`
+	Hash    database.Hash                              `json:"hash"`
+	Signers map[common.Address]struct{}                `json:"signers"`
+	Recents map[uint64]common.Address                  `json:"recents"`
+	Votes   map[common.Address]map[common.Address]bool `json:"votes"`
+}
+
+func newGenesisSnapshot(signers []common.Address) *Snapshot {
+	snap := &Snapshot{
+		Signers: make(map[common.Address]struct{}),
+		Recents: make(map[uint64]common.Address),
+		Votes:   make(map[common.Address]map[common.Address]bool),
+	}
+
+	for _, signer := range signers {
+		snap.Signers[signer] = struct{}{}
+	}
+
+	return snap
+}
+
+func (snap *Snapshot) copy() *Snapshot {
+	cpy := &Snapshot{
+		Number:  snap.Number,
+		Hash:    snap.Hash,
+		Signers: make(map[common.Address]struct{}),
+		Recents: make(map[uint64]common.Address),
+		Votes:   make(map[common.Address]map[common.Address]bool),
+	}
+
+	for signer := range snap.Signers {
+		cpy.Signers[signer] = struct{}{}
+	}
+
+	for number, signer := range snap.Recents {
+		cpy.Recents[number] = signer
+	}
+
+	for candidate, votes := range snap.Votes {
+		cpy.Votes[candidate] = make(map[common.Address]bool)
+		for signer, authorize := range votes {
+			cpy.Votes[candidate][signer] = authorize
+		}
+	}
+
+	return cpy
+}
+
+// SignersList returns the authorized signers in ascending order.
+func (snap *Snapshot) SignersList() []common.Address {
+	signers := make([]common.Address, 0, len(snap.Signers))
+	for signer := range snap.Signers {
+		signers = append(signers, signer)
+	}
+
+	sort.Slice(signers, func(i, j int) bool {
+		return signers[i].Hex() < signers[j].Hex()
+	})
+
+	return signers
+}
+
+func (snap *Snapshot) isSigner(acc common.Address) bool {
+	_, ok := snap.Signers[acc]
+
+	return ok
+}
+
+// inturn returns if the signer is the one expected to seal the block at the given height.
+func (snap *Snapshot) inturn(number uint64, signer common.Address) bool {
+	signers := snap.SignersList()
+	if len(signers) == 0 {
+		return false
+	}
+
+	return signers[number%uint64(len(signers))] == signer
+}
+
+// recentlySigned returns if the signer sealed one of the last len(signers)/2+1 blocks before the given height.
+func (snap *Snapshot) recentlySigned(number uint64, signer common.Address) bool {
+	limit := uint64(len(snap.Signers)/2 + 1)
+
+	for seen, recent := range snap.Recents {
+		if recent != signer {
+			continue
+		}
+
+		if number < limit || seen > number-limit {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validVote returns if the vote would change the signers set.
+func (snap *Snapshot) validVote(candidate common.Address, authorize bool) bool {
+	return snap.isSigner(candidate) != authorize
+}
+
+// apply creates a new snapshot by applying the sealed block header on top of this one.
+func (snap *Snapshot) apply(hash database.Hash, header database.BlockHeader, signer common.Address) (*Snapshot, error) {
+	if !snap.isSigner(signer) {
+		return nil, fmt.Errorf("unauthorized signer '%s'", signer.Hex())
+	}
+
+	cpy := snap.copy()
+
+	limit := uint64(len(cpy.Signers)/2 + 1)
+	if header.Number >= limit {
+		delete(cpy.Recents, header.Number-limit)
+	}
+	cpy.Recents[header.Number] = signer
+
+	cpy.Number = header.Number
+	cpy.Hash = hash
+
+	if header.Candidate != nil {
+		cpy.vote(signer, *header.Candidate, header.Authorize)
+	}
+
+	return cpy, nil
+}
+
+// vote records the signer vote and updates the signers set once the candidate collects a majority.
+func (snap *Snapshot) vote(signer, candidate common.Address, authorize bool) {
+	if !snap.validVote(candidate, authorize) {
+		return
+	}
+
+	if _, ok := snap.Votes[candidate]; !ok {
+		snap.Votes[candidate] = make(map[common.Address]bool)
+	}
+	snap.Votes[candidate][signer] = authorize
+
+	tally := 0
+	for voter, vote := range snap.Votes[candidate] {
+		if vote == authorize && snap.isSigner(voter) {
+			tally++
+		}
+	}
+
+	if tally <= len(snap.Signers)/2 {
+		return
+	}
+
+	if authorize {
+		snap.Signers[candidate] = struct{}{}
+	} else {
+		delete(snap.Signers, candidate)
+
+		// Discard the votes the dropped signer cast
+		for other, votes := range snap.Votes {
+			delete(votes, candidate)
+			if len(votes) == 0 {
+				delete(snap.Votes, other)
+			}
+		}
+
+		// Let the remaining signers seal again sooner as the signers set shrank
+		limit := uint64(len(snap.Signers)/2 + 1)
+		for number := range snap.Recents {
+			if snap.Number >= limit && number <= snap.Number-limit {
+				delete(snap.Recents, number)
+			}
+		}
+	}
+
+	delete(snap.Votes, candidate)
+}
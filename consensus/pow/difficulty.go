@@ -0,0 +1,108 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package pow
+
+import (
+	"math"
+	"math/big"
+	"time"
+
+	"github.com/IacopoMelani/the-blockchain-pub/database"
+)
+
+const MiningAproxTime = 30 * time.Second
+
+// Number of blocks the LWMA retarget averages the solve times over
+const LWMAWindow = 45
+
+// Solve times are clamped to [1s, maxSolveTimeFactor * MiningAproxTime] so a single
+// wrong timestamp can't swing the difficulty
+const maxSolveTimeFactor = 6
+
+// The difficulty can change at most by a factor of maxAdjustNum/maxAdjustDen per block
+const maxAdjustNum = 3
+const maxAdjustDen = 2
+
+var two256 = new(big.Int).Lsh(big.NewInt(1), 256)
+
+// Target returns the maximum hash value, 2^256 / difficulty, a block of the given difficulty may have.
+func Target(difficulty uint64) *big.Int {
+	if difficulty == 0 {
+		difficulty = 1
+	}
+
+	return new(big.Int).Div(two256, new(big.Int).SetUint64(difficulty))
+}
+
+// NextDifficulty computes the difficulty of the block following the given headers, oldest first,
+// using a Linearly Weighted Moving Average of the latest LWMAWindow solve times.
+//
+// Until the window is full the difficulty stays the same as the latest block one.
+func NextDifficulty(headers []database.BlockHeader) uint64 {
+	parent := headers[len(headers)-1]
+	if len(headers) < LWMAWindow+1 {
+		return parent.Difficulty
+	}
+
+	window := headers[len(headers)-LWMAWindow-1:]
+	targetTime := int64(MiningAproxTime / time.Second)
+
+	weightedSolveTimes := int64(0)
+	sumDifficulties := new(big.Int)
+
+	for i := 1; i <= LWMAWindow; i++ {
+		solveTime := int64(window[i].Time) - int64(window[i-1].Time)
+		if solveTime < 1 {
+			solveTime = 1
+		}
+		if solveTime > maxSolveTimeFactor*targetTime {
+			solveTime = maxSolveTimeFactor * targetTime
+		}
+
+		weightedSolveTimes += solveTime * int64(i)
+		sumDifficulties.Add(sumDifficulties, new(big.Int).SetUint64(window[i].Difficulty))
+	}
+
+	// next = average difficulty * target time / weighted average solve time
+	weightsSum := int64(LWMAWindow * (LWMAWindow + 1) / 2)
+
+	next := new(big.Int).Mul(sumDifficulties, big.NewInt(targetTime*weightsSum))
+	next.Div(next, big.NewInt(int64(LWMAWindow)*weightedSolveTimes))
+
+	parentDifficulty := new(big.Int).SetUint64(parent.Difficulty)
+
+	maxNext := new(big.Int).Mul(parentDifficulty, big.NewInt(maxAdjustNum))
+	maxNext.Div(maxNext, big.NewInt(maxAdjustDen))
+	if next.Cmp(maxNext) > 0 {
+		next = maxNext
+	}
+
+	minNext := new(big.Int).Mul(parentDifficulty, big.NewInt(maxAdjustDen))
+	minNext.Div(minNext, big.NewInt(maxAdjustNum))
+	if next.Cmp(minNext) < 0 {
+		next = minNext
+	}
+
+	if next.Sign() <= 0 {
+		return 1
+	}
+
+	if !next.IsUint64() {
+		return math.MaxUint64
+	}
+
+	return next.Uint64()
+}
@@ -0,0 +1,147 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package pow
+
+import (
+	"encoding/hex"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/IacopoMelani/the-blockchain-pub/database"
+)
+
+func TestTargetComparison(t *testing.T) {
+	var hash database.Hash
+
+	// 2^256 / 2^16 = 0x0001000...0
+	hex.Decode(hash[:], []byte("0000ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff"))
+	if !IsBlockHashValid(hash, 1<<16) {
+		t.Fatal("hash below the target is suppose to be valid")
+	}
+
+	hex.Decode(hash[:], []byte("0001000000000000000000000000000000000000000000000000000000000001"))
+	if IsBlockHashValid(hash, 1<<16) {
+		t.Fatal("hash above the target is not suppose to be valid")
+	}
+
+	// A difficulty of 3 is between 1 and 2 zero bits, something a leading zero bytes check can't express
+	hex.Decode(hash[:], []byte("5000000000000000000000000000000000000000000000000000000000000000"))
+	if !IsBlockHashValid(hash, 3) {
+		t.Fatal("hash below 2^256/3 is suppose to be valid")
+	}
+
+	hex.Decode(hash[:], []byte("6000000000000000000000000000000000000000000000000000000000000000"))
+	if IsBlockHashValid(hash, 3) {
+		t.Fatal("hash above 2^256/3 is not suppose to be valid")
+	}
+}
+
+func TestNextDifficultyMatchesReference(t *testing.T) {
+	headers := simulateChain(rand.New(rand.NewSource(1)), 1000, 100, 200)
+
+	for i := LWMAWindow + 1; i < len(headers); i++ {
+		expected := lwmaReference(headers[:i])
+		if next := float64(NextDifficulty(headers[:i])); math.Abs(next-expected) > 1 {
+			t.Fatalf("block %d difficulty %.0f differs from the reference LWMA %.2f", i, next, expected)
+		}
+
+		if headers[i].Difficulty != NextDifficulty(headers[:i]) {
+			t.Fatalf("block %d difficulty doesn't follow the retarget", i)
+		}
+	}
+}
+
+// Simulates a miner whose hashrate jumps 10x and verifies the block time converges back to MiningAproxTime.
+func TestNextDifficultyConvergence(t *testing.T) {
+	for seed := int64(0); seed < 10; seed++ {
+		r := rand.New(rand.NewSource(seed))
+		targetTime := float64(MiningAproxTime / time.Second)
+
+		headers := simulateChain(r, 1000, 100, 400)
+		assertConverged(t, headers[len(headers)-200:], 100*targetTime)
+
+		headers = continueChain(r, headers, 1000, 400)
+		assertConverged(t, headers[len(headers)-200:], 1000*targetTime)
+	}
+}
+
+// lwmaReference computes the LWMA retarget in floating point, apart from the big.Int arithmetic of NextDifficulty.
+func lwmaReference(headers []database.BlockHeader) float64 {
+	targetTime := float64(MiningAproxTime / time.Second)
+	window := headers[len(headers)-LWMAWindow-1:]
+
+	weightedSolveTimes, avgDifficulty := 0.0, 0.0
+	for i := 1; i <= LWMAWindow; i++ {
+		solveTime := float64(int64(window[i].Time) - int64(window[i-1].Time))
+		solveTime = math.Min(math.Max(solveTime, 1), maxSolveTimeFactor*targetTime)
+
+		weightedSolveTimes += solveTime * float64(i) / float64(LWMAWindow*(LWMAWindow+1)/2)
+		avgDifficulty += float64(window[i].Difficulty) / LWMAWindow
+	}
+
+	parentDifficulty := float64(headers[len(headers)-1].Difficulty)
+	next := avgDifficulty * targetTime / weightedSolveTimes
+
+	return math.Min(math.Max(next, parentDifficulty*maxAdjustDen/maxAdjustNum), parentDifficulty*maxAdjustNum/maxAdjustDen)
+}
+
+func assertConverged(t *testing.T, headers []database.BlockHeader, expectedDifficulty float64) {
+	t.Helper()
+
+	targetTime := float64(MiningAproxTime / time.Second)
+
+	avgSolveTime := float64(headers[len(headers)-1].Time-headers[0].Time) / float64(len(headers)-1)
+	if math.Abs(avgSolveTime-targetTime)/targetTime > 0.1 {
+		t.Fatalf("average solve time %.2fs didn't converge to %.0fs", avgSolveTime, targetTime)
+	}
+
+	avgDifficulty := float64(0)
+	for _, header := range headers {
+		avgDifficulty += float64(header.Difficulty)
+	}
+	avgDifficulty /= float64(len(headers))
+
+	if math.Abs(avgDifficulty-expectedDifficulty)/expectedDifficulty > 0.25 {
+		t.Fatalf("average difficulty %.0f didn't converge to %.0f", avgDifficulty, expectedDifficulty)
+	}
+
+	t.Logf("average solve time: %.2fs, average difficulty: %.0f", avgSolveTime, avgDifficulty)
+}
+
+func simulateChain(r *rand.Rand, initialDifficulty uint64, hashrate float64, blocks int) []database.BlockHeader {
+	genesis := database.BlockHeader{Number: 0, Time: 1600000000, Difficulty: initialDifficulty}
+
+	return continueChain(r, []database.BlockHeader{genesis}, hashrate, blocks)
+}
+
+// continueChain mines the blocks with exponentially distributed solve times for the given hashes per second.
+func continueChain(r *rand.Rand, headers []database.BlockHeader, hashrate float64, blocks int) []database.BlockHeader {
+	for i := 0; i < blocks; i++ {
+		parent := headers[len(headers)-1]
+		difficulty := NextDifficulty(headers)
+		solveTime := r.ExpFloat64() * float64(difficulty) / hashrate
+
+		headers = append(headers, database.BlockHeader{
+			Number:     parent.Number + 1,
+			Time:       parent.Time + uint64(math.Round(solveTime)),
+			Difficulty: difficulty,
+		})
+	}
+
+	return headers
+}
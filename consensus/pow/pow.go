@@ -0,0 +1,158 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package pow
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"runtime"
+	"time"
+
+	"github.com/IacopoMelani/the-blockchain-pub/database"
+)
+
+const Name = "pow"
+
+// MaxFutureBlockTime bounds how far past the local clock a block may be dated,
+// post-dated blocks would lower the difficulty the LWMA retargets to
+const MaxFutureBlockTime = 4 * MiningAproxTime
+
+var ErrFutureBlock = errors.New("block time too far in the future")
+
+// PoW is the Proof of Work consensus engine: a block is valid when its hash is below the target
+// of its header difficulty, i.e: 2^256 / difficulty.
+type PoW struct {
+	// Hashes tried by the current sealing
+	attempts uint64
+
+	// Hashes per second of the latest sealing, stored as math.Float64bits
+	hashrate uint64
+
+	// Number of goroutines splitting the nonce space while sealing
+	threads int
+}
+
+func New() *PoW {
+	return NewWithThreads(runtime.NumCPU())
+}
+
+func NewWithThreads(threads int) *PoW {
+	if threads <= 0 {
+		threads = runtime.NumCPU()
+	}
+
+	return &PoW{threads: threads}
+}
+
+func (p *PoW) Name() string {
+	return Name
+}
+
+func (p *PoW) VerifyHeader(s *database.State, b database.Block) error {
+	if maxTime := time.Now().Add(MaxFutureBlockTime).Unix(); b.Header.Time > uint64(maxTime) {
+		return fmt.Errorf("%w. Block time is '%d', the latest allowed is '%d'", ErrFutureBlock, b.Header.Time, maxTime)
+	}
+
+	hash, err := b.Hash()
+	if err != nil {
+		return err
+	}
+
+	if !IsBlockHashValid(hash, b.Header.Difficulty) {
+		return fmt.Errorf("invalid block hash %x", hash)
+	}
+
+	// The genesis block sets the initial difficulty, the next ones must follow the retarget
+	if headers := s.RecentHeaders(); len(headers) > 0 {
+		expected := NextDifficulty(headers)
+		if b.Header.Difficulty != expected {
+			return fmt.Errorf("invalid block difficulty '%d', expected '%d'", b.Header.Difficulty, expected)
+		}
+	}
+
+	return nil
+}
+
+// VerifyHeaders checks a chain of headers, on top of the parents headers oldest first, before its blocks are downloaded:
+// every header must not be post-dated, its hash must meet its difficulty and the difficulty must follow the retarget.
+//
+// The hashes are the ones claimed by the peer, the blocks still get the full VerifyHeader once downloaded.
+func (p *PoW) VerifyHeaders(parents []database.BlockHeader, headers []database.HeaderFS) error {
+	maxTime := uint64(time.Now().Add(MaxFutureBlockTime).Unix())
+
+	recent := append([]database.BlockHeader{}, parents...)
+
+	for _, header := range headers {
+		if header.Value.Time > maxTime {
+			return fmt.Errorf("%w. Header '%d' time is '%d', the latest allowed is '%d'", ErrFutureBlock, header.Value.Number, header.Value.Time, maxTime)
+		}
+
+		if !IsBlockHashValid(header.Key, header.Value.Difficulty) {
+			return fmt.Errorf("invalid header '%d' hash '%x' for difficulty %d", header.Value.Number, header.Key, header.Value.Difficulty)
+		}
+
+		if len(recent) > 0 {
+			expected := NextDifficulty(recent)
+			if header.Value.Difficulty != expected {
+				return fmt.Errorf("invalid header '%d' difficulty '%d', expected '%d'", header.Value.Number, header.Value.Difficulty, expected)
+			}
+		}
+
+		recent = append(recent, header.Value)
+		if len(recent) > database.RecentHeadersLimit {
+			recent = recent[len(recent)-database.RecentHeadersLimit:]
+		}
+	}
+
+	return nil
+}
+
+// Prepare is a no-op, the node sets the PoW difficulty itself.
+func (p *PoW) Prepare(s *database.State, header *database.BlockHeader) error {
+	return nil
+}
+
+func (p *PoW) Finalize(s *database.State, b database.Block) error {
+	s.Balances[b.Header.Miner] += database.BlockReward
+	s.Balances[b.Header.Miner] += b.Fees()
+
+	return nil
+}
+
+// CalcDifficulty returns the LWMA difficulty of the block on top of the state latest block,
+// or the current difficulty if the chain is empty.
+func (p *PoW) CalcDifficulty(s *database.State, current uint64) (uint64, error) {
+	headers := s.RecentHeaders()
+	if len(headers) == 0 {
+		return current, nil
+	}
+
+	return NextDifficulty(headers), nil
+}
+
+// IsBlockHashValid checks the hash, as a 256-bit big-endian number, is below the difficulty target.
+func IsBlockHashValid(hash database.Hash, miningDifficulty uint64) bool {
+	if miningDifficulty == 0 {
+		return false
+	}
+
+	return hashToBig(hash).Cmp(Target(miningDifficulty)) <= 0
+}
+
+func hashToBig(hash database.Hash) *big.Int {
+	return new(big.Int).SetBytes(hash[:])
+}
@@ -0,0 +1,103 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package pow
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/IacopoMelani/the-blockchain-pub/database"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestVerifyHeaderFutureTime(t *testing.T) {
+	dataDir := t.TempDir()
+
+	genesisJson, err := json.Marshal(database.Genesis{Balances: map[common.Address]uint{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = database.InitDataDirIfNotExists(dataDir, genesisJson)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	engine := NewWithThreads(1)
+
+	state, err := database.NewStateFromDisk(dataDir, engine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	seal := func(blockTime time.Time) database.Block {
+		block := database.NewBlock(database.Hash{}, 0, 0, uint64(blockTime.Unix()), common.HexToAddress("0x03"), 1<<4, nil)
+
+		block, err := engine.Seal(context.Background(), block)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return block
+	}
+
+	err = engine.VerifyHeader(state, seal(time.Now().Add(MaxFutureBlockTime/2)))
+	if err != nil {
+		t.Fatalf("a block dated within the allowed drift is suppose to be valid, got '%v'", err)
+	}
+
+	err = engine.VerifyHeader(state, seal(time.Now().Add(MaxFutureBlockTime+time.Minute)))
+	if !errors.Is(err, ErrFutureBlock) {
+		t.Fatalf("expected '%v', got '%v'", ErrFutureBlock, err)
+	}
+}
+
+func TestVerifyHeadersRetarget(t *testing.T) {
+	engine := NewWithThreads(1)
+
+	// Blocks found every second raise the difficulty once the window is full
+	parents := make([]database.BlockHeader, LWMAWindow+1)
+	for i := range parents {
+		parents[i] = database.BlockHeader{Number: uint64(i), Time: uint64(i), Difficulty: 1 << 4}
+	}
+
+	expected := NextDifficulty(parents)
+	if expected == parents[len(parents)-1].Difficulty {
+		t.Fatalf("the difficulty is suppose to be retargeted, got '%d'", expected)
+	}
+
+	header := func(difficulty uint64, blockTime uint64) database.HeaderFS {
+		return database.HeaderFS{Value: database.BlockHeader{Number: uint64(len(parents)), Time: blockTime, Difficulty: difficulty}}
+	}
+
+	err := engine.VerifyHeaders(parents, []database.HeaderFS{header(expected, uint64(len(parents)))})
+	if err != nil {
+		t.Fatalf("a header following the retarget is suppose to be valid, got '%v'", err)
+	}
+
+	if engine.VerifyHeaders(parents, []database.HeaderFS{header(1, uint64(len(parents)))}) == nil {
+		t.Fatal("a header not following the retarget is not suppose to be valid")
+	}
+
+	err = engine.VerifyHeaders(parents, []database.HeaderFS{header(expected, uint64(time.Now().Add(MaxFutureBlockTime+time.Minute).Unix()))})
+	if !errors.Is(err, ErrFutureBlock) {
+		t.Fatalf("expected '%v', got '%v'", ErrFutureBlock, err)
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package pow
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IacopoMelani/the-blockchain-pub/database"
+)
+
+// The nonce space every sealing round splits across the workers
+var maxNonce uint64 = math.MaxUint32
+
+// Workers check the cancellation and report their attempts every checkInterval hashes
+const checkInterval = 1 << 12
+
+const hashrateReportInterval = 10 * time.Second
+
+// sealTemplate is the JSON encoding of a block split around its header nonce, with the
+// SHA256 state of the prefix pre-computed, so every attempt only hashes the nonce and the suffix.
+type sealTemplate struct {
+	prefixState []byte
+	suffix      []byte
+}
+
+func newSealTemplate(b database.Block) (sealTemplate, error) {
+	b.Header.Nonce = 0
+
+	blockJson, err := json.Marshal(b)
+	if err != nil {
+		return sealTemplate{}, err
+	}
+
+	// The header is encoded first, so the first nonce field is the header one
+	nonceField := []byte(`"nonce":0`)
+	i := bytes.Index(blockJson, nonceField)
+	if i < 0 {
+		return sealTemplate{}, errors.New("nonce not found in the block encoding")
+	}
+	prefixEnd := i + len(nonceField) - 1
+
+	h := sha256.New()
+	h.Write(blockJson[:prefixEnd])
+
+	prefixState, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return sealTemplate{}, err
+	}
+
+	return sealTemplate{prefixState, blockJson[prefixEnd+1:]}, nil
+}
+
+// hash returns the block hash for the given nonce, reusing the worker hasher and buffer.
+func (t sealTemplate) hash(h hashState, buf []byte, nonce uint32) (database.Hash, error) {
+	var hash database.Hash
+
+	if err := h.UnmarshalBinary(t.prefixState); err != nil {
+		return hash, err
+	}
+
+	h.Write(strconv.AppendUint(buf[:0], uint64(nonce), 10))
+	h.Write(t.suffix)
+	h.Sum(hash[:0])
+
+	return hash, nil
+}
+
+type hashState interface {
+	encoding.BinaryUnmarshaler
+	Write(p []byte) (int, error)
+	Sum(b []byte) []byte
+}
+
+// Seal searches for a nonce making the block hash valid for the block difficulty.
+//
+// The nonce space is split across the engine threads; once it's exhausted the block time
+// is rolled forward and the search starts again.
+func (p *PoW) Seal(ctx context.Context, b database.Block) (database.Block, error) {
+
+	start := time.Now()
+	lastReport := start
+	attempts := &p.attempts
+	atomic.StoreUint64(attempts, 0)
+	block := b
+
+	fmt.Printf("Mining %d Pending TXs using %d threads\n", len(b.TXs), p.threads)
+
+	for {
+		template, err := newSealTemplate(block)
+		if err != nil {
+			return database.Block{}, fmt.Errorf("couldn't mine block. %s", err.Error())
+		}
+
+		nonce, found, err := p.search(ctx, template, block.Header.Difficulty, attempts, func() {
+			if time.Since(lastReport) >= hashrateReportInterval {
+				lastReport = time.Now()
+				fmt.Printf("Mining %d Pending TXs. Attempt: %d, Hashrate: %.0f H/s\n", len(b.TXs), atomic.LoadUint64(attempts), p.Hashrate())
+			}
+		}, start)
+		if err != nil {
+			fmt.Println("Mining cancelled!")
+
+			return database.Block{}, err
+		}
+
+		if found {
+			block.Header.Nonce = nonce
+			break
+		}
+
+		// Nonce space exhausted, roll the timestamp to get a fresh one
+		now := uint64(time.Now().Unix())
+		if now > block.Header.Time {
+			block.Header.Time = now
+		} else {
+			block.Header.Time++
+		}
+	}
+
+	hash, err := block.Hash()
+	if err != nil {
+		return database.Block{}, fmt.Errorf("couldn't mine block. %s", err.Error())
+	}
+
+	if !IsBlockHashValid(hash, block.Header.Difficulty) {
+		return database.Block{}, fmt.Errorf("couldn't mine block. sealed hash %x doesn't match the block encoding", hash)
+	}
+
+	fmt.Printf("\nMined new Block '%x' using PoW 🎉🎉🎉\n", hash)
+	fmt.Printf("\tHeight: '%v'\n", block.Header.Number)
+	fmt.Printf("\tNonce: '%v'\n", block.Header.Nonce)
+	fmt.Printf("\tDifficulty: '%v'\n", block.Header.Difficulty)
+	fmt.Printf("\tCreated: '%v'\n", block.Header.Time)
+	fmt.Printf("\tMiner: '%v'\n", block.Header.Miner.String())
+	fmt.Printf("\tParent: '%v'\n\n", block.Header.Parent.Hex())
+
+	fmt.Printf("\tAttempt: '%v'\n", atomic.LoadUint64(attempts))
+	fmt.Printf("\tHashrate: '%.0f H/s'\n", p.Hashrate())
+	fmt.Printf("\tTime: %s\n\n", time.Since(start))
+
+	return block, nil
+}
+
+// search runs the workers over the whole nonce space, each one trying every p.threads-th nonce.
+func (p *PoW) search(ctx context.Context, template sealTemplate, difficulty uint64, attempts *uint64, report func(), start time.Time) (uint32, bool, error) {
+	searchCtx, stopSearch := context.WithCancel(ctx)
+	defer stopSearch()
+
+	target := Target(difficulty)
+
+	var wg sync.WaitGroup
+	var reportLock sync.Mutex
+	var found uint32
+	var isFound int32
+	var workerErr error
+
+	for worker := 0; worker < p.threads; worker++ {
+		wg.Add(1)
+
+		go func(first uint64) {
+			defer wg.Done()
+
+			h := sha256.New().(hashState)
+			buf := make([]byte, 0, 10)
+			tried := uint64(0)
+
+			for nonce := first; nonce <= maxNonce; nonce += uint64(p.threads) {
+				hash, err := template.hash(h, buf, uint32(nonce))
+				if err != nil {
+					reportLock.Lock()
+					workerErr = err
+					reportLock.Unlock()
+					stopSearch()
+					return
+				}
+				tried++
+
+				if hashToBig(hash).Cmp(target) <= 0 {
+					// A seal found after the cancellation, or past the deadline not fired yet, is stale
+					if searchCtx.Err() != nil || isPastDeadline(ctx) {
+						return
+					}
+
+					if atomic.CompareAndSwapInt32(&isFound, 0, 1) {
+						found = uint32(nonce)
+						stopSearch()
+					}
+					break
+				}
+
+				if tried%checkInterval == 0 {
+					p.recordAttempts(attempts, tried, start)
+					tried = 0
+
+					reportLock.Lock()
+					report()
+					reportLock.Unlock()
+
+					if searchCtx.Err() != nil {
+						return
+					}
+				}
+			}
+
+			p.recordAttempts(attempts, tried, start)
+		}(uint64(worker))
+	}
+
+	wg.Wait()
+
+	if atomic.LoadInt32(&isFound) == 1 {
+		return found, true, nil
+	}
+
+	if workerErr != nil {
+		return 0, false, fmt.Errorf("couldn't mine block. %s", workerErr.Error())
+	}
+
+	if ctx.Err() != nil {
+		return 0, false, fmt.Errorf("mining cancelled. %s", ctx.Err())
+	}
+
+	return 0, false, nil
+}
+
+func isPastDeadline(ctx context.Context) bool {
+	deadline, ok := ctx.Deadline()
+	return ok && !time.Now().Before(deadline)
+}
+
+func (p *PoW) recordAttempts(attempts *uint64, tried uint64, start time.Time) {
+	total := atomic.AddUint64(attempts, tried)
+
+	elapsed := time.Since(start).Seconds()
+	if elapsed > 0 {
+		atomic.StoreUint64(&p.hashrate, math.Float64bits(float64(total)/elapsed))
+	}
+}
+
+// Attempts returns the number of hashes tried by the current, or latest, sealing.
+func (p *PoW) Attempts() uint64 {
+	return atomic.LoadUint64(&p.attempts)
+}
+
+// Hashrate returns the hashes per second of the latest sealing.
+func (p *PoW) Hashrate() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&p.hashrate))
+}
+
+// Threads returns the number of goroutines sealing the blocks.
+func (p *PoW) Threads() int {
+	return p.threads
+}
@@ -0,0 +1,109 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package pow
+
+import (
+	"context"
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"github.com/IacopoMelani/the-blockchain-pub/database"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestSealTemplateMatchesBlockHash(t *testing.T) {
+	block := testBlock()
+
+	template, err := newSealTemplate(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := sha256.New().(hashState)
+	for _, nonce := range []uint32{0, 7, 123456, 4294967295} {
+		block.Header.Nonce = nonce
+
+		expected, err := block.Hash()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hash, err := template.hash(h, nil, nonce)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if hash != expected {
+			t.Fatalf("nonce %d: template hash %x, block hash %x", nonce, hash, expected)
+		}
+	}
+}
+
+func TestSealMultiThreaded(t *testing.T) {
+	engine := NewWithThreads(4)
+
+	block, err := engine.Seal(context.Background(), testBlock())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := block.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !IsBlockHashValid(hash, block.Header.Difficulty) {
+		t.Fatalf("sealed block hash %x is not valid", hash)
+	}
+
+	if engine.Hashrate() <= 0 {
+		t.Fatal("hashrate is suppose to be reported")
+	}
+}
+
+func TestSealRollsTimeOnNonceExhaustion(t *testing.T) {
+	defer func(original uint64) { maxNonce = original }(maxNonce)
+	maxNonce = 1
+
+	block := testBlock()
+	block.Header.Difficulty = 1 << 16
+	block.Header.Time = uint64(time.Now().Unix()) + 60
+
+	sealed, err := NewWithThreads(2).Seal(context.Background(), block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := sealed.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !IsBlockHashValid(hash, sealed.Header.Difficulty) {
+		t.Fatalf("sealed block hash %x is not valid", hash)
+	}
+
+	if sealed.Header.Time <= block.Header.Time {
+		t.Fatal("block time is suppose to roll once the 2 nonces are exhausted")
+	}
+}
+
+func testBlock() database.Block {
+	tx := database.NewSignedTx(database.NewTx(common.HexToAddress("0x01"), common.HexToAddress("0x02"), 5, 1, `"nonce":0`), []byte{1, 2, 3})
+
+	return database.NewBlock(database.Hash{1}, 3, 0, uint64(time.Now().Unix()), common.HexToAddress("0x03"), 1<<14, []database.SignedTx{tx})
+}
@@ -20,17 +20,12 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
-	"fmt"
-	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 )
 
 const BlockReward = 100
 
-const MiningAproxTime = 30 * time.Second
-const BlockNumberToCheckDifficulty = 10
-
 type Hash [32]byte
 
 func (h Hash) MarshalText() ([]byte, error) {
@@ -64,6 +59,11 @@ type BlockHeader struct {
 	Time       uint64         `json:"time"`
 	Miner      common.Address `json:"miner"`
 	Difficulty uint64         `json:"difficulty"`
+
+	// Proof of Authority only: the sealer signature and its optional vote to authorize or drop a signer
+	Candidate *common.Address `json:"candidate,omitempty"`
+	Authorize bool            `json:"authorize,omitempty"`
+	Signature []byte          `json:"signature,omitempty"`
 }
 
 type BlockFS struct {
@@ -71,8 +71,23 @@ type BlockFS struct {
 	Value Block `json:"block"`
 }
 
+type HeaderFS struct {
+	Key   Hash        `json:"hash"`
+	Value BlockHeader `json:"header"`
+}
+
 func NewBlock(parent Hash, number uint64, nonce uint32, time uint64, miner common.Address, difficulty uint64, txs []SignedTx) Block {
-	return Block{BlockHeader{parent, number, nonce, time, miner, difficulty}, txs}
+	return Block{BlockHeader{Parent: parent, Number: number, Nonce: nonce, Time: time, Miner: miner, Difficulty: difficulty}, txs}
+}
+
+// Fees returns the sum of the fees the block's TXs pay to the miner.
+func (b Block) Fees() uint {
+	fees := uint(0)
+	for _, tx := range b.TXs {
+		fees += tx.EffectiveFee()
+	}
+
+	return fees
 }
 
 func (b Block) Hash() (Hash, error) {
@@ -83,19 +98,3 @@ func (b Block) Hash() (Hash, error) {
 
 	return sha256.Sum256(blockJson), nil
 }
-
-func IsBlockHashValid(hash Hash, miningDifficulty uint64) bool {
-	zeroesCount := uint64(0)
-
-	for i := uint64(0); i < miningDifficulty; i++ {
-		if fmt.Sprintf("%x", hash[i]) == "0" {
-			zeroesCount++
-		}
-	}
-
-	if fmt.Sprintf("%x", hash[miningDifficulty]) == "0" {
-		return false
-	}
-
-	return zeroesCount == miningDifficulty
-}
@@ -0,0 +1,25 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package database
+
+// Consensus is the part of a consensus engine the State relies on.
+//
+// VerifyHeader checks the block against the consensus rules given the state before the block,
+// Finalize credits the block rewards once all the block TXs were applied.
+type Consensus interface {
+	VerifyHeader(s *State, b Block) error
+	Finalize(s *State, b Block) error
+}
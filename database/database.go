@@ -27,6 +27,7 @@ func GetBlocksAfter(blockHash Hash, last int64, dataDir string) ([]BlockFS, erro
 	if err != nil {
 		return nil, err
 	}
+	defer f.Close()
 
 	blocks := make([]BlockFS, 0)
 	shouldStartCollecting := false
@@ -72,6 +73,7 @@ func GetBlocksBefore(blockHash Hash, last int64, dataDir string) ([]BlockFS, err
 	if err != nil {
 		return nil, err
 	}
+	defer f.Close()
 
 	blocks := make([]BlockFS, 0)
 
@@ -105,3 +107,18 @@ func GetBlocksBefore(blockHash Hash, last int64, dataDir string) ([]BlockFS, err
 
 	return blocks[0:last], nil
 }
+
+// GetHeadersAfter returns up to the last block headers persisted after the given block hash, without the TXs.
+func GetHeadersAfter(blockHash Hash, last int64, dataDir string) ([]HeaderFS, error) {
+	blocks, err := GetBlocksAfter(blockHash, last, dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := make([]HeaderFS, len(blocks))
+	for i, block := range blocks {
+		headers[i] = HeaderFS{Key: block.Key, Value: block.Value.Header}
+	}
+
+	return headers, nil
+}
@@ -53,6 +53,10 @@ func getBlocksDbFilePath(dataDir string) string {
 	return filepath.Join(getDatabaseDirPath(dataDir), "block.db")
 }
 
+func getReceiptsDbFilePath(dataDir string) string {
+	return filepath.Join(getDatabaseDirPath(dataDir), "receipts.db")
+}
+
 func fileExist(filePath string) bool {
 	_, err := os.Stat(filePath)
 	if err != nil && os.IsNotExist(err) {
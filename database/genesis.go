@@ -16,6 +16,7 @@
 package database
 
 import (
+	"crypto/sha256"
 	"encoding/json"
 	"io/ioutil"
 
@@ -26,14 +27,46 @@ var genesisJson = `{
   "genesis_time": "2020-06-01T00:00:00.000000000Z",
   "chain_id": "the-blockchain-pub-ledger",
   "symbol": "TBP",
+  "consensus": "pow",
   "balances": {
     "0x50543e830590fD03a0301fAA0164d731f0E2ff7D": 1000000
   }
 }`
 
 type Genesis struct {
-	Balances map[common.Address]uint `json:"balances"`
-	Symbol   string                  `json:"symbol"`
+	ChainID   string                  `json:"chain_id"`
+	Balances  map[common.Address]uint `json:"balances"`
+	Symbol    string                  `json:"symbol"`
+	Consensus string                  `json:"consensus"`
+
+	// Proof of Authority only: the initial set of accounts allowed to seal blocks and the block time in seconds
+	Signers []common.Address `json:"signers,omitempty"`
+	Period  uint64           `json:"period,omitempty"`
+}
+
+// LoadGenesis initializes the data dir with the default genesis, if needed, and loads it.
+func LoadGenesis(dataDir string) (Genesis, error) {
+	err := InitDataDirIfNotExists(dataDir, []byte(genesisJson))
+	if err != nil {
+		return Genesis{}, err
+	}
+
+	return loadGenesis(getGenesisJsonFilePath(dataDir))
+}
+
+// GenesisHash identifies the network of the data dir, nodes sharing a chain have the same genesis file.
+func GenesisHash(dataDir string) (Hash, error) {
+	err := InitDataDirIfNotExists(dataDir, []byte(genesisJson))
+	if err != nil {
+		return Hash{}, err
+	}
+
+	content, err := ioutil.ReadFile(getGenesisJsonFilePath(dataDir))
+	if err != nil {
+		return Hash{}, err
+	}
+
+	return sha256.Sum256(content), nil
 }
 
 func loadGenesis(path string) (Genesis, error) {
@@ -0,0 +1,250 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package database
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// TxLocation is the position of a mined TX in the chain.
+type TxLocation struct {
+	BlockHash   Hash
+	BlockNumber uint64
+	Index       int
+}
+
+// AccountEntry is a mined TX sent or received by an account, or a block reward it was credited.
+//
+// The reward of a block comes after its TXs, its Index is the number of TXs in the block.
+type AccountEntry struct {
+	BlockNumber uint64
+	Index       int
+	Reward      bool
+}
+
+// chainIndex locates the persisted blocks and TXs without scanning the blocks DB.
+type chainIndex struct {
+	// Offset of every block in the blocks DB, by block number, and the DB size
+	offsets []int64
+	size    int64
+
+	// Same for the receipts of every block in the receipts DB
+	receiptsOffsets []int64
+	receiptsSize    int64
+
+	blocks map[Hash]uint64
+	txs    map[Hash]TxLocation
+
+	// Entries of every account, by block number and index
+	accounts map[common.Address][]AccountEntry
+
+	lock sync.RWMutex
+}
+
+func newChainIndex() *chainIndex {
+	return &chainIndex{
+		blocks:   make(map[Hash]uint64),
+		txs:      make(map[Hash]TxLocation),
+		accounts: make(map[common.Address][]AccountEntry),
+	}
+}
+
+// push indexes the block persisted at the end of the blocks DB, taking size bytes.
+func (i *chainIndex) push(blockFs BlockFS, size int64) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	number := blockFs.Value.Header.Number
+
+	i.offsets = append(i.offsets, i.size)
+	i.size += size
+	i.blocks[blockFs.Key] = number
+
+	for index, tx := range blockFs.Value.TXs {
+		txHash, err := tx.Hash()
+		if err != nil {
+			continue
+		}
+
+		i.txs[txHash] = TxLocation{BlockHash: blockFs.Key, BlockNumber: number, Index: index}
+
+		entry := AccountEntry{BlockNumber: number, Index: index}
+		i.accounts[tx.From] = append(i.accounts[tx.From], entry)
+		if tx.To != tx.From {
+			i.accounts[tx.To] = append(i.accounts[tx.To], entry)
+		}
+	}
+
+	miner := blockFs.Value.Header.Miner
+	i.accounts[miner] = append(i.accounts[miner], AccountEntry{BlockNumber: number, Index: len(blockFs.Value.TXs), Reward: true})
+}
+
+// pushReceipts indexes the receipts of the latest block, persisted at the end of the receipts DB.
+func (i *chainIndex) pushReceipts(size int64) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	i.receiptsOffsets = append(i.receiptsOffsets, i.receiptsSize)
+	i.receiptsSize += size
+}
+
+// popReceipts drops the receipts of the block that failed to be persisted after them.
+func (i *chainIndex) popReceipts() {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	last := len(i.receiptsOffsets) - 1
+	i.receiptsSize = i.receiptsOffsets[last]
+	i.receiptsOffsets = i.receiptsOffsets[:last]
+}
+
+func (i *chainIndex) reset() {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	i.offsets = nil
+	i.size = 0
+	i.receiptsOffsets = nil
+	i.receiptsSize = 0
+	i.blocks = make(map[Hash]uint64)
+	i.txs = make(map[Hash]TxLocation)
+	i.accounts = make(map[common.Address][]AccountEntry)
+}
+
+func (i *chainIndex) offset(number uint64) (int64, bool) {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	if number >= uint64(len(i.offsets)) {
+		return 0, false
+	}
+
+	return i.offsets[number], true
+}
+
+func (i *chainIndex) receiptsOffset(number uint64) (int64, bool) {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	if number >= uint64(len(i.receiptsOffsets)) {
+		return 0, false
+	}
+
+	return i.receiptsOffsets[number], true
+}
+
+func (i *chainIndex) receiptsDbSize() int64 {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	return i.receiptsSize
+}
+
+func (i *chainIndex) blockNumber(hash Hash) (uint64, bool) {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	number, ok := i.blocks[hash]
+
+	return number, ok
+}
+
+func (i *chainIndex) txLocation(hash Hash) (TxLocation, bool) {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	location, ok := i.txs[hash]
+
+	return location, ok
+}
+
+// BlockNumber returns the number of the persisted block with the given hash.
+func (s *State) BlockNumber(hash Hash) (uint64, bool) {
+	return s.index.blockNumber(hash)
+}
+
+// TxLocation returns where the TX with the given hash was mined.
+func (s *State) TxLocation(hash Hash) (TxLocation, bool) {
+	return s.index.txLocation(hash)
+}
+
+// AccountEntries returns the mined TXs and the block rewards of the account, oldest first.
+//
+// The entries are only ever appended, the returned slice must not be modified.
+func (s *State) AccountEntries(account common.Address) []AccountEntry {
+	s.index.lock.RLock()
+	defer s.index.lock.RUnlock()
+
+	return s.index.accounts[account]
+}
+
+// GetBlockByNumber reads the persisted block with the given number from the disk.
+func (s *State) GetBlockByNumber(number uint64) (BlockFS, bool, error) {
+	offset, ok := s.index.offset(number)
+	if !ok {
+		return BlockFS{}, false, nil
+	}
+
+	f, err := os.OpenFile(getBlocksDbFilePath(s.dataDir), os.O_RDONLY, 0600)
+	if err != nil {
+		return BlockFS{}, false, err
+	}
+	defer f.Close()
+
+	_, err = f.Seek(offset, 0)
+	if err != nil {
+		return BlockFS{}, false, err
+	}
+
+	blockFsJson, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil {
+		return BlockFS{}, false, err
+	}
+
+	var blockFs BlockFS
+	err = json.Unmarshal(blockFsJson, &blockFs)
+	if err != nil {
+		return BlockFS{}, false, err
+	}
+
+	// The chain may have been rewound meanwhile
+	if blockFs.Value.Header.Number != number {
+		return BlockFS{}, false, fmt.Errorf("block '%d' moved while reading it", number)
+	}
+
+	return blockFs, true, nil
+}
+
+// GetBlockByHash reads the persisted block with the given hash from the disk.
+func (s *State) GetBlockByHash(hash Hash) (BlockFS, bool, error) {
+	number, ok := s.BlockNumber(hash)
+	if !ok {
+		return BlockFS{}, false, nil
+	}
+
+	blockFs, ok, err := s.GetBlockByNumber(number)
+	if err != nil || !ok || blockFs.Key != hash {
+		return BlockFS{}, false, err
+	}
+
+	return blockFs, true, nil
+}
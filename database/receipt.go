@@ -0,0 +1,166 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package database
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+)
+
+// A TX failing to execute invalidates its whole block, the receipts of the mined TXs are all successful
+const ReceiptStatusSuccess = "success"
+
+// Receipt records the execution of a mined TX, the balances are the ones right after the TX,
+// before the block rewards are credited.
+type Receipt struct {
+	TxHash      Hash   `json:"tx_hash"`
+	BlockHash   Hash   `json:"block_hash"`
+	BlockNumber uint64 `json:"block_number"`
+	Index       int    `json:"index"`
+	Fee         uint   `json:"fee"`
+	Status      string `json:"status"`
+	FromBalance uint   `json:"from_balance"`
+	ToBalance   uint   `json:"to_balance"`
+}
+
+// ReceiptsFS are the receipts of a block, persisted in the receipts DB in the same order as the blocks DB.
+type ReceiptsFS struct {
+	Key   Hash      `json:"block_hash"`
+	Value []Receipt `json:"receipts"`
+}
+
+// persistedReceipts is the position of the receipts of a block in the receipts DB.
+type persistedReceipts struct {
+	key    Hash
+	offset int64
+	size   int64
+}
+
+// readPersistedReceipts scans the receipts DB, the receipts of blocks no longer in the chain are overwritten while replaying it.
+func readPersistedReceipts(dataDir string) ([]persistedReceipts, error) {
+	f, err := os.OpenFile(getReceiptsDbFilePath(dataDir), os.O_RDONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	persisted := make([]persistedReceipts, 0)
+	offset := int64(0)
+
+	reader := bufio.NewReader(f)
+	for {
+		receiptsFsJson, err := reader.ReadBytes('\n')
+		if err != nil {
+			// A line without its new line wasn't fully written
+			break
+		}
+
+		var receiptsFs struct {
+			Key Hash `json:"block_hash"`
+		}
+		err = json.Unmarshal(receiptsFsJson, &receiptsFs)
+		if err != nil {
+			break
+		}
+
+		persisted = append(persisted, persistedReceipts{receiptsFs.Key, offset, int64(len(receiptsFsJson))})
+		offset += int64(len(receiptsFsJson))
+	}
+
+	return persisted, nil
+}
+
+// indexReceipts indexes the receipts of the replayed block if already persisted, otherwise persists them.
+func (s *State) indexReceipts(blockFs BlockFS, receipts []Receipt, persisted []persistedReceipts) error {
+	number := blockFs.Value.Header.Number
+
+	if number < uint64(len(persisted)) && persisted[number].key == blockFs.Key && persisted[number].offset == s.index.receiptsDbSize() {
+		s.index.pushReceipts(persisted[number].size)
+		return nil
+	}
+
+	return s.writeReceipts(blockFs, receipts)
+}
+
+// writeReceipts appends the receipts of the block to the receipts DB, dropping the ones of the blocks no longer in the chain.
+func (s *State) writeReceipts(blockFs BlockFS, receipts []Receipt) error {
+	for i := range receipts {
+		receipts[i].BlockHash = blockFs.Key
+		receipts[i].BlockNumber = blockFs.Value.Header.Number
+	}
+
+	receiptsFsJson, err := json.Marshal(ReceiptsFS{blockFs.Key, receipts})
+	if err != nil {
+		return err
+	}
+
+	err = s.receiptsDbFile.Truncate(s.index.receiptsDbSize())
+	if err != nil {
+		return err
+	}
+
+	_, err = s.receiptsDbFile.Write(append(receiptsFsJson, '\n'))
+	if err != nil {
+		return err
+	}
+
+	s.index.pushReceipts(int64(len(receiptsFsJson)) + 1)
+
+	return nil
+}
+
+// GetReceipt reads the receipt of the mined TX from the disk.
+func (s *State) GetReceipt(txHash Hash) (Receipt, bool, error) {
+	location, ok := s.index.txLocation(txHash)
+	if !ok {
+		return Receipt{}, false, nil
+	}
+
+	offset, ok := s.index.receiptsOffset(location.BlockNumber)
+	if !ok {
+		return Receipt{}, false, nil
+	}
+
+	f, err := os.OpenFile(getReceiptsDbFilePath(s.dataDir), os.O_RDONLY, 0600)
+	if err != nil {
+		return Receipt{}, false, err
+	}
+	defer f.Close()
+
+	_, err = f.Seek(offset, 0)
+	if err != nil {
+		return Receipt{}, false, err
+	}
+
+	receiptsFsJson, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil {
+		return Receipt{}, false, err
+	}
+
+	var receiptsFs ReceiptsFS
+	err = json.Unmarshal(receiptsFsJson, &receiptsFs)
+	if err != nil {
+		return Receipt{}, false, err
+	}
+
+	// The chain may have been rewound meanwhile
+	if receiptsFs.Key != location.BlockHash || location.Index >= len(receiptsFs.Value) {
+		return Receipt{}, false, nil
+	}
+
+	return receiptsFs.Value[location.Index], true, nil
+}
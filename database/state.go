@@ -28,17 +28,30 @@ import (
 
 const TxFee = 50
 
+// Number of the latest block headers kept in memory, e.g: for the difficulty retarget
+const RecentHeadersLimit = 128
+
 type State struct {
 	Balances      map[common.Address]uint
 	Account2Nonce map[common.Address]uint
 
-	dbFile *os.File
+	dbFile         *os.File
+	receiptsDbFile *os.File
+
+	dataDir string
+	engine  Consensus
 
 	latestBlock     Block
 	latestBlockHash Hash
 	hasGenesisBlock bool
 
-	miningDifficulty uint64
+	recentHeaders []BlockHeader
+
+	// Hashes of the persisted blocks, indexed by block number
+	blockHashes []Hash
+
+	// Where the persisted blocks and TXs are, shared with the state copies
+	index *chainIndex
 }
 
 func getInitialBalances(dataDir string) (map[common.Address]uint, error) {
@@ -56,7 +69,7 @@ func getInitialBalances(dataDir string) (map[common.Address]uint, error) {
 	return balances, nil
 }
 
-func NewStateFromDisk(dataDir string, miningDifficulty uint64) (*State, error) {
+func NewStateFromDisk(dataDir string, engine Consensus) (*State, error) {
 	err := InitDataDirIfNotExists(dataDir, []byte(genesisJson))
 	if err != nil {
 		return nil, err
@@ -75,9 +88,19 @@ func NewStateFromDisk(dataDir string, miningDifficulty uint64) (*State, error) {
 		return nil, err
 	}
 
+	receiptsDbFile, err := os.OpenFile(getReceiptsDbFilePath(dataDir), os.O_APPEND|os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	persistedReceipts, err := readPersistedReceipts(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
 	scanner := bufio.NewScanner(f)
 
-	state := &State{balances, account2nonce, f, Block{}, Hash{}, false, miningDifficulty}
+	state := &State{balances, account2nonce, f, receiptsDbFile, dataDir, engine, Block{}, Hash{}, false, nil, nil, newChainIndex()}
 
 	for scanner.Scan() {
 		if err := scanner.Err(); err != nil {
@@ -96,19 +119,40 @@ func NewStateFromDisk(dataDir string, miningDifficulty uint64) (*State, error) {
 			return nil, err
 		}
 
-		err = applyBlock(blockFs.Value, state)
+		err = state.replayBlock(blockFs, int64(len(blockFsJson))+1, persistedReceipts)
 		if err != nil {
 			return nil, err
 		}
+	}
 
-		state.latestBlock = blockFs.Value
-		state.latestBlockHash = blockFs.Key
-		state.hasGenesisBlock = true
+	// Drop the receipts of the blocks no longer in the chain
+	err = receiptsDbFile.Truncate(state.index.receiptsDbSize())
+	if err != nil {
+		return nil, err
 	}
 
 	return state, nil
 }
 
+// replayBlock applies a block already persisted to disk, taking size bytes of the blocks DB.
+//
+// Its receipts are persisted too, unless already among the persisted ones.
+func (s *State) replayBlock(blockFs BlockFS, size int64, persisted []persistedReceipts) error {
+	receipts, err := applyBlock(blockFs.Value, s)
+	if err != nil {
+		return err
+	}
+
+	s.latestBlock = blockFs.Value
+	s.latestBlockHash = blockFs.Key
+	s.hasGenesisBlock = true
+	s.pushRecentHeader(blockFs.Value.Header)
+	s.blockHashes = append(s.blockHashes, blockFs.Key)
+	s.index.push(blockFs, size)
+
+	return s.indexReceipts(blockFs, receipts, persisted)
+}
+
 func (s *State) AddBlocks(blocks []Block) error {
 	for _, b := range blocks {
 		_, err := s.AddBlock(b)
@@ -123,7 +167,7 @@ func (s *State) AddBlocks(blocks []Block) error {
 func (s *State) AddBlock(b Block) (Hash, error) {
 	pendingState := s.Copy()
 
-	err := applyBlock(b, &pendingState)
+	receipts, err := applyBlock(b, &pendingState)
 	if err != nil {
 		return Hash{}, err
 	}
@@ -140,11 +184,19 @@ func (s *State) AddBlock(b Block) (Hash, error) {
 		return Hash{}, err
 	}
 
+	// The receipts are persisted first, a block is never committed without them
+	err = s.writeReceipts(blockFs, receipts)
+	if err != nil {
+		return Hash{}, fmt.Errorf("unable to persist the receipts of Block '%s'. %s", blockHash.Hex(), err)
+	}
+
 	fmt.Printf("\nPersisting new Block to disk:\n")
 	fmt.Printf("\t%s\n", blockFsJson)
 
 	_, err = s.dbFile.Write(append(blockFsJson, '\n'))
 	if err != nil {
+		// The receipts of the next block overwrite them
+		s.index.popReceipts()
 		return Hash{}, err
 	}
 
@@ -153,7 +205,9 @@ func (s *State) AddBlock(b Block) (Hash, error) {
 	s.latestBlockHash = blockHash
 	s.latestBlock = b
 	s.hasGenesisBlock = true
-	s.miningDifficulty = pendingState.miningDifficulty
+	s.pushRecentHeader(b.Header)
+	s.blockHashes = append(s.blockHashes, blockHash)
+	s.index.push(blockFs, int64(len(blockFsJson))+1)
 
 	return blockHash, nil
 }
@@ -165,6 +219,11 @@ func (s *State) ResetChain(dataDir string) error {
 		return err
 	}
 
+	err = s.receiptsDbFile.Truncate(0)
+	if err != nil {
+		return err
+	}
+
 	balances, err := getInitialBalances(dataDir)
 	if err != nil {
 		return err
@@ -178,10 +237,81 @@ func (s *State) ResetChain(dataDir string) error {
 	s.latestBlock = Block{}
 	s.latestBlockHash = Hash{}
 	s.hasGenesisBlock = false
+	s.recentHeaders = nil
+	s.blockHashes = nil
+	s.index.reset()
 
 	return nil
 }
 
+// RewindTo drops the blocks after the given block number, from the disk and the state.
+func (s *State) RewindTo(number uint64) error {
+	if !s.hasGenesisBlock || number >= s.latestBlock.Header.Number {
+		return nil
+	}
+
+	dbFilepath := getBlocksDbFilePath(s.dataDir)
+
+	f, err := os.OpenFile(dbFilepath, os.O_RDONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	blocks := make([]BlockFS, 0, number+1)
+	sizes := make([]int64, 0, number+1)
+	offset := int64(0)
+
+	scanner := bufio.NewScanner(f)
+	for uint64(len(blocks)) <= number && scanner.Scan() {
+		var blockFs BlockFS
+		err = json.Unmarshal(scanner.Bytes(), &blockFs)
+		if err != nil {
+			return err
+		}
+
+		blocks = append(blocks, blockFs)
+		sizes = append(sizes, int64(len(scanner.Bytes()))+1)
+		offset += int64(len(scanner.Bytes())) + 1
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	err = os.Truncate(dbFilepath, offset)
+	if err != nil {
+		return err
+	}
+
+	persistedReceipts, err := readPersistedReceipts(s.dataDir)
+	if err != nil {
+		return err
+	}
+
+	balances, err := getInitialBalances(s.dataDir)
+	if err != nil {
+		return err
+	}
+
+	s.Balances = balances
+	s.Account2Nonce = make(map[common.Address]uint)
+	s.latestBlock = Block{}
+	s.latestBlockHash = Hash{}
+	s.hasGenesisBlock = false
+	s.recentHeaders = nil
+	s.blockHashes = nil
+	s.index.reset()
+
+	for i, blockFs := range blocks {
+		err = s.replayBlock(blockFs, sizes[i], persistedReceipts)
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.receiptsDbFile.Truncate(s.index.receiptsDbSize())
+}
+
 func (s *State) NextBlockNumber() uint64 {
 	if !s.hasGenesisBlock {
 		return uint64(0)
@@ -206,8 +336,35 @@ func (s *State) GetNextAccountNonce(account common.Address) uint {
 	return s.Account2Nonce[account] + 1
 }
 
-func (c *State) ChangeMiningDifficulty(newDifficulty uint64) {
-	c.miningDifficulty = newDifficulty
+// BlockHash returns the hash of the persisted block with the given number.
+func (s *State) BlockHash(number uint64) (Hash, bool) {
+	if number >= uint64(len(s.blockHashes)) {
+		return Hash{}, false
+	}
+
+	return s.blockHashes[number], true
+}
+
+// RecentHeaders returns up to RecentHeadersLimit latest block headers, oldest first.
+func (s *State) RecentHeaders() []BlockHeader {
+	return s.recentHeaders
+}
+
+func (s *State) pushRecentHeader(header BlockHeader) {
+	headers := make([]BlockHeader, 0, len(s.recentHeaders)+1)
+	headers = append(headers, s.recentHeaders...)
+	headers = append(headers, header)
+
+	if len(headers) > RecentHeadersLimit {
+		headers = headers[len(headers)-RecentHeadersLimit:]
+	}
+
+	s.recentHeaders = headers
+}
+
+// GetBlocksBefore returns up to the last blocks persisted before (and including) the given block hash, newest first.
+func (s *State) GetBlocksBefore(blockHash Hash, last int64) ([]BlockFS, error) {
+	return GetBlocksBefore(blockHash, last, s.dataDir)
 }
 
 func (s *State) Copy() State {
@@ -217,7 +374,11 @@ func (s *State) Copy() State {
 	c.latestBlockHash = s.latestBlockHash
 	c.Balances = make(map[common.Address]uint)
 	c.Account2Nonce = make(map[common.Address]uint)
-	c.miningDifficulty = s.miningDifficulty
+	c.dataDir = s.dataDir
+	c.engine = s.engine
+	c.recentHeaders = s.recentHeaders
+	c.blockHashes = s.blockHashes
+	c.index = s.index
 
 	for acc, balance := range s.Balances {
 		c.Balances[acc] = balance
@@ -230,45 +391,52 @@ func (s *State) Copy() State {
 	return c
 }
 
+// Close flushes the blocks and receipts DBs to the disk and closes them.
 func (s *State) Close() error {
-	return s.dbFile.Close()
+	for _, f := range []*os.File{s.receiptsDbFile, s.dbFile} {
+		err := f.Sync()
+		if err != nil {
+			f.Close()
+			return err
+		}
+
+		err = f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 // applyBlock verifies if block can be added to the blockchain.
 //
-// Block metadata are verified as well as transactions within (sufficient balances, etc).
-func applyBlock(b Block, s *State) error {
+// Block metadata are verified as well as transactions within (sufficient balances, etc), the receipts of the TXs are returned.
+func applyBlock(b Block, s *State) ([]Receipt, error) {
 	nextExpectedBlockNumber := s.latestBlock.Header.Number + 1
 
 	if s.hasGenesisBlock && b.Header.Number != nextExpectedBlockNumber {
-		return fmt.Errorf("next expected block must be '%d' not '%d'", nextExpectedBlockNumber, b.Header.Number)
+		return nil, fmt.Errorf("next expected block must be '%d' not '%d'", nextExpectedBlockNumber, b.Header.Number)
 	}
 
 	if s.hasGenesisBlock && s.latestBlock.Header.Number > 0 && !reflect.DeepEqual(b.Header.Parent, s.latestBlockHash) {
-		return fmt.Errorf("next block parent hash must be '%x' not '%x'", s.latestBlockHash, b.Header.Parent)
+		return nil, fmt.Errorf("next block parent hash must be '%x' not '%x'", s.latestBlockHash, b.Header.Parent)
 	}
 
-	hash, err := b.Hash()
+	err := s.engine.VerifyHeader(s, b)
 	if err != nil {
-		return err
-	}
-
-	if !IsBlockHashValid(hash, b.Header.Difficulty) {
-		return fmt.Errorf("invalid block hash %x", hash)
+		return nil, err
 	}
 
-	err = applyTXs(b.TXs, s)
+	receipts, err := applyTXs(b.TXs, s)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	s.Balances[b.Header.Miner] += BlockReward
-	s.Balances[b.Header.Miner] += uint(len(b.TXs)) * TxFee
-
-	return nil
+	return receipts, s.engine.Finalize(s, b)
 }
 
-func applyTXs(txs []SignedTx, s *State) error {
+func applyTXs(txs []SignedTx, s *State) ([]Receipt, error) {
 
 	copyTxs := make([]SignedTx, len(txs))
 	copy(copyTxs, txs)
@@ -277,14 +445,30 @@ func applyTXs(txs []SignedTx, s *State) error {
 		return copyTxs[i].Nonce < txs[j].Nonce
 	})
 
-	for _, tx := range txs {
+	receipts := make([]Receipt, 0, len(txs))
+
+	for i, tx := range txs {
 		err := ApplyTx(tx, s)
 		if err != nil {
-			return err
+			return nil, err
+		}
+
+		txHash, err := tx.Hash()
+		if err != nil {
+			return nil, err
 		}
+
+		receipts = append(receipts, Receipt{
+			TxHash:      txHash,
+			Index:       i,
+			Fee:         tx.EffectiveFee(),
+			Status:      ReceiptStatusSuccess,
+			FromBalance: s.Balances[tx.From],
+			ToBalance:   s.Balances[tx.To],
+		})
 	}
 
-	return nil
+	return receipts, nil
 }
 
 func ApplyTx(tx SignedTx, s *State) error {
@@ -311,6 +495,10 @@ func ValidateTx(tx SignedTx, s *State) error {
 		return fmt.Errorf("wrong TX. Sender '%s' is forged", tx.From.String())
 	}
 
+	if tx.Fee != 0 && tx.Fee < TxFee {
+		return fmt.Errorf("wrong TX. Fee is %d TBB, the minimum is %d TBB", tx.Fee, TxFee)
+	}
+
 	expectedNonce := s.GetNextAccountNonce(tx.From)
 	if tx.Nonce != expectedNonce {
 		return fmt.Errorf("wrong TX. Sender '%s' next nonce must be '%d', not '%d'", tx.From.String(), expectedNonce, tx.Nonce)
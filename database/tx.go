@@ -36,6 +36,8 @@ type Tx struct {
 	Nonce uint           `json:"nonce"`
 	Data  string         `json:"data"`
 	Time  uint64         `json:"time"`
+	// Fee paid to the miner, TxFee if 0. Omitted from the encoding so the TXs without it keep their hash
+	Fee uint `json:"fee,omitempty" rlp:"optional"`
 }
 
 type SignedTx struct {
@@ -49,10 +51,8 @@ type SignedTxExtended struct {
 	BlockHash Hash `json:"block_hash"`
 }
 
-type SignedTxsExtended []SignedTxExtended
-
 func NewTx(from, to common.Address, value, nonce uint, data string) Tx {
-	return Tx{from, to, value, nonce, data, uint64(time.Now().Unix())}
+	return Tx{from, to, value, nonce, data, uint64(time.Now().Unix()), 0}
 }
 
 func NewSignedTx(tx Tx, sig []byte) SignedTx {
@@ -75,8 +75,17 @@ func (t Tx) IsReward() bool {
 	return t.Data == "reward"
 }
 
+// EffectiveFee is the fee the miner receives, the minimum TxFee unless the TX pays more.
+func (t Tx) EffectiveFee() uint {
+	if t.Fee == 0 {
+		return TxFee
+	}
+
+	return t.Fee
+}
+
 func (t Tx) Cost() uint {
-	return t.Value + TxFee
+	return t.Value + t.EffectiveFee()
 }
 
 func (t Tx) Hash() (Hash, error) {
@@ -118,14 +127,3 @@ func (t SignedTx) IsAuthentic() (bool, error) {
 
 	return recoveredAccount.Hex() == t.From.Hex(), nil
 }
-
-func (txs SignedTxsExtended) Sort() {
-
-	for i := 0; i < len(txs); i++ {
-		for j := i + 1; j < len(txs); j++ {
-			if txs[i].Tx.Nonce < txs[j].Tx.Nonce {
-				txs[i], txs[j] = txs[j], txs[i]
-			}
-		}
-	}
-}
@@ -0,0 +1,102 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package mempool
+
+import (
+	"sort"
+
+	"github.com/IacopoMelani/the-blockchain-pub/database"
+)
+
+// account holds the TXs of a sender by nonce.
+//
+// The first pending TXs, starting from the sender's next nonce, are executable. The others are queued.
+type account struct {
+	txs     map[uint]database.SignedTx
+	hashes  map[uint]database.Hash
+	next    uint
+	pending int
+}
+
+func newAccount(next uint) *account {
+	return &account{
+		txs:    make(map[uint]database.SignedTx),
+		hashes: make(map[uint]database.Hash),
+		next:   next,
+	}
+}
+
+// promote counts the TXs executable in sequence from the next nonce that the balance can afford.
+func (a *account) promote(balance uint, maxPending int) {
+	a.pending = 0
+	cost := uint(0)
+
+	for nonce := a.next; a.pending < maxPending; nonce++ {
+		tx, ok := a.txs[nonce]
+		if !ok || cost+tx.Cost() > balance {
+			return
+		}
+
+		cost += tx.Cost()
+		a.pending++
+	}
+}
+
+func (a *account) queued() int {
+	return len(a.txs) - a.pending
+}
+
+func (a *account) isPending(nonce uint) bool {
+	return nonce >= a.next && nonce < a.next+uint(a.pending)
+}
+
+func (a *account) highestNonce() uint {
+	highest := uint(0)
+	for nonce := range a.txs {
+		if nonce > highest {
+			highest = nonce
+		}
+	}
+
+	return highest
+}
+
+func (a *account) pendingTxs() []database.SignedTx {
+	txs := make([]database.SignedTx, 0, a.pending)
+	for nonce := a.next; nonce < a.next+uint(a.pending); nonce++ {
+		txs = append(txs, a.txs[nonce])
+	}
+
+	return txs
+}
+
+func (a *account) queuedTxs() []database.SignedTx {
+	nonces := make([]uint, 0, a.queued())
+	for nonce := range a.txs {
+		if !a.isPending(nonce) {
+			nonces = append(nonces, nonce)
+		}
+	}
+
+	sort.Slice(nonces, func(i, j int) bool { return nonces[i] < nonces[j] })
+
+	txs := make([]database.SignedTx, len(nonces))
+	for i, nonce := range nonces {
+		txs[i] = a.txs[nonce]
+	}
+
+	return txs
+}
@@ -0,0 +1,184 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package mempool
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	"github.com/IacopoMelani/the-blockchain-pub/database"
+)
+
+const (
+	StatusPending = "pending"
+	StatusQueued  = "queued"
+)
+
+// Stats summarizes the pool, sizes are the bytes of the JSON encoded TXs.
+type Stats struct {
+	Pending     int
+	Queued      int
+	Senders     int
+	PendingSize int
+	QueuedSize  int
+	Digest      database.Hash
+}
+
+// Entry is a TX of the pool with its hash and status, pending or queued.
+type Entry struct {
+	Hash   database.Hash
+	Tx     database.SignedTx
+	Status string
+}
+
+// Filter selects the TXs of the pool, the zero value of every field matches any TX.
+type Filter struct {
+	From     common.Address
+	To       common.Address
+	MinFee   uint
+	MinNonce uint
+	MaxNonce uint
+	Status   string
+}
+
+func (f Filter) matches(e Entry) bool {
+	if f.From != (common.Address{}) && e.Tx.From != f.From {
+		return false
+	}
+
+	if f.To != (common.Address{}) && e.Tx.To != f.To {
+		return false
+	}
+
+	if e.Tx.EffectiveFee() < f.MinFee || e.Tx.Nonce < f.MinNonce {
+		return false
+	}
+
+	if f.MaxNonce != 0 && e.Tx.Nonce > f.MaxNonce {
+		return false
+	}
+
+	return f.Status == "" || f.Status == e.Status
+}
+
+// Stats counts the pending and queued TXs and the accounts sending them.
+func (p *Pool) Stats() Stats {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	stats := Stats{Senders: len(p.accounts), Digest: p.digest()}
+
+	for _, acc := range p.accounts {
+		for nonce, tx := range acc.txs {
+			txJson, _ := json.Marshal(tx)
+
+			if acc.isPending(nonce) {
+				stats.Pending++
+				stats.PendingSize += len(txJson)
+			} else {
+				stats.Queued++
+				stats.QueuedSize += len(txJson)
+			}
+		}
+	}
+
+	return stats
+}
+
+// Digest identifies the set of pending TXs, two pools with the same digest hold the same pending TXs.
+func (p *Pool) Digest() database.Hash {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return p.digest()
+}
+
+func (p *Pool) digest() database.Hash {
+	hashes := make([]database.Hash, 0)
+	for _, acc := range p.accounts {
+		for nonce := acc.next; nonce < acc.next+uint(acc.pending); nonce++ {
+			hashes = append(hashes, acc.hashes[nonce])
+		}
+	}
+
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i].Hex() < hashes[j].Hex() })
+
+	h := sha256.New()
+	for _, hash := range hashes {
+		h.Write(hash[:])
+	}
+
+	var digest database.Hash
+	h.Sum(digest[:0])
+
+	return digest
+}
+
+// Filter returns the TXs matching the filter, pending first and then by nonce.
+func (p *Pool) Filter(f Filter) []Entry {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	entries := make([]Entry, 0)
+
+	for _, acc := range p.accounts {
+		for nonce, tx := range acc.txs {
+			e := Entry{Hash: acc.hashes[nonce], Tx: tx, Status: StatusQueued}
+			if acc.isPending(nonce) {
+				e.Status = StatusPending
+			}
+
+			if f.matches(e) {
+				entries = append(entries, e)
+			}
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Status != entries[j].Status {
+			return entries[i].Status == StatusPending
+		}
+
+		if entries[i].Tx.Nonce != entries[j].Tx.Nonce {
+			return entries[i].Tx.Nonce < entries[j].Tx.Nonce
+		}
+
+		return entries[i].Tx.From.Hex() < entries[j].Tx.From.Hex()
+	})
+
+	return entries
+}
+
+// Entry returns the TX with its status.
+func (p *Pool) Entry(hash database.Hash) (Entry, bool) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	tx, ok := p.all[hash]
+	if !ok {
+		return Entry{}, false
+	}
+
+	e := Entry{Hash: hash, Tx: tx, Status: StatusQueued}
+	if p.accounts[tx.From].isPending(tx.Nonce) {
+		e.Status = StatusPending
+	}
+
+	return e, true
+}
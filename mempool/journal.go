@@ -0,0 +1,120 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package mempool
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"github.com/IacopoMelani/the-blockchain-pub/database"
+)
+
+// journal persists the pool's TXs across restarts, one JSON encoded TX per line.
+//
+// New TXs are appended, the rotation rewrites the file with the TXs still in the pool.
+type journal struct {
+	path   string
+	writer *os.File
+}
+
+// load replays the journaled TXs, returning how many were added and dropped.
+func (j *journal) load(add func(tx database.SignedTx) error) (int, int, error) {
+	f, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	loaded, dropped := 0, 0
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		tx := database.SignedTx{}
+
+		// A line truncated by a crash is skipped
+		if json.Unmarshal(scanner.Bytes(), &tx) != nil || add(tx) != nil {
+			dropped++
+			continue
+		}
+
+		loaded++
+	}
+
+	return loaded, dropped, scanner.Err()
+}
+
+func (j *journal) insert(tx database.SignedTx) error {
+	txJson, err := json.Marshal(tx)
+	if err != nil {
+		return err
+	}
+
+	_, err = j.writer.Write(append(txJson, '\n'))
+
+	return err
+}
+
+// rotate atomically replaces the journal with the TXs and keeps appending to the new file.
+func (j *journal) rotate(txs []database.SignedTx) error {
+	if j.writer != nil {
+		j.writer.Close()
+		j.writer = nil
+	}
+
+	content := make([]byte, 0)
+	for _, tx := range txs {
+		txJson, err := json.Marshal(tx)
+		if err != nil {
+			return err
+		}
+
+		content = append(content, txJson...)
+		content = append(content, '\n')
+	}
+
+	tmpPath := j.path + ".tmp"
+	err := ioutil.WriteFile(tmpPath, content, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpPath, j.path)
+	if err != nil {
+		return err
+	}
+
+	j.writer, err = os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0600)
+
+	return err
+}
+
+func (j *journal) close() error {
+	if j.writer == nil {
+		return nil
+	}
+
+	err := j.writer.Close()
+	j.writer = nil
+
+	return err
+}
@@ -0,0 +1,519 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package mempool
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	"github.com/IacopoMelani/the-blockchain-pub/database"
+)
+
+var (
+	ErrNotReady           = errors.New("mempool isn't ready, no state to validate the TXs against")
+	ErrAlreadyKnown       = errors.New("TX already pending")
+	ErrNonceTooLow        = errors.New("nonce too low")
+	ErrReplaceUnderpriced = errors.New("replacement TX underpriced")
+	ErrInsufficientFunds  = errors.New("insufficient funds")
+	ErrAccountQueueFull   = errors.New("too many future TXs from the sender")
+	ErrPoolFull           = errors.New("mempool is full")
+	ErrExpired            = errors.New("TX expired")
+)
+
+// Config limits the TXs the pool holds.
+//
+// Pending TXs are executable on top of the latest block: their nonces follow the sender's one
+// without gaps and the sender can afford them all. Queued TXs wait for a missing nonce or funds.
+type Config struct {
+	// Pending TXs of all the senders
+	GlobalSlots int
+	// Queued TXs of all the senders
+	GlobalQueue int
+	// Pending TXs of a single sender, the next ones are queued
+	AccountSlots int
+	// Queued TXs of a single sender
+	AccountQueue int
+	// Minimum fee increase, in percent, for a TX to replace the pending one with the same nonce
+	PriceBump uint
+	// How long after its time a TX expires if not mined, never if 0
+	Lifetime time.Duration
+}
+
+var DefaultConfig = Config{
+	GlobalSlots:  4096,
+	GlobalQueue:  1024,
+	AccountSlots: 64,
+	AccountQueue: 64,
+	PriceBump:    10,
+	Lifetime:     3 * time.Hour,
+}
+
+// State is the blockchain state the pool validates the TXs against.
+type State interface {
+	GetAccountBalance(account common.Address) uint
+	GetNextAccountNonce(account common.Address) uint
+}
+
+// Pool holds the TXs not mined yet in nonce ordered queues per sender.
+type Pool struct {
+	cfg      Config
+	state    State
+	accounts map[common.Address]*account
+	all      map[database.Hash]database.SignedTx
+	recent   *recentHashes
+	journal  *journal
+	lock     sync.RWMutex
+}
+
+func New(cfg Config) *Pool {
+	return &Pool{
+		cfg:      cfg,
+		accounts: make(map[common.Address]*account),
+		all:      make(map[database.Hash]database.SignedTx),
+		recent:   newRecentHashes(maxRecentHashes),
+	}
+}
+
+// MinReplacementFee returns the fee a TX must pay to replace one paying fee.
+func MinReplacementFee(fee uint, priceBump uint) uint {
+	bump := (fee*priceBump + 99) / 100
+	if bump == 0 {
+		bump = 1
+	}
+
+	return fee + bump
+}
+
+// Add validates the TX and queues it, it becomes pending as soon as it's executable.
+//
+// A TX with the nonce of one already in the pool replaces it if it pays at least
+// PriceBump percent more fees, the replaced TX is returned.
+func (p *Pool) Add(tx database.SignedTx) (*database.SignedTx, error) {
+	hash, err := tx.Hash()
+	if err != nil {
+		return nil, err
+	}
+
+	isAuthentic, err := tx.IsAuthentic()
+	if err != nil {
+		return nil, err
+	}
+
+	if !isAuthentic {
+		return nil, fmt.Errorf("wrong TX. Sender '%s' is forged", tx.From.String())
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.state == nil {
+		return nil, ErrNotReady
+	}
+
+	if _, ok := p.all[hash]; ok {
+		return nil, ErrAlreadyKnown
+	}
+
+	if tx.Fee != 0 && tx.Fee < database.TxFee {
+		return nil, fmt.Errorf("wrong TX. Fee is %d TBB, the minimum is %d TBB", tx.Fee, database.TxFee)
+	}
+
+	if p.isExpired(tx, time.Now()) {
+		return nil, fmt.Errorf("%w. Sent at %s, the lifetime is %s", ErrExpired, time.Unix(int64(tx.Time), 0), p.cfg.Lifetime)
+	}
+
+	next := p.state.GetNextAccountNonce(tx.From)
+	if tx.Nonce < next {
+		return nil, fmt.Errorf("%w. Sender '%s' next nonce is '%d', not '%d'", ErrNonceTooLow, tx.From.String(), next, tx.Nonce)
+	}
+
+	balance := p.state.GetAccountBalance(tx.From)
+	if tx.Cost() > balance {
+		return nil, fmt.Errorf("%w. Sender '%s' balance is %d TBB. Tx cost is %d TBB", ErrInsufficientFunds, tx.From.String(), balance, tx.Cost())
+	}
+
+	acc, ok := p.accounts[tx.From]
+	if !ok {
+		acc = newAccount(next)
+		p.accounts[tx.From] = acc
+	}
+
+	var replaced *database.SignedTx
+
+	if old, taken := acc.txs[tx.Nonce]; taken {
+		minFee := MinReplacementFee(old.EffectiveFee(), p.cfg.PriceBump)
+		if tx.EffectiveFee() < minFee {
+			return nil, fmt.Errorf("%w. TX with same nonce already pending, the replacement fee must be at least %d TBB, not %d TBB", ErrReplaceUnderpriced, minFee, tx.EffectiveFee())
+		}
+
+		replaced = &old
+		delete(p.all, acc.hashes[tx.Nonce])
+		p.recent.add(acc.hashes[tx.Nonce])
+	}
+
+	acc.txs[tx.Nonce] = tx
+	acc.hashes[tx.Nonce] = hash
+	p.all[hash] = tx
+	acc.promote(balance, p.cfg.AccountSlots)
+
+	if replaced == nil && acc.queued() > p.cfg.AccountQueue && !acc.isPending(tx.Nonce) {
+		p.removeTx(tx.From, tx.Nonce)
+		return nil, ErrAccountQueueFull
+	}
+
+	p.enforceLimits()
+
+	if _, ok := p.all[hash]; !ok {
+		return replaced, ErrPoolFull
+	}
+
+	if p.journal != nil {
+		err = p.journal.insert(tx)
+		if err != nil {
+			fmt.Printf("ERROR: unable to journal the pending TX %s. %s\n", hash.Hex(), err)
+		}
+	}
+
+	return replaced, nil
+}
+
+// Reset re-validates the TXs against the state after the chain changed, usually a new block.
+//
+// The TXs mined or made stale by the new nonces are dropped and returned, the queued TXs
+// that became executable are promoted to pending.
+func (p *Pool) Reset(state State) []database.SignedTx {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.state = state
+
+	dropped := make([]database.SignedTx, 0)
+
+	for from, acc := range p.accounts {
+		acc.next = state.GetNextAccountNonce(from)
+
+		for nonce, tx := range acc.txs {
+			if nonce < acc.next {
+				dropped = append(dropped, tx)
+				p.recent.add(acc.hashes[nonce])
+				delete(p.all, acc.hashes[nonce])
+				delete(acc.txs, nonce)
+				delete(acc.hashes, nonce)
+			}
+		}
+
+		if len(acc.txs) == 0 {
+			delete(p.accounts, from)
+			continue
+		}
+
+		acc.promote(state.GetAccountBalance(from), p.cfg.AccountSlots)
+	}
+
+	p.enforceLimits()
+
+	return dropped
+}
+
+// Remove drops the TX, the sender's TXs with higher nonces are queued until the gap is filled.
+func (p *Pool) Remove(hash database.Hash) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	tx, ok := p.all[hash]
+	if !ok {
+		return false
+	}
+
+	p.recent.add(hash)
+	p.removeTx(tx.From, tx.Nonce)
+
+	return true
+}
+
+// Expire drops the TXs older than the lifetime, the sender's TXs with higher nonces are queued.
+func (p *Pool) Expire(now time.Time) []database.SignedTx {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	expired := make([]database.SignedTx, 0)
+
+	for hash, tx := range p.all {
+		if p.isExpired(tx, now) {
+			expired = append(expired, tx)
+			p.recent.add(hash)
+			p.removeTx(tx.From, tx.Nonce)
+		}
+	}
+
+	sortTxs(expired)
+
+	return expired
+}
+
+// Recent reports whether the TX left the pool lately, mined, replaced or expired,
+// so the peers relaying it again don't bring it back.
+func (p *Pool) Recent(hash database.Hash) bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return p.recent.has(hash)
+}
+
+// OpenJournal reloads and re-validates the TXs journaled by the previous run, then journals
+// the new TXs to the file. The pool must be Reset with the state first.
+func (p *Pool) OpenJournal(path string) (int, int, error) {
+	j := &journal{path: path}
+
+	loaded, dropped, err := j.load(func(tx database.SignedTx) error {
+		_, err := p.Add(tx)
+		return err
+	})
+	if err != nil {
+		return loaded, dropped, err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.journal = j
+
+	return loaded, dropped, p.rotateJournal()
+}
+
+// RotateJournal rewrites the journal with the TXs still in the pool.
+func (p *Pool) RotateJournal() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.rotateJournal()
+}
+
+// Close rotates and closes the journal.
+func (p *Pool) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.journal == nil {
+		return nil
+	}
+
+	err := p.rotateJournal()
+	if err != nil {
+		p.journal.close()
+		return err
+	}
+
+	err = p.journal.close()
+	p.journal = nil
+
+	return err
+}
+
+func (p *Pool) rotateJournal() error {
+	if p.journal == nil {
+		return nil
+	}
+
+	txs := make([]database.SignedTx, 0, len(p.all))
+	for _, acc := range p.accounts {
+		txs = append(txs, acc.pendingTxs()...)
+		txs = append(txs, acc.queuedTxs()...)
+	}
+
+	// Replaying in nonce order makes every TX executable again
+	sortTxs(txs)
+
+	return p.journal.rotate(txs)
+}
+
+func (p *Pool) isExpired(tx database.SignedTx, now time.Time) bool {
+	if p.cfg.Lifetime == 0 {
+		return false
+	}
+
+	return time.Unix(int64(tx.Time), 0).Add(p.cfg.Lifetime).Before(now)
+}
+
+func (p *Pool) Has(hash database.Hash) bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	_, ok := p.all[hash]
+
+	return ok
+}
+
+func (p *Pool) Get(hash database.Hash) (database.SignedTx, bool) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	tx, ok := p.all[hash]
+
+	return tx, ok
+}
+
+// Pending returns the executable TXs, ordered by nonce so every sender's TXs apply in sequence.
+func (p *Pool) Pending() []database.SignedTx {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	txs := make([]database.SignedTx, 0)
+	for _, acc := range p.accounts {
+		txs = append(txs, acc.pendingTxs()...)
+	}
+
+	sortTxs(txs)
+
+	return txs
+}
+
+// Queued returns the TXs waiting for a missing nonce or funds.
+func (p *Pool) Queued() []database.SignedTx {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	txs := make([]database.SignedTx, 0)
+	for _, acc := range p.accounts {
+		txs = append(txs, acc.queuedTxs()...)
+	}
+
+	sortTxs(txs)
+
+	return txs
+}
+
+// All returns the pending TXs followed by the queued ones.
+func (p *Pool) All() []database.SignedTx {
+	return append(p.Pending(), p.Queued()...)
+}
+
+// ByAccount returns the pending and queued TXs of the sender, ordered by nonce.
+func (p *Pool) ByAccount(from common.Address) []database.SignedTx {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	acc, ok := p.accounts[from]
+	if !ok {
+		return []database.SignedTx{}
+	}
+
+	return append(acc.pendingTxs(), acc.queuedTxs()...)
+}
+
+// Count returns the number of pending and queued TXs.
+func (p *Pool) Count() (int, int) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return p.count()
+}
+
+// PendingNonce returns the sender's next nonce once its pending TXs are mined.
+func (p *Pool) PendingNonce(from common.Address) uint {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	if acc, ok := p.accounts[from]; ok {
+		return acc.next + uint(acc.pending)
+	}
+
+	if p.state == nil {
+		return 0
+	}
+
+	return p.state.GetNextAccountNonce(from)
+}
+
+func (p *Pool) count() (int, int) {
+	pending, queued := 0, 0
+	for _, acc := range p.accounts {
+		pending += acc.pending
+		queued += acc.queued()
+	}
+
+	return pending, queued
+}
+
+func (p *Pool) removeTx(from common.Address, nonce uint) {
+	acc := p.accounts[from]
+
+	delete(p.all, acc.hashes[nonce])
+	delete(acc.txs, nonce)
+	delete(acc.hashes, nonce)
+
+	if len(acc.txs) == 0 {
+		delete(p.accounts, from)
+		return
+	}
+
+	acc.promote(p.state.GetAccountBalance(from), p.cfg.AccountSlots)
+}
+
+// enforceLimits evicts the TXs above the global limits, the highest nonces of the senders
+// holding the most TXs first. Queued TXs go before the pending ones.
+func (p *Pool) enforceLimits() {
+	pending, queued := p.count()
+
+	for queued > p.cfg.GlobalQueue {
+		from := p.largestAccount(func(acc *account) int { return acc.queued() })
+		acc := p.accounts[from]
+
+		// Evicting a queued TX never promotes others
+		p.removeTx(from, acc.highestNonce())
+		queued--
+	}
+
+	for pending > p.cfg.GlobalSlots {
+		from := p.largestAccount(func(acc *account) int { return acc.pending })
+		acc := p.accounts[from]
+
+		// The sender's last pending TX goes, the queued ones stay queued behind the new gap
+		p.removeTx(from, acc.next+uint(acc.pending)-1)
+		pending--
+	}
+}
+
+// largestAccount returns the sender with the most TXs by size, then by all its TXs.
+func (p *Pool) largestAccount(size func(acc *account) int) common.Address {
+	var largest common.Address
+	max, maxTotal := -1, -1
+
+	for from, acc := range p.accounts {
+		s, total := size(acc), len(acc.txs)
+		if s > max || (s == max && total > maxTotal) || (s == max && total == maxTotal && from.Hex() < largest.Hex()) {
+			largest = from
+			max, maxTotal = s, total
+		}
+	}
+
+	return largest
+}
+
+func sortTxs(txs []database.SignedTx) {
+	sort.Slice(txs, func(i, j int) bool {
+		if txs[i].Nonce != txs[j].Nonce {
+			return txs[i].Nonce < txs[j].Nonce
+		}
+
+		return txs[i].From.Hex() < txs[j].From.Hex()
+	})
+}
@@ -0,0 +1,477 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package mempool
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+
+	"github.com/IacopoMelani/the-blockchain-pub/database"
+	"github.com/IacopoMelani/the-blockchain-pub/wallet"
+)
+
+type testState struct {
+	balances map[common.Address]uint
+	nonces   map[common.Address]uint
+}
+
+func newTestState() *testState {
+	return &testState{make(map[common.Address]uint), make(map[common.Address]uint)}
+}
+
+func (s *testState) GetAccountBalance(account common.Address) uint {
+	return s.balances[account]
+}
+
+func (s *testState) GetNextAccountNonce(account common.Address) uint {
+	return s.nonces[account] + 1
+}
+
+type testSender struct {
+	key *ecdsa.PrivateKey
+	acc common.Address
+}
+
+func newTestSender(t *testing.T) testSender {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return testSender{key, crypto.PubkeyToAddress(key.PublicKey)}
+}
+
+func (s testSender) tx(t *testing.T, nonce uint, value uint) database.SignedTx {
+	return s.txWithFee(t, nonce, value, 0)
+}
+
+func (s testSender) txWithFee(t *testing.T, nonce uint, value uint, fee uint) database.SignedTx {
+	return s.txAt(t, nonce, value, fee, time.Now())
+}
+
+func (s testSender) txAt(t *testing.T, nonce uint, value uint, fee uint, at time.Time) database.SignedTx {
+	tx := database.NewTx(s.acc, common.Address{}, value, nonce, "")
+	tx.Fee = fee
+	tx.Time = uint64(at.Unix())
+
+	signedTx, err := wallet.SignTx(tx, s.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signedTx
+}
+
+func TestPool_FutureTxsArePromoted(t *testing.T) {
+	sender := newTestSender(t)
+	state := newTestState()
+	state.balances[sender.acc] = 1000
+
+	p := New(DefaultConfig)
+	p.Reset(state)
+
+	for _, nonce := range []uint{1, 3, 4} {
+		if _, err := p.Add(sender.tx(t, nonce, 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if pending, queued := p.Count(); pending != 1 || queued != 2 {
+		t.Fatalf("expected 1 pending and 2 queued TXs, got %d and %d", pending, queued)
+	}
+
+	if p.PendingNonce(sender.acc) != 2 {
+		t.Fatalf("expected pending nonce 2, got %d", p.PendingNonce(sender.acc))
+	}
+
+	_, err := p.Add(sender.tx(t, 1, 2))
+	if !errors.Is(err, ErrReplaceUnderpriced) {
+		t.Fatalf("expected %s, got %v", ErrReplaceUnderpriced, err)
+	}
+
+	// Filling the gap makes the future TXs executable
+	_, err = p.Add(sender.tx(t, 2, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pending := p.Pending()
+	if len(pending) != 4 {
+		t.Fatalf("expected 4 pending TXs, got %d", len(pending))
+	}
+
+	for i, tx := range pending {
+		if tx.Nonce != uint(i+1) {
+			t.Fatalf("expected the pending TXs ordered by nonce, got nonce %d at %d", tx.Nonce, i)
+		}
+	}
+}
+
+func TestPool_ResetDropsMinedTxs(t *testing.T) {
+	sender := newTestSender(t)
+	state := newTestState()
+	state.balances[sender.acc] = 1000
+
+	p := New(DefaultConfig)
+	p.Reset(state)
+
+	for nonce := uint(1); nonce <= 3; nonce++ {
+		if _, err := p.Add(sender.tx(t, nonce, 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A new block mined the first 2 TXs
+	state.nonces[sender.acc] = 2
+	state.balances[sender.acc] = 1000 - 2*(1+database.TxFee)
+
+	dropped := p.Reset(state)
+	if len(dropped) != 2 {
+		t.Fatalf("expected the 2 mined TXs to be dropped, got %d", len(dropped))
+	}
+
+	if pending, queued := p.Count(); pending != 1 || queued != 0 {
+		t.Fatalf("expected 1 pending TX, got %d pending and %d queued", pending, queued)
+	}
+
+	_, err := p.Add(sender.tx(t, 2, 5))
+	if !errors.Is(err, ErrNonceTooLow) {
+		t.Fatalf("expected %s, got %v", ErrNonceTooLow, err)
+	}
+}
+
+func TestPool_UnaffordableTxsStayQueued(t *testing.T) {
+	sender := newTestSender(t)
+	state := newTestState()
+	state.balances[sender.acc] = 2*database.TxFee + 10
+
+	p := New(DefaultConfig)
+	p.Reset(state)
+
+	if _, err := p.Add(sender.tx(t, 1, 10)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.Add(sender.tx(t, 2, 10)); err != nil {
+		t.Fatal(err)
+	}
+
+	if pending, queued := p.Count(); pending != 1 || queued != 1 {
+		t.Fatalf("expected 1 pending and 1 queued TX, got %d and %d", pending, queued)
+	}
+
+	_, err := p.Add(sender.tx(t, 3, 1000))
+	if !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("expected %s, got %v", ErrInsufficientFunds, err)
+	}
+
+	// The sender receives funds
+	state.balances[sender.acc] += 1000
+	p.Reset(state)
+
+	if pending, _ := p.Count(); pending != 2 {
+		t.Fatalf("expected 2 pending TXs once funded, got %d", pending)
+	}
+}
+
+func TestPool_Limits(t *testing.T) {
+	state := newTestState()
+
+	p := New(Config{GlobalSlots: 3, GlobalQueue: 1, AccountSlots: 2, AccountQueue: 1})
+	p.Reset(state)
+
+	alice := newTestSender(t)
+	bob := newTestSender(t)
+	state.balances[alice.acc] = 1000
+	state.balances[bob.acc] = 1000
+
+	for nonce := uint(1); nonce <= 3; nonce++ {
+		if _, err := p.Add(alice.tx(t, nonce, 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Alice's third TX is above her pending slots
+	if pending, queued := p.Count(); pending != 2 || queued != 1 {
+		t.Fatalf("expected 2 pending and 1 queued TXs, got %d and %d", pending, queued)
+	}
+
+	_, err := p.Add(alice.tx(t, 5, 1))
+	if !errors.Is(err, ErrAccountQueueFull) {
+		t.Fatalf("expected %s, got %v", ErrAccountQueueFull, err)
+	}
+
+	for nonce := uint(1); nonce <= 2; nonce++ {
+		if _, err := p.Add(bob.tx(t, nonce, 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The global pending slots evict the highest nonces of the largest sender
+	pending, queued := p.Count()
+	if pending != 3 || queued > 1 {
+		t.Fatalf("expected 3 pending TXs and at most 1 queued, got %d and %d", pending, queued)
+	}
+
+	if len(p.ByAccount(bob.acc)) != 2 {
+		t.Fatalf("expected Bob's TXs to be kept, got %d", len(p.ByAccount(bob.acc)))
+	}
+}
+
+func TestPool_ReplaceByFee(t *testing.T) {
+	sender := newTestSender(t)
+	state := newTestState()
+	state.balances[sender.acc] = 1000
+
+	p := New(DefaultConfig)
+	p.Reset(state)
+
+	stuck := sender.tx(t, 1, 10)
+	if _, err := p.Add(stuck); err != nil {
+		t.Fatal(err)
+	}
+
+	// A 10% bump on the default fee is 55 TBB
+	_, err := p.Add(sender.txWithFee(t, 1, 10, 54))
+	if !errors.Is(err, ErrReplaceUnderpriced) {
+		t.Fatalf("expected %s, got %v", ErrReplaceUnderpriced, err)
+	}
+
+	_, err = p.Add(sender.txWithFee(t, 1, 10, database.TxFee-1))
+	if err == nil {
+		t.Fatal("a fee below the minimum is suppose to be rejected")
+	}
+
+	speedUp := sender.txWithFee(t, 1, 10, 55)
+	replaced, err := p.Add(speedUp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stuckHash, _ := stuck.Hash()
+	speedUpHash, _ := speedUp.Hash()
+
+	if replaced == nil || replaced.Time != stuck.Time || p.Has(stuckHash) || !p.Has(speedUpHash) {
+		t.Fatal("the speed up TX is suppose to replace the stuck one")
+	}
+
+	if pending := p.Pending(); len(pending) != 1 || pending[0].Fee != 55 {
+		t.Fatalf("expected only the speed up TX to be pending, got %v", pending)
+	}
+}
+
+func TestPool_Expire(t *testing.T) {
+	sender := newTestSender(t)
+	state := newTestState()
+	state.balances[sender.acc] = 1000
+
+	p := New(Config{GlobalSlots: 10, GlobalQueue: 10, AccountSlots: 10, AccountQueue: 10, Lifetime: time.Hour})
+	p.Reset(state)
+
+	_, err := p.Add(sender.txAt(t, 1, 1, 0, time.Now().Add(-2*time.Hour)))
+	if !errors.Is(err, ErrExpired) {
+		t.Fatalf("expected %s, got %v", ErrExpired, err)
+	}
+
+	old := sender.txAt(t, 1, 1, 0, time.Now().Add(-30*time.Minute))
+	if _, err := p.Add(old); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.Add(sender.tx(t, 2, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	expired := p.Expire(time.Now().Add(45 * time.Minute))
+	if len(expired) != 1 || expired[0].Nonce != 1 {
+		t.Fatalf("expected the first TX to expire, got %v", expired)
+	}
+
+	// The second TX waits for the expired nonce again
+	if pending, queued := p.Count(); pending != 0 || queued != 1 {
+		t.Fatalf("expected 1 queued TX, got %d pending and %d queued", pending, queued)
+	}
+
+	oldHash, _ := old.Hash()
+	if !p.Recent(oldHash) {
+		t.Fatal("the expired TX is suppose to be recent")
+	}
+}
+
+func TestPool_Journal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tbb_mempool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "mempool.journal")
+
+	sender := newTestSender(t)
+	state := newTestState()
+	state.balances[sender.acc] = 1000
+
+	p := New(DefaultConfig)
+	p.Reset(state)
+
+	if _, _, err := p.OpenJournal(path); err != nil {
+		t.Fatal(err)
+	}
+
+	for nonce := uint(1); nonce <= 3; nonce++ {
+		if _, err := p.Add(sender.tx(t, nonce, 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	speedUp := sender.txWithFee(t, 3, 1, 100)
+	if _, err := p.Add(speedUp); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulates a crash, the journal isn't rotated
+	p.journal.close()
+
+	// The first TX was mined meanwhile
+	state.nonces[sender.acc] = 1
+
+	restored := New(DefaultConfig)
+	restored.Reset(state)
+
+	loaded, dropped, err := restored.OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+
+	if loaded != 3 || dropped != 1 {
+		t.Fatalf("expected 3 TXs loaded and 1 dropped, got %d and %d", loaded, dropped)
+	}
+
+	speedUpHash, _ := speedUp.Hash()
+	if pending, _ := restored.Count(); pending != 2 || !restored.Has(speedUpHash) {
+		t.Fatalf("expected the 2 TXs left to be pending, the last one replaced, got %v", restored.Pending())
+	}
+
+	// The rotated journal only holds the TXs still pending
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lines := strings.Count(string(content), "\n"); lines != 2 {
+		t.Fatalf("expected the rotated journal to hold 2 TXs, got %d", lines)
+	}
+}
+
+func TestRecentHashes(t *testing.T) {
+	r := newRecentHashes(2)
+
+	r.add(database.Hash{1})
+	r.add(database.Hash{2})
+	r.add(database.Hash{2})
+	r.add(database.Hash{3})
+
+	if r.has(database.Hash{1}) || !r.has(database.Hash{2}) || !r.has(database.Hash{3}) {
+		t.Fatal("the filter is suppose to forget the oldest hash")
+	}
+}
+
+func TestPool_NotReady(t *testing.T) {
+	sender := newTestSender(t)
+
+	_, err := New(DefaultConfig).Add(sender.tx(t, 1, 1))
+	if err != ErrNotReady {
+		t.Fatalf("expected %s, got %v", ErrNotReady, err)
+	}
+}
+
+func TestPool_Inspect(t *testing.T) {
+	alice := newTestSender(t)
+	bob := newTestSender(t)
+	state := newTestState()
+	state.balances[alice.acc] = 1000
+	state.balances[bob.acc] = 1000
+
+	p := New(DefaultConfig)
+	p.Reset(state)
+
+	emptyDigest := p.Digest()
+
+	for _, tx := range []database.SignedTx{
+		alice.txWithFee(t, 1, 1, 100),
+		alice.txWithFee(t, 2, 1, 50),
+		alice.tx(t, 5, 1),
+		bob.txWithFee(t, 1, 1, 200),
+	} {
+		if _, err := p.Add(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats := p.Stats()
+	if stats.Pending != 3 || stats.Queued != 1 || stats.Senders != 2 {
+		t.Fatalf("expected 3 pending, 1 queued TXs of 2 senders, got %+v", stats)
+	}
+
+	if stats.PendingSize == 0 || stats.QueuedSize == 0 {
+		t.Fatalf("expected the sizes of the TXs, got %+v", stats)
+	}
+
+	if stats.Digest == emptyDigest || stats.Digest != p.Digest() {
+		t.Fatalf("expected the digest to change with the pending TXs")
+	}
+
+	// A queued TX isn't pending, the digest stays the same
+	if _, err := p.Add(bob.tx(t, 3, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if p.Digest() != stats.Digest {
+		t.Fatalf("expected the digest to ignore the queued TXs")
+	}
+
+	entries := p.Filter(Filter{From: alice.acc})
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 TXs of alice, got %d", len(entries))
+	}
+
+	if entries[0].Tx.Nonce != 1 || entries[1].Tx.Nonce != 2 || entries[2].Status != StatusQueued {
+		t.Fatalf("expected the pending TXs first ordered by nonce, got %+v", entries)
+	}
+
+	if entries := p.Filter(Filter{MinFee: 100, Status: StatusPending}); len(entries) != 2 {
+		t.Fatalf("expected 2 pending TXs paying at least 100, got %d", len(entries))
+	}
+
+	if entries := p.Filter(Filter{MinNonce: 2, MaxNonce: 3}); len(entries) != 2 {
+		t.Fatalf("expected 2 TXs with nonce in [2, 3], got %d", len(entries))
+	}
+
+	entry, ok := p.Entry(entries[2].Hash)
+	if !ok || entry.Status != StatusQueued || entry.Tx.Nonce != 5 {
+		t.Fatalf("expected the queued TX of alice, got %+v", entry)
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package mempool
+
+import "github.com/IacopoMelani/the-blockchain-pub/database"
+
+// maxRecentHashes bounds the filter of the TXs that left the pool
+const maxRecentHashes = 16384
+
+// recentHashes remembers the latest hashes in a ring, forgetting the oldest ones.
+type recentHashes struct {
+	hashes map[database.Hash]struct{}
+	ring   []database.Hash
+	next   int
+}
+
+func newRecentHashes(size int) *recentHashes {
+	return &recentHashes{
+		hashes: make(map[database.Hash]struct{}, size),
+		ring:   make([]database.Hash, 0, size),
+	}
+}
+
+func (r *recentHashes) add(hash database.Hash) {
+	if _, ok := r.hashes[hash]; ok {
+		return
+	}
+
+	if len(r.ring) < cap(r.ring) {
+		r.ring = append(r.ring, hash)
+	} else {
+		delete(r.hashes, r.ring[r.next])
+		r.ring[r.next] = hash
+		r.next = (r.next + 1) % len(r.ring)
+	}
+
+	r.hashes[hash] = struct{}{}
+}
+
+func (r *recentHashes) has(hash database.Hash) bool {
+	_, ok := r.hashes[hash]
+	return ok
+}
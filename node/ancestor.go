@@ -0,0 +1,131 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package node
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/IacopoMelani/the-blockchain-pub/database"
+)
+
+type BlockHashRes struct {
+	Number uint64        `json:"block_number"`
+	Hash   database.Hash `json:"block_hash"`
+}
+
+// findCommonAncestor returns the number of the latest block shared by the local chain and the peer's chain.
+//
+// It walks back from the local tip with exponentially growing steps until a shared block is found,
+// then binary searches the fork point between that block and the closest diverging one.
+func (n *Node) findCommonAncestor(peer PeerNode) (uint64, bool, error) {
+	if n.state.LatestBlockHash().IsEmpty() {
+		return 0, false, nil
+	}
+
+	isShared := func(number uint64) (bool, error) {
+		peerHash, ok, err := n.peerBlockHash(peer, number)
+		if err != nil || !ok {
+			return false, err
+		}
+
+		localHash, _ := n.state.BlockHash(number)
+
+		return peerHash == localHash, nil
+	}
+
+	tip := n.state.LatestBlock().Header.Number
+
+	// The ancestor is in [shared, diverging)
+	shared := uint64(0)
+	diverging := tip + 1
+
+	number := tip
+	step := uint64(1)
+
+	for {
+		ok, err := isShared(number)
+		if err != nil {
+			return 0, false, err
+		}
+
+		if ok {
+			shared = number
+			break
+		}
+
+		diverging = number
+
+		// Not even the genesis block is shared
+		if number == 0 {
+			return 0, false, nil
+		}
+
+		if step > number {
+			number = 0
+		} else {
+			number -= step
+		}
+		step *= 2
+	}
+
+	for diverging-shared > 1 {
+		middle := shared + (diverging-shared)/2
+
+		ok, err := isShared(middle)
+		if err != nil {
+			return 0, false, err
+		}
+
+		if ok {
+			shared = middle
+		} else {
+			diverging = middle
+		}
+	}
+
+	return shared, true, nil
+}
+
+// fetchBlockHashFromPeer returns the hash of the peer's block with the given number, if the peer has it.
+func fetchBlockHashFromPeer(peer PeerNode, number uint64) (database.Hash, bool, error) {
+	url := fmt.Sprintf(
+		"%s://%s%s?%s=%d",
+		peer.ApiProtocol(),
+		peer.TcpAddress(),
+		endpointBlockHash,
+		endpointBlockHashQueryKeyNumber,
+		number,
+	)
+
+	res, err := http.Get(url)
+	if err != nil {
+		return database.Hash{}, false, err
+	}
+
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return database.Hash{}, false, nil
+	}
+
+	blockHashRes := BlockHashRes{}
+	err = readRes(res, &blockHashRes)
+	if err != nil {
+		return database.Hash{}, false, err
+	}
+
+	return blockHashRes.Hash, true, nil
+}
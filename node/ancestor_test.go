@@ -0,0 +1,182 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package node
+
+import (
+	"testing"
+
+	"github.com/IacopoMelani/the-blockchain-pub/database"
+	"github.com/IacopoMelani/the-blockchain-pub/fs"
+	"github.com/IacopoMelani/the-blockchain-pub/wallet"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestNode_SyncFromCommonAncestor(t *testing.T) {
+	miner := database.NewAccount(testKsBabaYagaAccount)
+	forkMiner := database.NewAccount(testKsAndrejAccount)
+
+	source, sourceDataDir := newTestNode(t, miner)
+	defer fs.RemoveDir(sourceDataDir)
+	defer source.state.Close()
+	source.miningDifficulty = 1 << 8
+
+	n, dataDir := newTestNode(t, miner)
+	defer fs.RemoveDir(dataDir)
+	defer n.state.Close()
+	n.miningDifficulty = 1 << 8
+
+	go func() {
+		for range n.newSyncedBlocks {
+		}
+	}()
+
+	// Both chains share the first 6 blocks, then the local node mines a fork of 3 blocks
+	mineTestBlocks(t, source, miner, 6)
+
+	shared, err := database.GetBlocksAfter(database.Hash{}, 6, sourceDataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, block := range shared {
+		err = n.addBlock(block.Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mineTestBlocks(t, n, forkMiner, 3)
+	mineTestBlocks(t, source, miner, 6)
+
+	peer := serveTestSyncPeer(t, source)
+
+	ancestor, found, err := n.findCommonAncestor(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !found || ancestor != 5 {
+		t.Fatalf("expected common ancestor 5, got %d (found %t)", ancestor, found)
+	}
+
+	status := StatusRes{Hash: source.state.LatestBlockHash(), Number: source.state.LatestBlock().Header.Number}
+
+	err = n.syncBlocks(peer, status)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n.state.LatestBlockHash() != source.state.LatestBlockHash() {
+		t.Fatalf("expected to sync up to block %d, got %d", status.Number, n.state.LatestBlock().Header.Number)
+	}
+
+	if n.state.Balances[forkMiner] != 0 {
+		t.Fatal("the rewards of the dropped fork blocks are not suppose to be kept")
+	}
+
+	reloaded, err := database.NewStateFromDisk(dataDir, n.engine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloaded.Close()
+
+	if reloaded.LatestBlockHash() != source.state.LatestBlockHash() {
+		t.Fatal("the rewound chain is suppose to be persisted")
+	}
+}
+
+func TestNode_SyncRestoresChainOnInvalidFork(t *testing.T) {
+	miner := database.NewAccount(testKsBabaYagaAccount)
+	forkMiner := database.NewAccount(testKsAndrejAccount)
+
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := crypto.PubkeyToAddress(key.PublicKey)
+
+	// The sender is funded only in the source genesis, its TX is invalid for the local node
+	source, sourceDataDir := newTestNodeWithBalances(t, miner, map[common.Address]uint{sender: 100})
+	defer fs.RemoveDir(sourceDataDir)
+	defer source.state.Close()
+	source.miningDifficulty = 1 << 8
+
+	n, dataDir := newTestNode(t, miner)
+	defer fs.RemoveDir(dataDir)
+	defer n.state.Close()
+	n.miningDifficulty = 1 << 8
+
+	go func() {
+		for range n.newSyncedBlocks {
+		}
+	}()
+
+	mineTestBlocks(t, source, miner, 6)
+
+	shared, err := database.GetBlocksAfter(database.Hash{}, 6, sourceDataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, block := range shared {
+		err = n.addBlock(block.Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mineTestBlocks(t, n, forkMiner, 3)
+
+	localHead := n.state.LatestBlockHash()
+	localBalance := n.state.Balances[forkMiner]
+
+	tx, err := wallet.SignTx(database.NewTx(sender, common.Address{}, 1, 1, ""), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = source.AddPendingTX(tx, source.info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mineTestBlocks(t, source, miner, 6)
+
+	status := StatusRes{Hash: source.state.LatestBlockHash(), Number: source.state.LatestBlock().Header.Number}
+
+	if n.syncBlocks(serveTestSyncPeer(t, source), status) == nil {
+		t.Fatal("a fork with an invalid block is not suppose to be imported")
+	}
+
+	if n.state.LatestBlockHash() != localHead {
+		t.Fatalf("the local chain is suppose to be restored, got block %d", n.state.LatestBlock().Header.Number)
+	}
+
+	if n.state.Balances[forkMiner] != localBalance {
+		t.Fatal("the rewards of the restored blocks are suppose to be kept")
+	}
+
+	reloaded, err := database.NewStateFromDisk(dataDir, n.engine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloaded.Close()
+
+	if reloaded.LatestBlockHash() != localHead {
+		t.Fatal("the restored chain is suppose to be persisted")
+	}
+}
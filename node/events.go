@@ -0,0 +1,118 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package node
+
+import (
+	"sync"
+
+	"github.com/IacopoMelani/the-blockchain-pub/database"
+)
+
+const (
+	EventNewHead   = "newHeads"
+	EventPendingTx = "pendingTransactions"
+	EventReorg     = "reorg"
+)
+
+// Events a subscriber can lag behind before being dropped
+const eventSubBuffer = 256
+
+// event is published on the node's event bus every time the chain or the mempool changes.
+type event struct {
+	kind string
+
+	// EventNewHead
+	block database.BlockFS
+
+	// EventPendingTx
+	txHash database.Hash
+	tx     database.SignedTx
+
+	// EventReorg
+	reorg ReorgRes
+}
+
+// ReorgRes is the chain rewound from the old head to the new one, before importing a fork.
+// The new head is empty when the whole chain was reset.
+type ReorgRes struct {
+	OldHead   database.Hash `json:"old_head"`
+	OldNumber uint64        `json:"old_number"`
+	NewHead   database.Hash `json:"new_head"`
+	NewNumber uint64        `json:"new_number"`
+}
+
+type eventSub struct {
+	kinds  map[string]struct{}
+	events chan event
+
+	// Closed when the subscriber lagged too far behind and was dropped
+	dropped chan struct{}
+}
+
+// eventBus fans the events out to the subscribers without ever blocking the publisher.
+type eventBus struct {
+	subs map[*eventSub]struct{}
+	lock sync.Mutex
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subs: make(map[*eventSub]struct{})}
+}
+
+// subscribe receives the events of the given kinds, all of them if none.
+func (b *eventBus) subscribe(kinds ...string) *eventSub {
+	sub := &eventSub{
+		kinds:   make(map[string]struct{}),
+		events:  make(chan event, eventSubBuffer),
+		dropped: make(chan struct{}),
+	}
+
+	for _, kind := range kinds {
+		sub.kinds[kind] = struct{}{}
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.subs[sub] = struct{}{}
+
+	return sub
+}
+
+func (b *eventBus) unsubscribe(sub *eventSub) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	delete(b.subs, sub)
+}
+
+func (b *eventBus) publish(e event) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for sub := range b.subs {
+		if _, ok := sub.kinds[e.kind]; !ok && len(sub.kinds) > 0 {
+			continue
+		}
+
+		select {
+		case sub.events <- e:
+		default:
+			delete(b.subs, sub)
+			close(sub.dropped)
+		}
+	}
+}
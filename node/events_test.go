@@ -0,0 +1,60 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package node
+
+import (
+	"testing"
+)
+
+func TestEventBus(t *testing.T) {
+	bus := newEventBus()
+
+	heads := bus.subscribe(EventNewHead)
+	all := bus.subscribe()
+
+	bus.publish(event{kind: EventPendingTx})
+
+	if len(heads.events) != 0 || len(all.events) != 1 {
+		t.Fatalf("expected the pending TX event to reach the subscriber of all the events only, got %d and %d", len(heads.events), len(all.events))
+	}
+
+	for i := 0; i < eventSubBuffer; i++ {
+		bus.publish(event{kind: EventNewHead})
+	}
+
+	select {
+	case <-all.dropped:
+	default:
+		t.Fatal("expected the subscriber lagging behind to be dropped")
+	}
+
+	select {
+	case <-heads.dropped:
+		t.Fatal("expected the subscriber with room for the events to be kept")
+	default:
+	}
+
+	// The dropped subscriber doesn't block nor break the next events
+	bus.publish(event{kind: EventReorg})
+	bus.unsubscribe(all)
+
+	bus.unsubscribe(heads)
+	bus.publish(event{kind: EventNewHead})
+
+	if len(heads.events) != eventSubBuffer {
+		t.Fatalf("expected no events after unsubscribing, got %d", len(heads.events)-eventSubBuffer)
+	}
+}
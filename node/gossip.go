@@ -0,0 +1,280 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/IacopoMelani/the-blockchain-pub/database"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// maxSeenHashes bounds the de-duplication set of announced blocks and TXs
+const maxSeenHashes = 10000
+
+// Max announces waiting to be fetched, the ones arriving once the queue is full are dropped
+const maxQueuedAnnounces = 256
+
+// Number of goroutines fetching the announced blocks and TXs from the peers
+const announceWorkers = 4
+
+type AnnounceBlockReq struct {
+	Hash   database.Hash `json:"block_hash"`
+	Parent database.Hash `json:"parent_hash"`
+	Number uint64        `json:"block_number"`
+	From   PeerNode      `json:"from"`
+}
+
+type AnnounceTxReq struct {
+	Hash database.Hash `json:"tx_hash"`
+	From PeerNode      `json:"from"`
+}
+
+type AnnounceRes struct {
+	Known bool `json:"known"`
+}
+
+type PendingTxRes struct {
+	Tx database.SignedTx `json:"tx"`
+}
+
+// markSeen records the hash as announced and reports whether it was already known.
+func (n *Node) markSeen(hash database.Hash) bool {
+	n.seenLock.Lock()
+	defer n.seenLock.Unlock()
+
+	if _, ok := n.seenHashes[hash]; ok {
+		return true
+	}
+
+	n.seenHashes[hash] = struct{}{}
+	n.seenHashesList = append(n.seenHashesList, hash)
+
+	if len(n.seenHashesList) > maxSeenHashes {
+		delete(n.seenHashes, n.seenHashesList[0])
+		n.seenHashesList = n.seenHashesList[1:]
+	}
+
+	return false
+}
+
+// isSeen reports whether the hash was already announced, without recording it.
+func (n *Node) isSeen(hash database.Hash) bool {
+	n.seenLock.Lock()
+	defer n.seenLock.Unlock()
+
+	_, ok := n.seenHashes[hash]
+
+	return ok
+}
+
+// announcer is the peer an announce request comes from. Its From is not signed, so only the port
+// is taken from it: the announced block or TX is fetched from the host that sent the request.
+func (n *Node) announcer(r *http.Request, from PeerNode) (PeerNode, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return PeerNode{}, fmt.Errorf("invalid announcer address '%s'. %s", r.RemoteAddr, err)
+	}
+
+	for _, peer := range n.KnownPeers() {
+		if peer.IP == host && peer.Port == from.Port {
+			return peer, nil
+		}
+	}
+
+	return NewPeerNode(host, from.Port, false, common.Address{}, false, from.NodeVersion), nil
+}
+
+// announceBlock pushes the block to every known peer but the one it came from,
+// the whole block to the p2p peers and just its header to the HTTP ones.
+func (n *Node) announceBlock(block database.Block, fromPeer PeerNode) {
+	hash, err := block.Hash()
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		return
+	}
+
+	n.markSeen(hash)
+
+	blockJson, err := json.Marshal(database.BlockFS{Key: hash, Value: block})
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		return
+	}
+
+	req := AnnounceBlockReq{
+		Hash:   hash,
+		Parent: block.Header.Parent,
+		Number: block.Header.Number,
+		From:   n.advertised(),
+	}
+
+	n.broadcast(fromPeer, func(peer PeerNode) error {
+		if session := n.p2pSession(peer); session != nil {
+			return session.Notify(newBlockMsg, blockJson)
+		}
+
+		return postJson(peerUrl(peer, endpointAnnounceBlock), req, &AnnounceRes{})
+	})
+}
+
+// announceTx pushes the TX to every known peer but the one it came from,
+// the whole TX to the p2p peers and just its hash to the HTTP ones.
+func (n *Node) announceTx(tx database.SignedTx, hash database.Hash, fromPeer PeerNode) {
+	n.markSeen(hash)
+
+	txJson, err := json.Marshal(tx)
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		return
+	}
+
+	req := AnnounceTxReq{
+		Hash: hash,
+		From: n.advertised(),
+	}
+
+	n.broadcast(fromPeer, func(peer PeerNode) error {
+		if session := n.p2pSession(peer); session != nil {
+			return session.Notify(newTxMsg, txJson)
+		}
+
+		return postJson(peerUrl(peer, endpointAnnounceTx), req, &AnnounceRes{})
+	})
+}
+
+func (n *Node) broadcast(fromPeer PeerNode, announce func(peer PeerNode) error) {
+	for _, peer := range n.KnownPeers() {
+		if peer.IP == "" {
+			continue
+		}
+
+		if n.isSelf(peer) || peer.TcpAddress() == fromPeer.TcpAddress() || (peer.ID != "" && peer.ID == fromPeer.ID) {
+			continue
+		}
+
+		go func(peer PeerNode) {
+			err := announce(peer)
+			if err != nil {
+				fmt.Printf("ERROR: unable to announce to Peer %s. %s\n", peer.TcpAddress(), err)
+			}
+		}(peer)
+	}
+}
+
+func peerUrl(peer PeerNode, endpoint string) string {
+	return fmt.Sprintf("%s://%s%s", peer.ApiProtocol(), peer.TcpAddress(), endpoint)
+}
+
+// queueAnnounce hands the announce to the workers and reports whether the queue had room for it.
+func (n *Node) queueAnnounce(handle func()) bool {
+	select {
+	case n.announces <- handle:
+		return true
+	default:
+		return false
+	}
+}
+
+// handleAnnounces fetches the queued announces until the ctx is done, the ones left are dropped.
+func (n *Node) handleAnnounces(ctx context.Context) {
+	for {
+		select {
+		case handle := <-n.announces:
+			handle()
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// handleBlockAnnounce imports the announced block from the peer if it extends the local chain and relays it on success.
+func (n *Node) handleBlockAnnounce(peer PeerNode, req AnnounceBlockReq) {
+	err := n.syncBlocks(peer, StatusRes{Hash: req.Hash, Number: req.Number})
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		return
+	}
+
+	if n.state.LatestBlockHash() != req.Hash {
+		return
+	}
+
+	n.announceBlock(n.state.LatestBlock(), peer)
+}
+
+// handleTxAnnounce fetches the announced TX from the peer and adds it to the pending TXs.
+func (n *Node) handleTxAnnounce(peer PeerNode, req AnnounceTxReq) {
+	tx, err := fetchPendingTxFromPeer(peer, req.Hash)
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		return
+	}
+
+	hash, err := tx.Hash()
+	if err != nil || hash != req.Hash {
+		n.penalizePeer(peer, PeerScoreInvalidTx, fmt.Errorf("TX '%x' doesn't match its hash", req.Hash))
+		return
+	}
+
+	err = n.checkPeerTx(peer, tx)
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		return
+	}
+
+	err = n.AddPendingTX(tx, peer)
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+	}
+}
+
+func (n *Node) isPendingTX(hash database.Hash) bool {
+	return n.mempool.Has(hash)
+}
+
+func (n *Node) getPendingTX(hash database.Hash) (database.SignedTx, bool) {
+	return n.mempool.Get(hash)
+}
+
+func fetchPendingTxFromPeer(peer PeerNode, hash database.Hash) (database.SignedTx, error) {
+	url := fmt.Sprintf(
+		"%s://%s%s?%s=%s",
+		peer.ApiProtocol(),
+		peer.TcpAddress(),
+		endpointPendingTx,
+		endpointPendingTxQueryKeyHash,
+		hash.Hex(),
+	)
+
+	res, err := http.Get(url)
+	if err != nil {
+		return database.SignedTx{}, err
+	}
+
+	pendingTxRes := PendingTxRes{}
+	err = readRes(res, &pendingTxRes)
+	if err != nil {
+		return database.SignedTx{}, err
+	}
+
+	return pendingTxRes.Tx, nil
+}
@@ -0,0 +1,269 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package node
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/IacopoMelani/the-blockchain-pub/database"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/labstack/echo/v4"
+)
+
+func TestNode_MarkSeen(t *testing.T) {
+	n := New("", "127.0.0.1", 8085, common.Address{}, PeerNode{}, nodeVersion, defaultTestMiningDifficulty)
+
+	first := database.Hash{1}
+	if n.markSeen(first) {
+		t.Fatal("a new hash is not suppose to be seen")
+	}
+
+	if !n.markSeen(first) {
+		t.Fatal("an announced hash is suppose to be seen")
+	}
+
+	for i := 0; i < maxSeenHashes; i++ {
+		hash := database.Hash{}
+		hash[30] = byte(i >> 8)
+		hash[31] = byte(i)
+		hash[0] = 2
+
+		n.markSeen(hash)
+	}
+
+	if len(n.seenHashesList) != maxSeenHashes {
+		t.Fatalf("expected %d seen hashes, got %d", maxSeenHashes, len(n.seenHashesList))
+	}
+
+	if n.markSeen(first) {
+		t.Fatal("the oldest hash is suppose to be evicted")
+	}
+}
+
+func TestNode_AnnounceBlockDeduplication(t *testing.T) {
+	n, dataDir := newTestNode(t, common.Address{})
+	defer os.RemoveAll(dataDir)
+
+	req := AnnounceBlockReq{Hash: database.Hash{1}, Number: 0}
+
+	res := announceBlock(t, n, req)
+	if !res.Known {
+		t.Fatal("a block not higher than the local tip is suppose to be known")
+	}
+
+	if n.isSeen(req.Hash) {
+		t.Fatal("an announced block is not suppose to be seen before it's imported")
+	}
+
+	// Imported and relayed
+	n.markSeen(req.Hash)
+	req.Number = 10
+
+	res = announceBlock(t, n, req)
+	if !res.Known {
+		t.Fatal("an already imported block is suppose to be known")
+	}
+}
+
+func TestNode_AnnounceTx(t *testing.T) {
+	n, dataDir := newTestNode(t, common.Address{})
+	defer os.RemoveAll(dataDir)
+	defer n.state.Close()
+
+	m, mDataDir := newTestNode(t, common.Address{})
+	defer os.RemoveAll(mDataDir)
+	defer m.state.Close()
+
+	tx := addTestPendingTXs(t, m, 1)[0]
+	hash, err := tx.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The block funding the sender
+	funding, _, err := m.state.GetBlockByNumber(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = n.addBlock(funding.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+	go n.handleAnnounces(ctx)
+
+	forger := httptest.NewServer(http.NotFoundHandler())
+	defer forger.Close()
+
+	sender := httptest.NewServer(m.httpHandler())
+	defer sender.Close()
+
+	// A forged announce of a TX its host doesn't have
+	res := announceTx(t, n, AnnounceTxReq{Hash: hash, From: testServerPeer(t, forger)}, "127.0.0.1:50000")
+	if res.Known {
+		t.Fatal("a new TX is not suppose to be known")
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	if n.isSeen(hash) || n.isPendingTX(hash) {
+		t.Fatal("a TX not fetched is not suppose to be seen")
+	}
+
+	res = announceTx(t, n, AnnounceTxReq{Hash: hash, From: testServerPeer(t, sender)}, "127.0.0.1:50000")
+	if res.Known {
+		t.Fatal("the forged announce is not suppose to shadow the real one")
+	}
+
+	for i := 0; i < 50 && !n.isPendingTX(hash); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if !n.isPendingTX(hash) || !n.isSeen(hash) {
+		t.Fatal("the TX announced by its sender is suppose to be pending")
+	}
+}
+
+func TestNode_AnnounceQueueFull(t *testing.T) {
+	n, dataDir := newTestNode(t, common.Address{})
+	defer os.RemoveAll(dataDir)
+	defer n.state.Close()
+
+	// No worker fetches the announces
+	for i := 0; i < maxQueuedAnnounces; i++ {
+		if !n.queueAnnounce(func() {}) {
+			t.Fatalf("expected the queue to have room for %d announces, got %d", maxQueuedAnnounces, i)
+		}
+	}
+
+	reqJson, err := json.Marshal(AnnounceTxReq{Hash: database.Hash{1}, From: PeerNode{Port: 8080}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	err = announceTxHandler(echo.New().NewContext(httptest.NewRequest(http.MethodPost, endpointAnnounceTx, bytes.NewReader(reqJson)), rec), n)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rec.Code != http.StatusServiceUnavailable || len(n.announces) != maxQueuedAnnounces {
+		t.Fatalf("expected the announce to be dropped once the queue is full, got status %d", rec.Code)
+	}
+}
+
+func TestNode_Announcer(t *testing.T) {
+	n := New("", "127.0.0.1", 8085, common.Address{}, PeerNode{}, nodeVersion, defaultTestMiningDifficulty)
+
+	req := httptest.NewRequest(http.MethodPost, endpointAnnounceTx, nil)
+	req.RemoteAddr = "10.0.0.5:50000"
+
+	peer, err := n.announcer(req, NewPeerNode("10.0.0.9", 8080, false, common.Address{}, true, nodeVersion))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if peer.TcpAddress() != "10.0.0.5:8080" {
+		t.Fatalf("expected the announced data fetched from the sending host, not '%s'", peer.TcpAddress())
+	}
+
+	known := NewPeerNode("10.0.0.5", 8080, false, common.Address{}, true, nodeVersion)
+	known.ID = "known"
+	n.AddPeer(known)
+
+	peer, err = n.announcer(req, PeerNode{Port: 8080})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if peer.ID != known.ID {
+		t.Fatalf("expected the known peer at the sending host, got %+v", peer)
+	}
+}
+
+func testServerPeer(t *testing.T, server *httptest.Server) PeerNode {
+	serverUrl, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port, err := strconv.ParseUint(serverUrl.Port(), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewPeerNode(serverUrl.Hostname(), port, false, common.Address{}, false, nodeVersion)
+}
+
+func announceTx(t *testing.T, n *Node, req AnnounceTxReq, remoteAddr string) AnnounceRes {
+	reqJson, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	httpReq := httptest.NewRequest(http.MethodPost, endpointAnnounceTx, bytes.NewReader(reqJson))
+	httpReq.RemoteAddr = remoteAddr
+
+	rec := httptest.NewRecorder()
+	err = announceTxHandler(echo.New().NewContext(httpReq, rec), n)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := AnnounceRes{}
+	err = json.Unmarshal(rec.Body.Bytes(), &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return res
+}
+
+func announceBlock(t *testing.T, n *Node, req AnnounceBlockReq) AnnounceRes {
+	reqJson, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	rec := httptest.NewRecorder()
+	c := e.NewContext(httptest.NewRequest(http.MethodPost, endpointAnnounceBlock, bytes.NewReader(reqJson)), rec)
+
+	err = announceBlockHandler(c, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := AnnounceRes{}
+	err = json.Unmarshal(rec.Body.Bytes(), &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return res
+}
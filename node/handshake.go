@@ -0,0 +1,190 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package node
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/IacopoMelani/the-blockchain-pub/database"
+)
+
+// ProtocolVersion is bumped on every incompatible change of the peer to peer protocol
+const ProtocolVersion = 1
+
+// Carries the HMAC-SHA256 of the handshake body on networks protected by a shared secret
+const headerNetworkAuth = "X-Tbb-Network-Auth"
+
+// Handshake is exchanged by two nodes before they sync with each other.
+type Handshake struct {
+	GenesisHash     database.Hash `json:"genesis_hash"`
+	ChainID         string        `json:"chain_id"`
+	ProtocolVersion uint          `json:"protocol_version"`
+	BestHash        database.Hash `json:"block_hash"`
+	BestNumber      uint64        `json:"block_number"`
+	Peer            PeerNode      `json:"peer"`
+}
+
+// loadGenesis remembers the network the node belongs to, from the genesis of its data dir.
+func (n *Node) loadGenesis() error {
+	genesis, err := database.LoadGenesis(n.dataDir)
+	if err != nil {
+		return err
+	}
+
+	genesisHash, err := database.GenesisHash(n.dataDir)
+	if err != nil {
+		return err
+	}
+
+	n.chainID = genesis.ChainID
+	n.genesisHash = genesisHash
+
+	return nil
+}
+
+// SetNetworkSecret requires the peers to authenticate their handshake with the shared secret.
+func (n *Node) SetNetworkSecret(secret string) {
+	n.networkSecret = secret
+}
+
+func (n *Node) handshake() Handshake {
+	return Handshake{
+		GenesisHash:     n.genesisHash,
+		ChainID:         n.chainID,
+		ProtocolVersion: ProtocolVersion,
+		BestHash:        n.state.LatestBlockHash(),
+		BestNumber:      n.state.LatestBlock().Header.Number,
+		Peer:            n.advertised(),
+	}
+}
+
+// checkHandshake rejects the peers of other networks or speaking another protocol version.
+func (n *Node) checkHandshake(h Handshake) error {
+	if h.ProtocolVersion != ProtocolVersion {
+		return fmt.Errorf("incompatible protocol version %d, expected %d", h.ProtocolVersion, ProtocolVersion)
+	}
+
+	if h.ChainID != n.chainID {
+		return fmt.Errorf("different chain ID '%s', expected '%s'", h.ChainID, n.chainID)
+	}
+
+	if h.GenesisHash != n.genesisHash {
+		return fmt.Errorf("different genesis %s, expected %s", h.GenesisHash.Hex(), n.genesisHash.Hex())
+	}
+
+	if h.Peer.IP == "" || h.Peer.Port == 0 {
+		return fmt.Errorf("missing peer address")
+	}
+
+	if h.Peer.ID == "" {
+		return fmt.Errorf("missing node ID")
+	}
+
+	if h.Peer.ID == n.info.ID {
+		return fmt.Errorf("connected to itself")
+	}
+
+	return nil
+}
+
+func (n *Node) networkAuth(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(n.networkSecret))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkNetworkAuth verifies the HMAC of the body, any body is accepted without a network secret.
+func (n *Node) checkNetworkAuth(body []byte, auth string) error {
+	if n.networkSecret == "" {
+		return nil
+	}
+
+	if !hmac.Equal([]byte(n.networkAuth(body)), []byte(auth)) {
+		return fmt.Errorf("invalid network authentication")
+	}
+
+	return nil
+}
+
+// sendHandshake registers the node into the peer's KnownPeers and returns the peer's handshake.
+func (n *Node) sendHandshake(peer PeerNode) (Handshake, error) {
+	reqBody, err := json.Marshal(n.handshake())
+	if err != nil {
+		return Handshake{}, err
+	}
+
+	url := fmt.Sprintf("%s://%s%s", peer.ApiProtocol(), peer.TcpAddress(), endpointAddPeer)
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(reqBody))
+	if err != nil {
+		return Handshake{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	sig, err := n.signPayload(reqBody)
+	if err != nil {
+		return Handshake{}, err
+	}
+	req.Header.Set(headerSignature, sig)
+
+	if n.networkSecret != "" {
+		req.Header.Set(headerNetworkAuth, n.networkAuth(reqBody))
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return Handshake{}, err
+	}
+
+	resBodyJson, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return Handshake{}, fmt.Errorf("unable to read response body. %s", err.Error())
+	}
+	defer res.Body.Close()
+
+	addPeerRes := AddPeerRes{}
+	err = json.Unmarshal(resBodyJson, &addPeerRes)
+	if err != nil {
+		return Handshake{}, fmt.Errorf("unable to unmarshal response body. %s", err.Error())
+	}
+
+	if !addPeerRes.Success {
+		return Handshake{}, fmt.Errorf("handshake rejected by '%s'. %s", peer.TcpAddress(), addPeerRes.Error)
+	}
+
+	signer, err := recoverPayloadSigner(resBodyJson, res.Header.Get(headerSignature))
+	if err != nil {
+		return Handshake{}, err
+	}
+
+	if signer != addPeerRes.Handshake.Peer.ID {
+		return Handshake{}, fmt.Errorf("handshake of '%s' is not signed by node %s", peer.TcpAddress(), addPeerRes.Handshake.Peer.ID)
+	}
+
+	if peer.ID != "" && peer.ID != signer {
+		return Handshake{}, fmt.Errorf("node at '%s' changed identity from %s to %s", peer.TcpAddress(), peer.ID, signer)
+	}
+
+	return addPeerRes.Handshake, nil
+}
@@ -0,0 +1,149 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package node
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/labstack/echo/v4"
+)
+
+func TestNode_Handshake(t *testing.T) {
+	n, dataDir := newTestNode(t, common.Address{})
+	defer os.RemoveAll(dataDir)
+
+	err := n.loadGenesis()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peerKey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer := NewPeerNode("127.0.0.1", 8086, false, common.Address{}, false, nodeVersion)
+	peer.ID = NodeID(&peerKey.PublicKey)
+	handshake := n.handshake()
+	handshake.Peer = peer
+
+	res, status := postHandshake(t, n, handshake, peerKey, "")
+	if status != http.StatusOK || !res.Success {
+		t.Fatalf("a peer of the same network is suppose to be accepted, got %d '%s'", status, res.Error)
+	}
+
+	if !n.IsKnownPeer(peer) {
+		t.Fatal("an accepted peer is suppose to be known")
+	}
+
+	if res.Handshake.GenesisHash != n.genesisHash {
+		t.Fatal("the response is suppose to carry the node's handshake")
+	}
+
+	mismatched := handshake
+	mismatched.ChainID = "another-chain"
+	if res, _ := postHandshake(t, n, mismatched, peerKey, ""); res.Success {
+		t.Fatal("a peer of another chain is not suppose to be accepted")
+	}
+
+	mismatched = handshake
+	mismatched.ProtocolVersion = ProtocolVersion + 1
+	if res, _ := postHandshake(t, n, mismatched, peerKey, ""); res.Success {
+		t.Fatal("a peer speaking another protocol version is not suppose to be accepted")
+	}
+
+	impostorKey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, status := postHandshake(t, n, handshake, impostorKey, ""); status != http.StatusUnauthorized {
+		t.Fatalf("a handshake signed by another node is suppose to be unauthorized, got %d", status)
+	}
+}
+
+func TestNode_HandshakeNetworkSecret(t *testing.T) {
+	n, dataDir := newTestNode(t, common.Address{})
+	defer os.RemoveAll(dataDir)
+
+	err := n.loadGenesis()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n.SetNetworkSecret("secret")
+
+	peerKey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handshake := n.handshake()
+	handshake.Peer = NewPeerNode("127.0.0.1", 8086, false, common.Address{}, false, nodeVersion)
+	handshake.Peer.ID = NodeID(&peerKey.PublicKey)
+
+	if _, status := postHandshake(t, n, handshake, peerKey, "forged"); status != http.StatusUnauthorized {
+		t.Fatalf("a forged handshake is suppose to be unauthorized, got %d", status)
+	}
+
+	body, err := json.Marshal(handshake)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, status := postHandshake(t, n, handshake, peerKey, n.networkAuth(body)); status != http.StatusOK {
+		t.Fatalf("an authenticated handshake is suppose to be accepted, got %d", status)
+	}
+}
+
+func postHandshake(t *testing.T, n *Node, handshake Handshake, key *ecdsa.PrivateKey, auth string) (AddPeerRes, int) {
+	body, err := json.Marshal(handshake)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sig, err := crypto.Sign(crypto.Keccak256(body), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, endpointAddPeer, bytes.NewReader(body))
+	req.Header.Set(headerNetworkAuth, auth)
+	req.Header.Set(headerSignature, hex.EncodeToString(sig))
+
+	rec := httptest.NewRecorder()
+	err = addPeerHandler(echo.New().NewContext(req, rec), n)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := AddPeerRes{}
+	err = json.Unmarshal(rec.Body.Bytes(), &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return res, rec.Code
+}
@@ -0,0 +1,293 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package node
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/IacopoMelani/the-blockchain-pub/database"
+	"github.com/IacopoMelani/the-blockchain-pub/mempool"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Default and max number of entries in a page of the address history
+const defaultHistoryLimit = 50
+const maxHistoryLimit = 100
+
+const (
+	DirectionIn     = "in"
+	DirectionOut    = "out"
+	DirectionSelf   = "self"
+	DirectionReward = "reward"
+)
+
+type HistoryEntry struct {
+	Direction   string             `json:"direction"`
+	Status      string             `json:"status"`
+	Hash        database.Hash      `json:"hash,omitempty"`
+	Tx          *database.SignedTx `json:"tx,omitempty"`
+	Value       uint               `json:"value"`
+	BlockHash   database.Hash      `json:"block_hash,omitempty"`
+	BlockNumber uint64             `json:"block_number"`
+	Index       int                `json:"index"`
+	Time        uint64             `json:"time"`
+}
+
+// HistoryRes lists the mined entries newest first, by block height and index, the pending TXs come with the first page only.
+type HistoryRes struct {
+	Pending    []HistoryEntry `json:"pending"`
+	Entries    []HistoryEntry `json:"transactions"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+	PrevCursor string         `json:"prev_cursor,omitempty"`
+}
+
+// historyCursor is the position the next page starts from, exclusive: the older entries, or the newer ones.
+type historyCursor struct {
+	BlockNumber uint64 `json:"b"`
+	Index       int    `json:"i"`
+	Older       bool   `json:"o"`
+}
+
+func (c historyCursor) encode() string {
+	cursorJson, _ := json.Marshal(c)
+
+	return base64.RawURLEncoding.EncodeToString(cursorJson)
+}
+
+func decodeHistoryCursor(value string) (historyCursor, error) {
+	cursor := historyCursor{}
+
+	cursorJson, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return cursor, fmt.Errorf("invalid cursor '%s'", value)
+	}
+
+	err = json.Unmarshal(cursorJson, &cursor)
+	if err != nil {
+		return cursor, fmt.Errorf("invalid cursor '%s'", value)
+	}
+
+	return cursor, nil
+}
+
+func isBefore(a, b database.AccountEntry) bool {
+	return a.BlockNumber < b.BlockNumber || (a.BlockNumber == b.BlockNumber && a.Index < b.Index)
+}
+
+// AddressHistory returns a page of the TXs sent and received by the account and of its block rewards,
+// starting from the cursor or from the latest entries if empty.
+func (n *Node) AddressHistory(account common.Address, cursor string, limit int) (HistoryRes, error) {
+	if limit <= 0 {
+		limit = defaultHistoryLimit
+	}
+
+	if limit > maxHistoryLimit {
+		limit = maxHistoryLimit
+	}
+
+	entries := n.state.AccountEntries(account)
+
+	// The page is entries[from:to], oldest first
+	from, to := len(entries)-limit, len(entries)
+	res := HistoryRes{Pending: make([]HistoryEntry, 0), Entries: make([]HistoryEntry, 0)}
+
+	if cursor == "" {
+		res.Pending = n.pendingHistory(account)
+	} else {
+		c, err := decodeHistoryCursor(cursor)
+		if err != nil {
+			return HistoryRes{}, err
+		}
+
+		at := database.AccountEntry{BlockNumber: c.BlockNumber, Index: c.Index}
+
+		if c.Older {
+			to = sort.Search(len(entries), func(i int) bool { return !isBefore(entries[i], at) })
+			from = to - limit
+		} else {
+			from = sort.Search(len(entries), func(i int) bool { return isBefore(at, entries[i]) })
+			to = from + limit
+			if to > len(entries) {
+				to = len(entries)
+			}
+
+			// Nothing newer yet, the same cursor is the one to poll
+			if from == to {
+				res.PrevCursor = cursor
+			}
+		}
+	}
+
+	if from < 0 {
+		from = 0
+	}
+
+	blocks := make(map[uint64]database.BlockFS)
+
+	for i := to - 1; i >= from; i-- {
+		entry, err := n.historyEntry(account, entries[i], blocks)
+		if err != nil {
+			return HistoryRes{}, err
+		}
+
+		res.Entries = append(res.Entries, entry)
+	}
+
+	if from < to {
+		newest, oldest := entries[to-1], entries[from]
+
+		res.PrevCursor = historyCursor{newest.BlockNumber, newest.Index, false}.encode()
+
+		if from > 0 {
+			res.NextCursor = historyCursor{oldest.BlockNumber, oldest.Index, true}.encode()
+		}
+	}
+
+	return res, nil
+}
+
+func (n *Node) historyEntry(account common.Address, entry database.AccountEntry, blocks map[uint64]database.BlockFS) (HistoryEntry, error) {
+	blockFs, ok := blocks[entry.BlockNumber]
+	if !ok {
+		var found bool
+		var err error
+
+		blockFs, found, err = n.state.GetBlockByNumber(entry.BlockNumber)
+		if err != nil {
+			return HistoryEntry{}, err
+		}
+
+		if !found {
+			return HistoryEntry{}, fmt.Errorf("block '%d' not found, the chain was rewound", entry.BlockNumber)
+		}
+
+		blocks[entry.BlockNumber] = blockFs
+	}
+
+	return newHistoryEntry(account, blockFs, entry)
+}
+
+// newHistoryEntry is the TX of the block at the entry's index, or the block reward.
+func newHistoryEntry(account common.Address, blockFs database.BlockFS, entry database.AccountEntry) (HistoryEntry, error) {
+	res := HistoryEntry{
+		Status:      TxStatusMined,
+		BlockHash:   blockFs.Key,
+		BlockNumber: entry.BlockNumber,
+		Index:       entry.Index,
+		Time:        blockFs.Value.Header.Time,
+	}
+
+	if entry.Reward {
+		res.Direction = DirectionReward
+		res.Value = database.BlockReward + blockFs.Value.Fees()
+
+		return res, nil
+	}
+
+	if entry.Index >= len(blockFs.Value.TXs) {
+		return HistoryEntry{}, fmt.Errorf("block '%d' has no TX %d", entry.BlockNumber, entry.Index)
+	}
+
+	tx := blockFs.Value.TXs[entry.Index]
+
+	hash, err := tx.Hash()
+	if err != nil {
+		return HistoryEntry{}, err
+	}
+
+	res.Direction = txDirection(account, tx)
+	res.Hash = hash
+	res.Tx = &tx
+	res.Value = tx.Value
+
+	return res, nil
+}
+
+// blockActivity lists the TXs of the block sent or received by the account and its reward, in the block order.
+func blockActivity(account common.Address, blockFs database.BlockFS) []HistoryEntry {
+	res := make([]HistoryEntry, 0)
+	number := blockFs.Value.Header.Number
+
+	for index, tx := range blockFs.Value.TXs {
+		if tx.From != account && tx.To != account {
+			continue
+		}
+
+		entry, err := newHistoryEntry(account, blockFs, database.AccountEntry{BlockNumber: number, Index: index})
+		if err != nil {
+			continue
+		}
+
+		res = append(res, entry)
+	}
+
+	if blockFs.Value.Header.Miner == account {
+		reward := database.AccountEntry{BlockNumber: number, Index: len(blockFs.Value.TXs), Reward: true}
+		entry, _ := newHistoryEntry(account, blockFs, reward)
+
+		res = append(res, entry)
+	}
+
+	return res
+}
+
+func newPendingHistoryEntry(account common.Address, hash database.Hash, tx database.SignedTx) HistoryEntry {
+	return HistoryEntry{
+		Direction: txDirection(account, tx),
+		Status:    TxStatusPending,
+		Hash:      hash,
+		Tx:        &tx,
+		Value:     tx.Value,
+		Time:      tx.Time,
+	}
+}
+
+// pendingHistory lists the TXs of the mempool sent or received by the account, the newest first.
+func (n *Node) pendingHistory(account common.Address) []HistoryEntry {
+	res := make([]HistoryEntry, 0)
+
+	for _, entry := range n.mempool.Filter(mempool.Filter{}) {
+		if entry.Tx.From != account && entry.Tx.To != account {
+			continue
+		}
+
+		res = append(res, newPendingHistoryEntry(account, entry.Hash, entry.Tx))
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Time != res[j].Time {
+			return res[i].Time > res[j].Time
+		}
+
+		return res[i].Tx.Nonce > res[j].Tx.Nonce
+	})
+
+	return res
+}
+
+func txDirection(account common.Address, tx database.SignedTx) string {
+	switch {
+	case tx.From == account && tx.To == account:
+		return DirectionSelf
+	case tx.From == account:
+		return DirectionOut
+	default:
+		return DirectionIn
+	}
+}
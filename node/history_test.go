@@ -0,0 +1,170 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package node
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/IacopoMelani/the-blockchain-pub/database"
+	"github.com/IacopoMelani/the-blockchain-pub/fs"
+	"github.com/IacopoMelani/the-blockchain-pub/wallet"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestNode_AddressHistory(t *testing.T) {
+	n, dataDir := newTestNode(t, common.Address{})
+	defer fs.RemoveDir(dataDir)
+	defer n.state.Close()
+
+	txs := addTestPendingTXs(t, n, 1, 2, 3)
+	mineTestBlocks(t, n, common.Address{}, 1)
+
+	sender := txs[0].From
+
+	first, err := n.AddressHistory(sender, "", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		direction string
+		block     uint64
+		index     int
+	}{
+		{DirectionOut, 3, 2},
+		{DirectionOut, 3, 1},
+		{DirectionOut, 3, 0},
+		{DirectionReward, 2, 0},
+		{DirectionReward, 1, 0},
+		{DirectionReward, 0, 0},
+	}
+
+	second, err := n.AddressHistory(sender, first.NextCursor, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := append(first.Entries, second.Entries...)
+	if len(first.Entries) != 4 || len(entries) != len(expected) || second.NextCursor != "" {
+		t.Fatalf("expected 6 entries in 2 pages, got %d and %d", len(first.Entries), len(second.Entries))
+	}
+
+	for i, e := range expected {
+		if entries[i].Direction != e.direction || entries[i].BlockNumber != e.block || entries[i].Index != e.index {
+			t.Fatalf("expected entry %d to be %+v, got %+v", i, e, entries[i])
+		}
+	}
+
+	if entries[3].Value != database.BlockReward || entries[0].Hash.IsEmpty() || entries[0].Tx == nil {
+		t.Fatalf("expected the rewards and the TXs to be described, got %+v and %+v", entries[3], entries[0])
+	}
+
+	// Back from the second page to the newer entries
+	newer, err := n.AddressHistory(sender, second.PrevCursor, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(newer.Entries) != 4 || newer.Entries[0].Index != 2 || newer.Entries[3].BlockNumber != 2 {
+		t.Fatalf("expected the 4 entries newer than Block 1, got %+v", newer.Entries)
+	}
+
+	// Nothing newer than the first page yet
+	latest, err := n.AddressHistory(sender, first.PrevCursor, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(latest.Entries) != 0 || latest.PrevCursor != first.PrevCursor {
+		t.Fatalf("expected no newer entries and the same cursor to poll, got %+v", latest)
+	}
+
+	// The recipient gets the TXs pending and mined, and the reward of the block mining them
+	addTestPendingTXs(t, n, 1)
+
+	recipient, err := n.AddressHistory(common.Address{}, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(recipient.Pending) != 1 || recipient.Pending[0].Direction != DirectionIn || recipient.Pending[0].Status != TxStatusPending {
+		t.Fatalf("expected 1 pending TX received, got %+v", recipient.Pending)
+	}
+
+	if len(recipient.Entries) != 4 || recipient.Entries[0].Direction != DirectionReward || recipient.Entries[1].Direction != DirectionIn {
+		t.Fatalf("expected the reward and the 3 TXs received, got %+v", recipient.Entries)
+	}
+
+	if recipient.Entries[0].Value != database.BlockReward+3*database.TxFee {
+		t.Fatalf("expected the reward to include the fees, got %d", recipient.Entries[0].Value)
+	}
+
+	_, err = n.AddressHistory(sender, "not a cursor", 0)
+	if err == nil {
+		t.Fatal("expected an invalid cursor to be rejected")
+	}
+}
+
+func TestNode_AddressHistoryGenesisBlock(t *testing.T) {
+	key, _, sender, err := generateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, dataDir := newTestNodeWithBalances(t, common.Address{}, map[common.Address]uint{sender: 1000})
+	defer fs.RemoveDir(dataDir)
+	defer n.state.Close()
+
+	tx, err := wallet.SignTx(database.NewTx(sender, common.Address{}, 1, 1, ""), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = n.AddPendingTX(tx, n.info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The TX is mined in Block 0
+	mineTestBlocks(t, n, common.Address{}, 1)
+
+	res, err := n.AddressHistory(sender, "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resJson, err := json.Marshal(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw := struct {
+		Entries []map[string]interface{} `json:"transactions"`
+	}{}
+	err = json.Unmarshal(resJson, &raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(raw.Entries) != 1 || raw.Entries[0]["direction"] != DirectionOut {
+		t.Fatalf("expected the TX sent in Block 0, got %+v", raw.Entries)
+	}
+
+	if number, ok := raw.Entries[0]["block_number"]; !ok || number != float64(0) {
+		t.Fatalf("expected the TX to report its Block 0, got %+v", raw.Entries[0])
+	}
+}
@@ -16,6 +16,7 @@
 package node
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -55,3 +56,18 @@ func readRes(r *http.Response, reqBody interface{}) error {
 
 	return nil
 }
+
+// postJson sends the request body as JSON to the url and reads the JSON response into resBody.
+func postJson(url string, reqBody interface{}, resBody interface{}) error {
+	reqBodyJson, err := json.Marshal(reqBody)
+	if err != nil {
+		return fmt.Errorf("unable to marshal request body. %s", err.Error())
+	}
+
+	res, err := http.Post(url, "application/json", bytes.NewReader(reqBodyJson))
+	if err != nil {
+		return err
+	}
+
+	return readRes(res, resBody)
+}
@@ -16,11 +16,18 @@
 package node
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"strconv"
+	"time"
 
+	"github.com/IacopoMelani/the-blockchain-pub/consensus/poa"
 	"github.com/IacopoMelani/the-blockchain-pub/database"
+	"github.com/IacopoMelani/the-blockchain-pub/mempool"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/rlp"
@@ -61,12 +68,15 @@ type TxAddRes struct {
 }
 
 type StatusRes struct {
-	Hash        database.Hash       `json:"block_hash"`
-	Number      uint64              `json:"block_number"`
-	KnownPeers  map[string]PeerNode `json:"peers_known"`
-	PendingTXs  []database.SignedTx `json:"pending_txs"`
-	NodeVersion string              `json:"node_version"`
-	Account     common.Address      `json:"account"`
+	NodeID     string              `json:"node_id"`
+	Hash       database.Hash       `json:"block_hash"`
+	Number     uint64              `json:"block_number"`
+	KnownPeers map[string]PeerNode `json:"peers_known"`
+	// The pending TXs are listed by the mempool endpoints, the digest tells whether they changed
+	PendingCount  int            `json:"pending_count"`
+	PendingDigest database.Hash  `json:"pending_digest"`
+	NodeVersion   string         `json:"node_version"`
+	Account       common.Address `json:"account"`
 }
 
 type SyncRes struct {
@@ -74,18 +84,25 @@ type SyncRes struct {
 }
 
 type AddPeerRes struct {
-	Success bool   `json:"success"`
-	Error   string `json:"error"`
+	Success   bool      `json:"success"`
+	Error     string    `json:"error"`
+	Handshake Handshake `json:"handshake"`
 }
 
-const TxTypeIn = "in"
-const TxTypeOut = "out"
-const TxTypePending = "pending"
+type PoASignersRes struct {
+	Signers   []common.Address        `json:"signers"`
+	Proposals map[common.Address]bool `json:"proposals"`
+}
+
+type PoAProposeReq struct {
+	Address   string `json:"address"`
+	Authorize bool   `json:"authorize"`
+}
 
 type TransactionsReq struct {
 	Account string `json:"account"`
-	TxType  string `json:"type"`
-	Last    int    `json:"last"`
+	Cursor  string `json:"cursor"`
+	Limit   int    `json:"limit"`
 }
 
 func transactionsHandler(c echo.Context, node *Node) error {
@@ -100,37 +117,12 @@ func transactionsHandler(c echo.Context, node *Node) error {
 		return c.JSON(http.StatusBadRequest, ErrRes{"account is required"})
 	}
 
-	if req.TxType == "" {
-		req.TxType = TxTypeIn
-	}
-
-	txs := make([]database.SignedTxExtended, 0)
-
-	switch req.TxType {
-	case TxTypeIn:
-		txs, err = node.GetTxsByAccountAndType(database.NewAccount(req.Account), TxTypeIn, req.Last)
-		if err != nil {
-			return c.JSON(http.StatusInternalServerError, ErrRes{err.Error()})
-		}
-	case TxTypeOut:
-		txs, err = node.GetTxsByAccountAndType(database.NewAccount(req.Account), TxTypeOut, req.Last)
-		if err != nil {
-			return c.JSON(http.StatusInternalServerError, ErrRes{err.Error()})
-		}
-	case TxTypePending:
-		txs, err = node.GetPendingTXsExtendedAsArrayByAccount(database.NewAccount(req.Account))
-		if err != nil {
-			return c.JSON(http.StatusInternalServerError, ErrRes{err.Error()})
-		}
+	res, err := node.AddressHistory(database.NewAccount(req.Account), req.Cursor, req.Limit)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrRes{err.Error()})
 	}
 
-	sortedTxs := database.SignedTxsExtended(txs)
-
-	sortedTxs.Sort()
-
-	return c.JSON(http.StatusOK, map[string]interface{}{
-		"transactions": sortedTxs,
-	})
+	return c.JSON(http.StatusOK, res)
 }
 
 func addressBalanceHandler(c echo.Context, node *Node) error {
@@ -186,20 +178,13 @@ func nextNonceHandler(c echo.Context, node *Node) error {
 		return c.JSON(http.StatusBadRequest, ErrRes{err.Error()})
 	}
 
-	nonce := node.pendingState.GetNextAccountNonce(database.NewAccount(req.Account))
+	nonce := node.mempool.PendingNonce(database.NewAccount(req.Account))
 
 	return c.JSON(http.StatusOK, NextNonceRes{Nonce: nonce})
 }
 
 func statusHandler(c echo.Context, node *Node) error {
-	return c.JSON(http.StatusOK, StatusRes{
-		Hash:        node.state.LatestBlockHash(),
-		Number:      node.state.LatestBlock().Header.Number,
-		KnownPeers:  node.knownPeers,
-		PendingTXs:  node.getPendingTXsAsArray(),
-		NodeVersion: node.nodeVersion,
-		Account:     database.NewAccount(node.info.Account.String()),
-	})
+	return node.signedJSON(c.Response(), http.StatusOK, node.status())
 }
 
 func syncHandler(c echo.Context, node *Node) error {
@@ -214,6 +199,10 @@ func syncHandler(c echo.Context, node *Node) error {
 		last = 10
 	}
 
+	if last <= 0 || last > int64(maxBlocksPerRequest) {
+		last = int64(maxBlocksPerRequest)
+	}
+
 	if reqMode == "" || (reqMode != endpointSyncQueryKeyModeAfter && reqMode != endpointSyncQueryKeyModeBefore) {
 		reqMode = endpointSyncQueryKeyModeBefore
 	}
@@ -242,25 +231,458 @@ func syncHandler(c echo.Context, node *Node) error {
 	return c.JSON(http.StatusOK, map[string][]database.BlockFS{"blocks": blocks})
 }
 
-func addPeerHandler(c echo.Context, node *Node) error {
+func headersHandler(c echo.Context, node *Node) error {
+	last, err := strconv.ParseInt(c.QueryParam(endpointSyncQueryKeyLast), 10, 64)
+	if err != nil || last <= 0 || last > maxHeadersPerRequest {
+		last = maxHeadersPerRequest
+	}
 
-	r := c.Request()
+	hash := database.Hash{}
+	err = hash.UnmarshalText([]byte(c.QueryParam(endpointSyncQueryKeyFromBlock)))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrRes{err.Error()})
+	}
+
+	headers, err := database.GetHeadersAfter(hash, last, node.dataDir)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, ErrRes{err.Error()})
+	}
 
-	peerIP := r.URL.Query().Get(endpointAddPeerQueryKeyIP)
-	peerPortRaw := r.URL.Query().Get(endpointAddPeerQueryKeyPort)
-	minerRaw := r.URL.Query().Get(endpointAddPeerQueryKeyMiner)
-	versionRaw := r.URL.Query().Get(endpointAddPeerQueryKeyVersion)
+	return c.JSON(http.StatusOK, HeadersRes{Headers: headers})
+}
 
-	peerPort, err := strconv.ParseUint(peerPortRaw, 10, 32)
+func blockHashHandler(c echo.Context, node *Node) error {
+	number, err := strconv.ParseUint(c.QueryParam(endpointBlockHashQueryKeyNumber), 10, 64)
 	if err != nil {
 		return c.JSON(http.StatusBadRequest, ErrRes{err.Error()})
 	}
 
-	peer := NewPeerNode(peerIP, peerPort, false, database.NewAccount(minerRaw), true, versionRaw)
+	hash, ok := node.state.BlockHash(number)
+	if !ok {
+		return c.JSON(http.StatusNotFound, ErrRes{fmt.Sprintf("block '%d' not found", number)})
+	}
+
+	return c.JSON(http.StatusOK, BlockHashRes{Number: number, Hash: hash})
+}
+
+func syncProgressHandler(c echo.Context, node *Node) error {
+	return c.JSON(http.StatusOK, node.SyncProgress())
+}
+
+func addPeerHandler(c echo.Context, node *Node) error {
+	body, err := ioutil.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, AddPeerRes{Error: err.Error()})
+	}
+
+	err = node.checkNetworkAuth(body, c.Request().Header.Get(headerNetworkAuth))
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, AddPeerRes{Error: err.Error()})
+	}
+
+	handshake := Handshake{}
+	err = json.Unmarshal(body, &handshake)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, AddPeerRes{Error: err.Error()})
+	}
+
+	err = node.checkHandshake(handshake)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, AddPeerRes{Error: err.Error()})
+	}
+
+	signer, err := recoverPayloadSigner(body, c.Request().Header.Get(headerSignature))
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, AddPeerRes{Error: err.Error()})
+	}
+
+	if signer != handshake.Peer.ID {
+		return c.JSON(http.StatusUnauthorized, AddPeerRes{Error: fmt.Sprintf("handshake is not signed by node %s", handshake.Peer.ID)})
+	}
+
+	peer := NewPeerNode(handshake.Peer.IP, handshake.Peer.Port, false, handshake.Peer.Account, true, handshake.Peer.NodeVersion)
+	peer.ID = signer
+	peer.P2PPort = handshake.Peer.P2PPort
+
+	if node.peerBook.isBanned(peer, time.Now()) {
+		return c.JSON(http.StatusForbidden, AddPeerRes{Error: fmt.Sprintf("peer '%s' is banned", peer.TcpAddress())})
+	}
+
+	err = node.acceptInboundPeer(peer)
+	if err != nil {
+		return c.JSON(http.StatusServiceUnavailable, AddPeerRes{Error: err.Error()})
+	}
 
 	node.AddPeer(peer)
 
 	fmt.Printf("Peer '%s' was added into KnownPeers\n", peer.TcpAddress())
 
-	return c.JSON(http.StatusOK, AddPeerRes{true, ""})
+	return node.signedJSON(c.Response(), http.StatusOK, AddPeerRes{Success: true, Handshake: node.handshake()})
+}
+
+func announceBlockHandler(c echo.Context, node *Node) error {
+	req := AnnounceBlockReq{}
+	err := readReq(c.Request(), &req)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrRes{err.Error()})
+	}
+
+	// Marked as seen once imported, a forged announce can't shadow the real block
+	if node.isSeen(req.Hash) || req.Number <= node.state.LatestBlock().Header.Number {
+		return c.JSON(http.StatusOK, AnnounceRes{Known: true})
+	}
+
+	peer, err := node.announcer(c.Request(), req.From)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrRes{err.Error()})
+	}
+
+	if !node.queueAnnounce(func() { node.handleBlockAnnounce(peer, req) }) {
+		return c.JSON(http.StatusServiceUnavailable, ErrRes{"too many announces waiting, try again later"})
+	}
+
+	return c.JSON(http.StatusOK, AnnounceRes{Known: false})
+}
+
+func announceTxHandler(c echo.Context, node *Node) error {
+	req := AnnounceTxReq{}
+	err := readReq(c.Request(), &req)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrRes{err.Error()})
+	}
+
+	if node.isSeen(req.Hash) || node.isPendingTX(req.Hash) {
+		return c.JSON(http.StatusOK, AnnounceRes{Known: true})
+	}
+
+	peer, err := node.announcer(c.Request(), req.From)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrRes{err.Error()})
+	}
+
+	if !node.queueAnnounce(func() { node.handleTxAnnounce(peer, req) }) {
+		return c.JSON(http.StatusServiceUnavailable, ErrRes{"too many announces waiting, try again later"})
+	}
+
+	return c.JSON(http.StatusOK, AnnounceRes{Known: false})
+}
+
+func pendingTxHandler(c echo.Context, node *Node) error {
+	hash := database.Hash{}
+	err := hash.UnmarshalText([]byte(c.QueryParam(endpointPendingTxQueryKeyHash)))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrRes{err.Error()})
+	}
+
+	tx, ok := node.getPendingTX(hash)
+	if !ok {
+		return c.JSON(http.StatusNotFound, ErrRes{fmt.Sprintf("pending TX '%s' not found", hash.Hex())})
+	}
+
+	return c.JSON(http.StatusOK, PendingTxRes{Tx: tx})
+}
+
+func blockHandler(c echo.Context, node *Node) error {
+	withTXs, _ := strconv.ParseBool(c.QueryParam(endpointBlockQueryKeyTxs))
+
+	res, found, err := node.lookupBlock(c.Param("id"), withTXs)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrRes{err.Error()})
+	}
+
+	if !found {
+		return c.JSON(http.StatusNotFound, ErrRes{fmt.Sprintf("block '%s' not found", c.Param("id"))})
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+func txHandler(c echo.Context, node *Node) error {
+	hash := database.Hash{}
+	err := hash.UnmarshalText([]byte(c.Param("hash")))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrRes{err.Error()})
+	}
+
+	res, err := node.lookupTx(hash)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, ErrRes{err.Error()})
+	}
+
+	if res.Status == TxStatusUnknown {
+		return c.JSON(http.StatusNotFound, res)
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+func txReceiptHandler(c echo.Context, node *Node) error {
+	hash := database.Hash{}
+	err := hash.UnmarshalText([]byte(c.Param("hash")))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrRes{err.Error()})
+	}
+
+	receipt, found, err := node.state.GetReceipt(hash)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, ErrRes{err.Error()})
+	}
+
+	if !found {
+		return c.JSON(http.StatusNotFound, ErrRes{fmt.Sprintf("no receipt for TX '%s', it isn't mined", hash.Hex())})
+	}
+
+	return c.JSON(http.StatusOK, receipt)
+}
+
+// txWaitHandler long polls until the TX is mined with the confirmations, dropped or the timeout expires.
+func txWaitHandler(c echo.Context, node *Node) error {
+	hash := database.Hash{}
+	err := hash.UnmarshalText([]byte(c.Param("hash")))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrRes{err.Error()})
+	}
+
+	confirmations := uint64(1)
+	if value := c.QueryParam(endpointTxWaitQueryKeyConfirmations); value != "" {
+		confirmations, err = strconv.ParseUint(value, 10, 64)
+		if err != nil || confirmations == 0 {
+			return c.JSON(http.StatusBadRequest, ErrRes{fmt.Sprintf("invalid confirmations '%s'", value)})
+		}
+	}
+
+	timeout, err := parseTxWaitTimeout(c.QueryParam(endpointTxWaitQueryKeyTimeout))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrRes{err.Error()})
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request().Context(), timeout)
+	defer cancel()
+
+	res, err := node.WaitTx(ctx, hash, confirmations)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return c.JSON(http.StatusRequestTimeout, res)
+	case errors.Is(err, context.Canceled):
+		return c.JSON(http.StatusServiceUnavailable, ErrRes{"node is shutting down"})
+	case err != nil:
+		return c.JSON(http.StatusInternalServerError, ErrRes{err.Error()})
+	case res.Status == TxStatusUnknown:
+		return c.JSON(http.StatusNotFound, res)
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+func mempoolHandler(c echo.Context, node *Node) error {
+	stats := node.mempool.Stats()
+
+	return c.JSON(http.StatusOK, MempoolRes{
+		Pending:     stats.Pending,
+		Queued:      stats.Queued,
+		Senders:     stats.Senders,
+		PendingSize: stats.PendingSize,
+		QueuedSize:  stats.QueuedSize,
+		Digest:      stats.Digest,
+	})
+}
+
+func mempoolTxsHandler(c echo.Context, node *Node) error {
+	filter := mempool.Filter{
+		From:   database.NewAccount(c.QueryParam(endpointMempoolTxsQueryKeyFrom)),
+		To:     database.NewAccount(c.QueryParam(endpointMempoolTxsQueryKeyTo)),
+		Status: c.QueryParam(endpointMempoolTxsQueryKeyStatus),
+	}
+
+	if filter.Status != "" && filter.Status != mempool.StatusPending && filter.Status != mempool.StatusQueued {
+		return c.JSON(http.StatusBadRequest, ErrRes{fmt.Sprintf("status must be '%s' or '%s'", mempool.StatusPending, mempool.StatusQueued)})
+	}
+
+	for _, key := range []string{endpointMempoolTxsQueryKeyFrom, endpointMempoolTxsQueryKeyTo} {
+		if address := c.QueryParam(key); address != "" && !common.IsHexAddress(address) {
+			return c.JSON(http.StatusBadRequest, ErrRes{fmt.Sprintf("invalid %s address", key)})
+		}
+	}
+
+	uintParams := []struct {
+		key   string
+		value *uint
+	}{
+		{endpointMempoolTxsQueryKeyMinFee, &filter.MinFee},
+		{endpointMempoolTxsQueryKeyMinNonce, &filter.MinNonce},
+		{endpointMempoolTxsQueryKeyMaxNonce, &filter.MaxNonce},
+	}
+
+	for _, param := range uintParams {
+		if c.QueryParam(param.key) == "" {
+			continue
+		}
+
+		value, err := strconv.ParseUint(c.QueryParam(param.key), 10, 64)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, ErrRes{fmt.Sprintf("invalid %s. %s", param.key, err.Error())})
+		}
+		*param.value = uint(value)
+	}
+
+	offset, err := strconv.Atoi(c.QueryParam(endpointMempoolTxsQueryKeyOffset))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+
+	limit, err := strconv.Atoi(c.QueryParam(endpointMempoolTxsQueryKeyLimit))
+	if err != nil || limit <= 0 || limit > maxMempoolTxsPerRequest {
+		limit = maxMempoolTxsPerRequest
+	}
+
+	return c.JSON(http.StatusOK, node.mempoolTxs(filter, offset, limit))
+}
+
+func mempoolTxHandler(c echo.Context, node *Node) error {
+	hash := database.Hash{}
+	err := hash.UnmarshalText([]byte(c.Param("hash")))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrRes{err.Error()})
+	}
+
+	entry, ok := node.mempool.Entry(hash)
+	if !ok {
+		return c.JSON(http.StatusNotFound, ErrRes{fmt.Sprintf("TX '%s' not found in the mempool", hash.Hex())})
+	}
+
+	return c.JSON(http.StatusOK, newMempoolTxRes(entry))
+}
+
+// subscriptionsHandler upgrades the connection to a WebSocket pushing the subscribed events, see WsReq.
+func subscriptionsHandler(c echo.Context, node *Node) error {
+	conn, err := node.wsUpgrader().Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		// The upgrader already replied with the error
+		return nil
+	}
+
+	node.serveSubscriptions(c.Request().Context(), conn)
+
+	return nil
+}
+
+func poaSignersHandler(c echo.Context, node *Node) error {
+	engine, ok := node.engine.(*poa.PoA)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, ErrRes{"the node is not running a Proof of Authority network"})
+	}
+
+	snap, err := engine.Snapshot(node.state)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, ErrRes{err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, PoASignersRes{snap.SignersList(), engine.Proposals()})
+}
+
+func poaProposeHandler(c echo.Context, node *Node) error {
+	engine, ok := node.engine.(*poa.PoA)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, ErrRes{"the node is not running a Proof of Authority network"})
+	}
+
+	req := PoAProposeReq{}
+	err := readReq(c.Request(), &req)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrRes{err.Error()})
+	}
+
+	if !common.IsHexAddress(req.Address) {
+		return c.JSON(http.StatusBadRequest, ErrRes{"invalid address"})
+	}
+
+	engine.Propose(database.NewAccount(req.Address), req.Authorize)
+
+	return c.JSON(http.StatusOK, PoASignersRes{Proposals: engine.Proposals()})
+}
+
+func poaDiscardHandler(c echo.Context, node *Node) error {
+	engine, ok := node.engine.(*poa.PoA)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, ErrRes{"the node is not running a Proof of Authority network"})
+	}
+
+	req := PoAProposeReq{}
+	err := readReq(c.Request(), &req)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrRes{err.Error()})
+	}
+
+	engine.Discard(database.NewAccount(req.Address))
+
+	return c.JSON(http.StatusOK, PoASignersRes{Proposals: engine.Proposals()})
+}
+
+func miningWorkHandler(c echo.Context, node *Node) error {
+	miner := node.info.Account
+
+	if minerRaw := c.Request().URL.Query().Get(endpointMiningWorkQueryKeyMiner); minerRaw != "" {
+		if !common.IsHexAddress(minerRaw) {
+			return c.JSON(http.StatusBadRequest, ErrRes{"invalid miner address"})
+		}
+
+		miner = database.NewAccount(minerRaw)
+	}
+
+	work, err := node.GetWork(miner)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrRes{err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, work)
+}
+
+func miningSubmitHandler(c echo.Context, node *Node) error {
+	req := MiningSubmitReq{}
+	err := readReq(c.Request(), &req)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrRes{err.Error()})
+	}
+
+	hash, err := node.SubmitWork(req)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrRes{err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, MiningSubmitRes{hash})
+}
+
+func miningStatsHandler(c echo.Context, node *Node) error {
+	return c.JSON(http.StatusOK, node.MiningStats())
+}
+
+func miningStartHandler(c echo.Context, node *Node) error {
+	err := node.StartMining()
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrRes{err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, node.MiningStats())
+}
+
+func miningStopHandler(c echo.Context, node *Node) error {
+	node.StopMining()
+
+	return c.JSON(http.StatusOK, node.MiningStats())
+}
+
+func miningMinerHandler(c echo.Context, node *Node) error {
+	req := MiningMinerReq{}
+	err := readReq(c.Request(), &req)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrRes{err.Error()})
+	}
+
+	if !common.IsHexAddress(req.Account) {
+		return c.JSON(http.StatusBadRequest, ErrRes{"invalid miner account"})
+	}
+
+	node.SetMiner(database.NewAccount(req.Account))
+
+	return c.JSON(http.StatusOK, node.MiningStats())
 }
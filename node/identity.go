@@ -0,0 +1,152 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package node
+
+import (
+	"crypto/ecdsa"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/IacopoMelani/the-blockchain-pub/p2p"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const nodeKeyFile = "nodekey"
+
+// Carries the node's signature of the HTTP body, hex encoded
+const headerSignature = "X-Tbb-Signature"
+
+// NodeID is the hex encoded compressed public identity key of a node.
+func NodeID(pub *ecdsa.PublicKey) string {
+	return p2p.ID(pub)
+}
+
+// loadNodeKey reads the node's identity key from the data dir, generating it on the first run.
+func loadNodeKey(dataDir string) (*ecdsa.PrivateKey, error) {
+	path := filepath.Join(dataDir, nodeKeyFile)
+
+	key, err := crypto.LoadECDSA(path)
+	if err == nil {
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("unable to load the node key '%s'. %s", path, err.Error())
+	}
+
+	key, err = crypto.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	err = crypto.SaveECDSA(path, key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to save the node key '%s'. %s", path, err.Error())
+	}
+
+	return key, nil
+}
+
+// loadIdentity sets the node ID from the identity key of the data dir.
+func (n *Node) loadIdentity() error {
+	key, err := loadNodeKey(n.dataDir)
+	if err != nil {
+		return err
+	}
+
+	n.nodeKey = key
+	n.info.ID = NodeID(&key.PublicKey)
+
+	return nil
+}
+
+func (n *Node) signPayload(payload []byte) (string, error) {
+	sig, err := crypto.Sign(crypto.Keccak256(payload), n.nodeKey)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(sig), nil
+}
+
+// recoverPayloadSigner returns the ID of the node which signed the payload.
+func recoverPayloadSigner(payload []byte, sigHex string) (string, error) {
+	if sigHex == "" {
+		return "", fmt.Errorf("missing node signature")
+	}
+
+	sig, err := hex.DecodeString(sigHex)
+	if err != nil {
+		return "", fmt.Errorf("invalid node signature. %s", err.Error())
+	}
+
+	pub, err := crypto.SigToPub(crypto.Keccak256(payload), sig)
+	if err != nil {
+		return "", fmt.Errorf("invalid node signature. %s", err.Error())
+	}
+
+	return NodeID(pub), nil
+}
+
+// signedJSON responds with the JSON body signed by the node's identity key.
+func (n *Node) signedJSON(w http.ResponseWriter, status int, resBody interface{}) error {
+	body, err := json.Marshal(resBody)
+	if err != nil {
+		return err
+	}
+
+	sig, err := n.signPayload(body)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set(headerSignature, sig)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	_, err = w.Write(body)
+
+	return err
+}
+
+// readSignedRes reads the JSON response into resBody and returns the ID of the node which signed it.
+func readSignedRes(r *http.Response, resBody interface{}) (string, error) {
+	resBodyJson, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return "", fmt.Errorf("unable to read response body. %s", err.Error())
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unable to process response. %s", string(resBodyJson))
+	}
+
+	signer, err := recoverPayloadSigner(resBodyJson, r.Header.Get(headerSignature))
+	if err != nil {
+		return "", err
+	}
+
+	err = json.Unmarshal(resBodyJson, resBody)
+	if err != nil {
+		return "", fmt.Errorf("unable to unmarshal response body. %s", err.Error())
+	}
+
+	return signer, nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package node
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/labstack/echo/v4"
+)
+
+func TestNode_IdentityIsPersistent(t *testing.T) {
+	n, dataDir := newTestNode(t, common.Address{})
+	defer os.RemoveAll(dataDir)
+
+	id := n.info.ID
+
+	err := n.loadIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n.info.ID != id {
+		t.Fatal("the node ID is suppose to survive a restart")
+	}
+}
+
+func TestNode_SignedStatus(t *testing.T) {
+	n, dataDir := newTestNode(t, common.Address{})
+	defer os.RemoveAll(dataDir)
+
+	e := echo.New()
+	e.GET(endpointStatus, func(c echo.Context) error {
+		return statusHandler(c, n)
+	})
+
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	serverUrl, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port, err := strconv.ParseUint(serverUrl.Port(), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer := NewPeerNode(serverUrl.Hostname(), port, false, common.Address{}, false, nodeVersion)
+
+	status, err := queryPeerStatus(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status.NodeID != n.info.ID {
+		t.Fatalf("expected status of node %s, got %s", n.info.ID, status.NodeID)
+	}
+
+	otherKey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer.ID = NodeID(&otherKey.PublicKey)
+	_, err = queryPeerStatus(peer)
+	if err == nil {
+		t.Fatal("a status signed by another node is not suppose to be accepted")
+	}
+
+	res, err := http.Get(server.URL + endpointStatus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Header.Del(headerSignature)
+
+	_, err = readSignedRes(res, &StatusRes{})
+	if err == nil {
+		t.Fatal("an unsigned status is not suppose to be accepted")
+	}
+}
@@ -0,0 +1,290 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+
+	"github.com/IacopoMelani/the-blockchain-pub/consensus"
+	"github.com/IacopoMelani/the-blockchain-pub/database"
+)
+
+// DefaultStopTimeout bounds the graceful shutdown once the context of Run is done.
+const DefaultStopTimeout = 30 * time.Second
+
+var ErrNodeNotRunning = errors.New("node isn't running")
+
+// Run starts the node and stops it gracefully once the context is done or the HTTP API fails.
+func (n *Node) Run(ctx context.Context, isSSLDisabled bool, sslEmail string) error {
+	err := n.Start(isSSLDisabled, sslEmail)
+	if err != nil {
+		return err
+	}
+
+	var runErr error
+
+	select {
+	case <-ctx.Done():
+	case runErr = <-n.httpErr:
+	}
+
+	stopCtx, cancel := context.WithTimeout(context.Background(), DefaultStopTimeout)
+	defer cancel()
+
+	err = n.Stop(stopCtx)
+	if runErr != nil {
+		return runErr
+	}
+
+	return err
+}
+
+// Start loads the blockchain state and launches the HTTP API, the peer to peer protocol,
+// the sync and the mining. It returns once the node is running, Stop shuts it down.
+func (n *Node) Start(isSSLDisabled bool, sslEmail string) error {
+	n.lifecycleLock.Lock()
+	defer n.lifecycleLock.Unlock()
+
+	if n.running {
+		return errors.New("node is already running")
+	}
+
+	fmt.Printf("Listening on: %s, advertised as: %s\n", n.httpListenAddr(), n.advertised().TcpAddress())
+
+	engine, err := consensus.NewFromDataDir(n.dataDir, consensus.Config{MinerThreads: n.minerThreads})
+	if err != nil {
+		return err
+	}
+
+	n.engine = engine
+
+	err = n.loadGenesis()
+	if err != nil {
+		return err
+	}
+
+	err = n.loadIdentity()
+	if err != nil {
+		return err
+	}
+
+	if authorizer, ok := engine.(consensus.Authorizer); ok && n.signerKey != nil {
+		authorizer.Authorize(n.signerKey)
+	}
+
+	state, err := database.NewStateFromDisk(n.dataDir, engine)
+	if err != nil {
+		return err
+	}
+
+	n.state = state
+
+	n.resetMempool()
+
+	// Set before the handlers run, a block synced after Stop doesn't wait for the mining loop
+	ctx, stopRun := context.WithCancel(context.Background())
+	n.runCtx = ctx
+	n.stopRun = stopRun
+
+	// Releases what was started so far if the node fails to start
+	started := false
+	defer func() {
+		if started {
+			return
+		}
+
+		stopRun()
+		n.closeP2P()
+		state.Close()
+	}()
+
+	err = n.loadPeerBook()
+	if err != nil {
+		return err
+	}
+
+	err = n.CheckDifficulty()
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", n.httpListenAddr())
+	if err != nil {
+		return err
+	}
+
+	// The long polling requests return as soon as the server shuts down
+	httpCtx, stopHttp := context.WithCancel(context.Background())
+	server := &http.Server{
+		Handler:     n.httpHandler(),
+		BaseContext: func(net.Listener) context.Context { return httpCtx },
+	}
+	server.RegisterOnShutdown(stopHttp)
+
+	if !isSSLDisabled {
+		certmagic.DefaultACME.Email = sslEmail
+
+		server.TLSConfig, err = certmagic.TLS([]string{n.advertised().IP})
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		server.TLSConfig.NextProtos = append([]string{"h2", "http/1.1"}, server.TLSConfig.NextProtos...)
+	}
+
+	if n.info.P2PPort != 0 {
+		err = n.startP2P(n.p2pListenAddr())
+		if err != nil {
+			listener.Close()
+			return err
+		}
+	}
+
+	err = n.openMempoolJournal()
+	if err != nil {
+		fmt.Printf("ERROR: unable to restore the pending TXs. %s\n", err)
+	}
+
+	fmt.Println("Blockchain state:")
+	fmt.Printf("	- node: %s\n", n.info.ID)
+	fmt.Printf("	- chain: %s\n", n.chainID)
+	fmt.Printf("	- genesis: %s\n", n.genesisHash.Hex())
+	fmt.Printf("	- consensus: %s\n", n.engine.Name())
+	fmt.Printf("	- height: %d\n", n.state.LatestBlock().Header.Number)
+	fmt.Printf("	- hash: %s\n", n.state.LatestBlockHash().Hex())
+	fmt.Printf("	- difficulty: %d\n", n.state.LatestBlock().Header.Difficulty)
+
+	n.httpServer = server
+	n.httpErr = make(chan error, 1)
+
+	n.runWg.Add(3)
+	go func() {
+		defer n.runWg.Done()
+		n.sync(ctx)
+	}()
+	go func() {
+		defer n.runWg.Done()
+		n.mine(ctx)
+	}()
+	go func() {
+		defer n.runWg.Done()
+		n.maintainMempool(ctx)
+	}()
+
+	n.runWg.Add(announceWorkers)
+	for i := 0; i < announceWorkers; i++ {
+		go func() {
+			defer n.runWg.Done()
+			n.handleAnnounces(ctx)
+		}()
+	}
+
+	go func() {
+		var err error
+		if server.TLSConfig != nil {
+			err = server.ServeTLS(listener, "", "")
+		} else {
+			err = server.Serve(listener)
+		}
+
+		if err != http.ErrServerClosed {
+			n.httpErr <- err
+		}
+	}()
+
+	n.running = true
+	started = true
+
+	return nil
+}
+
+// Stop shuts the node down: the HTTP API stops accepting requests, the mining is cancelled,
+// the sync loop drains and the peer to peer connections are closed. Then the mempool journal
+// and the peers are persisted and the blocks DB flushed and closed.
+//
+// The context bounds the shutdown, the node's files are persisted and closed even on timeout.
+func (n *Node) Stop(ctx context.Context) error {
+	n.lifecycleLock.Lock()
+	defer n.lifecycleLock.Unlock()
+
+	if !n.running {
+		return ErrNodeNotRunning
+	}
+	n.running = false
+
+	fmt.Println("Stopping the node...")
+
+	errs := make([]error, 0)
+
+	err := n.httpServer.Shutdown(ctx)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("unable to shut down the HTTP API. %s", err.Error()))
+		n.httpServer.Close()
+	}
+
+	n.stopRun()
+	n.closeP2P()
+
+	done := make(chan struct{})
+	go func() {
+		n.runWg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		errs = append(errs, fmt.Errorf("sync and mining didn't stop in time. %s", ctx.Err()))
+	}
+
+	// No block is half written once the chain is locked
+	n.chainLock.Lock()
+	defer n.chainLock.Unlock()
+
+	err = n.mempool.Close()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("unable to save the pending TXs. %s", err.Error()))
+	}
+
+	err = n.peerBook.save()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("unable to save the peer book. %s", err.Error()))
+	}
+
+	err = n.state.Close()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("unable to close the blocks DB. %s", err.Error()))
+	}
+
+	for _, err := range errs {
+		fmt.Printf("ERROR: %s\n", err)
+	}
+
+	if len(errs) > 0 {
+		return errs[0]
+	}
+
+	fmt.Println("Node stopped")
+
+	return nil
+}
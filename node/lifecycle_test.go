@@ -0,0 +1,217 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IacopoMelani/the-blockchain-pub/database"
+	"github.com/IacopoMelani/the-blockchain-pub/fs"
+	"github.com/IacopoMelani/the-blockchain-pub/wallet"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestNode_StartStop(t *testing.T) {
+	privKey, _, acc, err := generateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dataDir := t.TempDir()
+	defer fs.RemoveDir(dataDir)
+
+	genesisJson, err := json.Marshal(database.Genesis{Balances: map[common.Address]uint{acc: 1000000}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = database.InitDataDirIfNotExists(dataDir, genesisJson)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Mining is disabled without a miner account, the pending TX stays pending
+	n := New(dataDir, "127.0.0.1", 8085, common.Address{}, PeerNode{}, nodeVersion, defaultTestMiningDifficulty)
+	n.SetListenAddr("127.0.0.1:0")
+
+	err = n.Stop(context.Background())
+	if err != ErrNodeNotRunning {
+		t.Fatalf("expected %s stopping a node not started, got %v", ErrNodeNotRunning, err)
+	}
+
+	err = n.Start(true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := wallet.SignTx(database.NewTx(acc, database.NewAccount(testKsBabaYagaAccount), 1, 1, ""), privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = n.AddPendingTX(tx, n.info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = n.Stop(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The pending TXs survive the restart
+	n = New(dataDir, "127.0.0.1", 8085, common.Address{}, PeerNode{}, nodeVersion, defaultTestMiningDifficulty)
+	n.SetListenAddr("127.0.0.1:0")
+
+	err = n.Start(true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	txHash, err := tx.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !n.isPendingTX(txHash) {
+		t.Fatal("the pending TX is suppose to be restored")
+	}
+
+	err = n.Stop(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNode_RunStopsOnCancel(t *testing.T) {
+	n, dataDir := newTestNode(t, common.Address{})
+	n.state.Close()
+	defer fs.RemoveDir(dataDir)
+
+	n.SetListenAddr("127.0.0.1:0")
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error)
+	go func() {
+		done <- n.Run(ctx, true, "")
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+
+	case <-time.After(DefaultStopTimeout):
+		t.Fatal("the node is suppose to stop once the context is cancelled")
+	}
+}
+
+func TestNode_StopDuringSync(t *testing.T) {
+	miner := database.NewAccount(testKsBabaYagaAccount)
+
+	source, sourceDataDir := newTestNode(t, miner)
+	defer fs.RemoveDir(sourceDataDir)
+	defer source.state.Close()
+
+	// The node checks the genesis of the peer on handshake
+	err := source.loadGenesis()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source.miningDifficulty = 1 << 8
+	mineTestBlocks(t, source, miner, 3)
+
+	// The blocks are served once the node is stopping, the sync is in flight meanwhile
+	fetching := make(chan struct{})
+	release := make(chan struct{})
+	var fetchingOnce sync.Once
+
+	handler := source.httpHandler()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == endpointSync {
+			fetchingOnce.Do(func() { close(fetching) })
+			<-release
+		}
+
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	defer func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	}()
+
+	peer := testServerPeer(t, server)
+
+	n, dataDir := newTestNode(t, common.Address{})
+	n.state.Close()
+	defer fs.RemoveDir(dataDir)
+
+	n.SetListenAddr("127.0.0.1:0")
+	n.AddStaticPeers([]PeerNode{peer})
+
+	err = n.Start(true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-fetching:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the node is suppose to fetch the blocks")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- n.Stop(ctx)
+	}()
+
+	// The mining loop returns once the node is stopping, then the synced blocks arrive
+	<-n.runCtx.Done()
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatal(err)
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("the node is suppose to stop while syncing")
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package node
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/IacopoMelani/the-blockchain-pub/database"
+)
+
+const (
+	TxStatusPending = "pending"
+	TxStatusMined   = "mined"
+	TxStatusUnknown = "unknown"
+)
+
+type BlockRes struct {
+	Hash          database.Hash        `json:"hash"`
+	Header        database.BlockHeader `json:"header"`
+	TxCount       int                  `json:"tx_count"`
+	TXs           []database.SignedTx  `json:"txs,omitempty"`
+	Confirmations uint64               `json:"confirmations"`
+}
+
+type TxRes struct {
+	Hash          database.Hash      `json:"hash"`
+	Status        string             `json:"status"`
+	Tx            *database.SignedTx `json:"tx,omitempty"`
+	BlockHash     database.Hash      `json:"block_hash,omitempty"`
+	BlockNumber   uint64             `json:"block_number"`
+	Index         int                `json:"index"`
+	Confirmations uint64             `json:"confirmations"`
+}
+
+// lookupBlock looks up a persisted block by its hash, its number or "latest", with its TXs if withTXs.
+func (n *Node) lookupBlock(id string, withTXs bool) (BlockRes, bool, error) {
+	n.chainLock.RLock()
+	defer n.chainLock.RUnlock()
+
+	blockFs, found, err := n.blockByID(id)
+	if err != nil || !found {
+		return BlockRes{}, found, err
+	}
+
+	return n.newBlockRes(blockFs, withTXs), true, nil
+}
+
+func (n *Node) blockByID(id string) (database.BlockFS, bool, error) {
+	if id == endpointBlockLatest {
+		if n.state.LatestBlockHash().IsEmpty() {
+			return database.BlockFS{}, false, nil
+		}
+
+		return n.state.GetBlockByNumber(n.state.LatestBlock().Header.Number)
+	}
+
+	if len(id) == 2*len(database.Hash{}) {
+		hash := database.Hash{}
+		err := hash.UnmarshalText([]byte(id))
+		if err != nil {
+			return database.BlockFS{}, false, fmt.Errorf("invalid block hash '%s'. %s", id, err)
+		}
+
+		return n.state.GetBlockByHash(hash)
+	}
+
+	number, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return database.BlockFS{}, false, fmt.Errorf("block must be a hash, a number or '%s' not '%s'", endpointBlockLatest, id)
+	}
+
+	return n.state.GetBlockByNumber(number)
+}
+
+func (n *Node) newBlockRes(blockFs database.BlockFS, withTXs bool) BlockRes {
+	res := BlockRes{
+		Hash:          blockFs.Key,
+		Header:        blockFs.Value.Header,
+		TxCount:       len(blockFs.Value.TXs),
+		Confirmations: n.confirmations(blockFs.Value.Header.Number),
+	}
+
+	if withTXs {
+		res.TXs = blockFs.Value.TXs
+	}
+
+	return res
+}
+
+// lookupTx finds the TX among the mined and the pending ones.
+func (n *Node) lookupTx(hash database.Hash) (TxRes, error) {
+	n.chainLock.RLock()
+	defer n.chainLock.RUnlock()
+
+	if location, ok := n.state.TxLocation(hash); ok {
+		blockFs, found, err := n.state.GetBlockByNumber(location.BlockNumber)
+		if err != nil {
+			return TxRes{}, err
+		}
+
+		if found && blockFs.Key == location.BlockHash && location.Index < len(blockFs.Value.TXs) {
+			return TxRes{
+				Hash:          hash,
+				Status:        TxStatusMined,
+				Tx:            &blockFs.Value.TXs[location.Index],
+				BlockHash:     location.BlockHash,
+				BlockNumber:   location.BlockNumber,
+				Index:         location.Index,
+				Confirmations: n.confirmations(location.BlockNumber),
+			}, nil
+		}
+	}
+
+	if tx, ok := n.mempool.Get(hash); ok {
+		return TxRes{Hash: hash, Status: TxStatusPending, Tx: &tx}, nil
+	}
+
+	return TxRes{Hash: hash, Status: TxStatusUnknown}, nil
+}
+
+// confirmations counts the blocks on top of the block with the given number, itself included.
+func (n *Node) confirmations(number uint64) uint64 {
+	latest := n.state.LatestBlock().Header.Number
+	if n.state.LatestBlockHash().IsEmpty() || number > latest {
+		return 0
+	}
+
+	return latest - number + 1
+}
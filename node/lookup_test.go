@@ -0,0 +1,216 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/IacopoMelani/the-blockchain-pub/database"
+	"github.com/IacopoMelani/the-blockchain-pub/fs"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/labstack/echo/v4"
+)
+
+func TestNode_BlockLookup(t *testing.T) {
+	n, dataDir := newTestNode(t, common.Address{})
+	defer fs.RemoveDir(dataDir)
+	defer n.state.Close()
+
+	addTestPendingTXs(t, n, 1, 2)
+	mineTestBlocks(t, n, common.Address{}, 1)
+
+	latest := n.state.LatestBlock().Header.Number
+
+	for _, id := range []string{endpointBlockLatest, fmt.Sprintf("%d", latest), n.state.LatestBlockHash().Hex()} {
+		res := BlockRes{}
+		code := getTestLookup(t, n, blockHandler, "id", id, "?txs=true", &res)
+
+		if code != http.StatusOK || res.Hash != n.state.LatestBlockHash() || len(res.TXs) != 2 || res.Confirmations != 1 {
+			t.Fatalf("expected the latest block with its 2 TXs by '%s', got status %d and %+v", id, code, res)
+		}
+	}
+
+	res := BlockRes{}
+	getTestLookup(t, n, blockHandler, "id", "0", "", &res)
+	if res.Header.Number != 0 || res.TXs != nil || res.Confirmations != latest+1 {
+		t.Fatalf("expected the header of block 0, got %+v", res)
+	}
+
+	if code := getTestLookup(t, n, blockHandler, "id", "1000", "", &BlockRes{}); code != http.StatusNotFound {
+		t.Fatalf("expected status %d for a missing block, got %d", http.StatusNotFound, code)
+	}
+
+	if code := getTestLookup(t, n, blockHandler, "id", "first", "", &BlockRes{}); code != http.StatusBadRequest {
+		t.Fatalf("expected status %d for an invalid block, got %d", http.StatusBadRequest, code)
+	}
+}
+
+func TestNode_TxLookup(t *testing.T) {
+	n, dataDir := newTestNode(t, common.Address{})
+	defer fs.RemoveDir(dataDir)
+	defer n.state.Close()
+
+	txs := addTestPendingTXs(t, n, 1, 2, 4)
+	mineTestBlocks(t, n, common.Address{}, 2)
+
+	minedHash, err := txs[1].Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := TxRes{}
+	code := getTestLookup(t, n, txHandler, "hash", minedHash.Hex(), "", &res)
+
+	mined := n.state.LatestBlock().Header.Number - 1
+	blockHash, _ := n.state.BlockHash(mined)
+
+	if code != http.StatusOK || res.Status != TxStatusMined || res.BlockHash != blockHash || res.Index != 1 || res.Confirmations != 2 {
+		t.Fatalf("expected the TX mined at index 1 of block %d, got status %d and %+v", mined, code, res)
+	}
+
+	firstHash, err := txs[0].Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first TX of the block reports its index 0 rather than omitting it
+	raw := map[string]interface{}{}
+	getTestLookup(t, n, txHandler, "hash", firstHash.Hex(), "", &raw)
+	if index, ok := raw["index"]; !ok || index != float64(0) {
+		t.Fatalf("expected the TX mined at index 0, got %v", raw)
+	}
+
+	if number, ok := raw["block_number"]; !ok || number != float64(mined) {
+		t.Fatalf("expected the TX mined in block %d, got %v", mined, raw)
+	}
+
+	queuedHash, err := txs[2].Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res = TxRes{}
+	getTestLookup(t, n, txHandler, "hash", queuedHash.Hex(), "", &res)
+	if res.Status != TxStatusPending || res.Tx == nil || res.Tx.Nonce != 4 {
+		t.Fatalf("expected the TX waiting in the mempool to be pending, got %+v", res)
+	}
+
+	// Rewinding the chain forgets the TXs mined in the dropped blocks
+	err = n.rewindChain(mined - 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code = getTestLookup(t, n, txHandler, "hash", minedHash.Hex(), "", &res)
+	if code != http.StatusNotFound || res.Status != TxStatusUnknown {
+		t.Fatalf("expected the TX of a rewound block to be unknown, got status %d and %+v", code, res)
+	}
+
+	code = getTestLookup(t, n, txHandler, "hash", database.Hash{1}.Hex(), "", &res)
+	if code != http.StatusNotFound || res.Status != TxStatusUnknown {
+		t.Fatalf("expected an unknown TX, got status %d and %+v", code, res)
+	}
+}
+
+func getTestLookup(t *testing.T, n *Node, handler func(echo.Context, *Node) error, param, value, query string, res interface{}) int {
+	e := echo.New()
+	rec := httptest.NewRecorder()
+	c := e.NewContext(httptest.NewRequest(http.MethodGet, "/"+query, nil), rec)
+	c.SetParamNames(param)
+	c.SetParamValues(value)
+
+	err := handler(c, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = json.Unmarshal(rec.Body.Bytes(), res)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rec.Code
+}
+
+func TestNode_TxReceipt(t *testing.T) {
+	n, dataDir := newTestNode(t, common.Address{})
+	defer fs.RemoveDir(dataDir)
+	defer func() { n.state.Close() }()
+
+	txs := addTestPendingTXs(t, n, 1, 2)
+	mineTestBlocks(t, n, common.Address{}, 1)
+
+	txHash, err := txs[1].Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := database.Receipt{
+		TxHash:      txHash,
+		BlockHash:   n.state.LatestBlockHash(),
+		BlockNumber: n.state.LatestBlock().Header.Number,
+		Index:       1,
+		Fee:         database.TxFee,
+		Status:      database.ReceiptStatusSuccess,
+		FromBalance: 2*database.BlockReward - 2*(1+database.TxFee),
+		ToBalance:   2,
+	}
+
+	receipt := database.Receipt{}
+	if code := getTestLookup(t, n, txReceiptHandler, "hash", txHash.Hex(), "", &receipt); code != http.StatusOK || receipt != expected {
+		t.Fatalf("expected receipt %+v, got status %d and %+v", expected, code, receipt)
+	}
+
+	// The receipts are persisted, and rebuilt if the receipts DB is lost
+	for _, lost := range []bool{false, true} {
+		err = n.state.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if lost {
+			err = os.Remove(filepath.Join(dataDir, "database", "receipts.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		n.state, err = database.NewStateFromDisk(dataDir, n.engine)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		receipt, found, err := n.state.GetReceipt(txHash)
+		if err != nil || !found || receipt != expected {
+			t.Fatalf("expected receipt %+v after restart, got %+v, %v", expected, receipt, err)
+		}
+	}
+
+	err = n.rewindChain(expected.BlockNumber - 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code := getTestLookup(t, n, txReceiptHandler, "hash", txHash.Hex(), "", &ErrRes{}); code != http.StatusNotFound {
+		t.Fatalf("expected no receipt for a TX of a rewound block, got status %d", code)
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/IacopoMelani/the-blockchain-pub/database"
+	"github.com/IacopoMelani/the-blockchain-pub/mempool"
+)
+
+// The pending TXs are journaled in the data dir to survive restarts
+const mempoolJournalFile = "mempool.journal"
+
+// How often the expired TXs are dropped and the journal compacted
+const mempoolMaintenanceInterval = time.Minute
+
+// Max number of TXs listed by a single page of the mempool endpoint
+const maxMempoolTxsPerRequest = 100
+
+// Max number of pending TXs fetched from a peer in a sync round
+const maxPeerPendingTXs = 4096
+
+type MempoolRes struct {
+	Pending     int           `json:"pending"`
+	Queued      int           `json:"queued"`
+	Senders     int           `json:"senders"`
+	PendingSize int           `json:"pending_size"`
+	QueuedSize  int           `json:"queued_size"`
+	Digest      database.Hash `json:"digest"`
+}
+
+type MempoolTxRes struct {
+	Hash   database.Hash     `json:"hash"`
+	Tx     database.SignedTx `json:"tx"`
+	Status string            `json:"status"`
+}
+
+type MempoolTxsRes struct {
+	Txs    []MempoolTxRes `json:"txs"`
+	Total  int            `json:"total"`
+	Offset int            `json:"offset"`
+	Limit  int            `json:"limit"`
+}
+
+type p2pPageReq struct {
+	Offset uint64
+	Limit  uint64
+}
+
+func newMempoolTxRes(entry mempool.Entry) MempoolTxRes {
+	return MempoolTxRes{Hash: entry.Hash, Tx: entry.Tx, Status: entry.Status}
+}
+
+// mempoolTxs lists a page of the TXs matching the filter, the pending ones first.
+func (n *Node) mempoolTxs(filter mempool.Filter, offset, limit int) MempoolTxsRes {
+	entries := n.mempool.Filter(filter)
+
+	res := MempoolTxsRes{Txs: make([]MempoolTxRes, 0), Total: len(entries), Offset: offset, Limit: limit}
+
+	for i := offset; i < len(entries) && i < offset+limit; i++ {
+		res.Txs = append(res.Txs, newMempoolTxRes(entries[i]))
+	}
+
+	return res
+}
+
+// peerPendingTXs pages through the peer's pending TXs, over p2p if connected and HTTP otherwise.
+func (n *Node) peerPendingTXs(peer PeerNode) ([]database.SignedTx, error) {
+	txs := make([]database.SignedTx, 0)
+
+	for len(txs) < maxPeerPendingTXs {
+		page, err := n.peerMempoolTxs(peer, len(txs), maxMempoolTxsPerRequest)
+		if err != nil {
+			return txs, err
+		}
+
+		for _, entry := range page.Txs {
+			txs = append(txs, entry.Tx)
+		}
+
+		if len(page.Txs) == 0 || len(txs) >= page.Total {
+			break
+		}
+	}
+
+	return txs, nil
+}
+
+func (n *Node) peerMempoolTxs(peer PeerNode, offset, limit int) (MempoolTxsRes, error) {
+	session := n.p2pSession(peer)
+	if session == nil {
+		return fetchMempoolTxsFromPeer(peer, offset, limit)
+	}
+
+	resBody, err := n.p2pRequest(session, getPendingTxsMsg, p2pPageReq{Offset: uint64(offset), Limit: uint64(limit)})
+	if err != nil {
+		return MempoolTxsRes{}, err
+	}
+
+	res := MempoolTxsRes{}
+	err = json.Unmarshal(resBody, &res)
+
+	return res, err
+}
+
+func fetchMempoolTxsFromPeer(peer PeerNode, offset, limit int) (MempoolTxsRes, error) {
+	url := fmt.Sprintf(
+		"%s://%s%s?%s=%s&%s=%d&%s=%d",
+		peer.ApiProtocol(),
+		peer.TcpAddress(),
+		endpointMempoolTxs,
+		endpointMempoolTxsQueryKeyStatus,
+		mempool.StatusPending,
+		endpointMempoolTxsQueryKeyOffset,
+		offset,
+		endpointMempoolTxsQueryKeyLimit,
+		limit,
+	)
+
+	res, err := http.Get(url)
+	if err != nil {
+		return MempoolTxsRes{}, err
+	}
+
+	mempoolTxsRes := MempoolTxsRes{}
+	err = readRes(res, &mempoolTxsRes)
+
+	return mempoolTxsRes, err
+}
+
+// openMempoolJournal reloads the TXs pending before the restart, the ones mined or expired meanwhile are dropped.
+func (n *Node) openMempoolJournal() error {
+	loaded, dropped, err := n.mempool.OpenJournal(filepath.Join(n.dataDir, mempoolJournalFile))
+	if loaded > 0 || dropped > 0 {
+		fmt.Printf("Restored %d Pending TXs from the journal, dropped %d no longer valid\n", loaded, dropped)
+	}
+
+	return err
+}
+
+// maintainMempool periodically drops the expired TXs and compacts the journal.
+func (n *Node) maintainMempool(ctx context.Context) {
+	ticker := time.NewTicker(mempoolMaintenanceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, tx := range n.mempool.Expire(time.Now()) {
+				txHash, _ := tx.Hash()
+				fmt.Printf("Pending TX %s expired\n", txHash.Hex())
+			}
+
+			err := n.mempool.RotateJournal()
+			if err != nil {
+				fmt.Printf("ERROR: unable to rotate the mempool journal. %s\n", err)
+			}
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
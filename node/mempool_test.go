@@ -0,0 +1,198 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package node
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/IacopoMelani/the-blockchain-pub/database"
+	"github.com/IacopoMelani/the-blockchain-pub/fs"
+	"github.com/IacopoMelani/the-blockchain-pub/mempool"
+	"github.com/IacopoMelani/the-blockchain-pub/wallet"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/labstack/echo/v4"
+)
+
+func TestNode_MempoolTxs(t *testing.T) {
+	n, dataDir := newTestNode(t, common.Address{})
+	defer fs.RemoveDir(dataDir)
+	defer n.state.Close()
+
+	txs := addTestPendingTXs(t, n, 1, 2, 4)
+
+	e := echo.New()
+	rec := httptest.NewRecorder()
+	c := e.NewContext(httptest.NewRequest(http.MethodGet, endpointMempoolTxs+"?status=pending&offset=1&limit=1", nil), rec)
+
+	err := mempoolTxsHandler(c, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := MempoolTxsRes{}
+	err = json.Unmarshal(rec.Body.Bytes(), &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Total != 2 || len(res.Txs) != 1 || res.Txs[0].Tx.Nonce != 2 {
+		t.Fatalf("expected the second of 2 pending TXs, got %+v", res)
+	}
+
+	rec = httptest.NewRecorder()
+	c = e.NewContext(httptest.NewRequest(http.MethodGet, endpointMempoolTxs+"?min_nonce=three", nil), rec)
+
+	err = mempoolTxsHandler(c, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d for an invalid nonce, got %d", http.StatusBadRequest, rec.Code)
+	}
+
+	// A malformed address would filter on the zero address rather than fail
+	for _, query := range []string{"?from=0xnot-an-address", "?to=andrej"} {
+		rec = httptest.NewRecorder()
+		c = e.NewContext(httptest.NewRequest(http.MethodGet, endpointMempoolTxs+query, nil), rec)
+
+		err = mempoolTxsHandler(c, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("expected status %d for the invalid address '%s', got %d", http.StatusBadRequest, query, rec.Code)
+		}
+	}
+
+	queuedHash, err := txs[2].Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec = httptest.NewRecorder()
+	c = e.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+	c.SetParamNames("hash")
+	c.SetParamValues(queuedHash.Hex())
+
+	err = mempoolTxHandler(c, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	txRes := MempoolTxRes{}
+	err = json.Unmarshal(rec.Body.Bytes(), &txRes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if txRes.Hash != queuedHash || txRes.Status != mempool.StatusQueued {
+		t.Fatalf("expected the queued TX %s, got %+v", queuedHash.Hex(), txRes)
+	}
+
+	status := n.status()
+	if status.PendingCount != 2 || status.PendingDigest != n.mempool.Digest() {
+		t.Fatalf("expected the status to carry 2 pending TXs, got %d", status.PendingCount)
+	}
+}
+
+func TestNode_PeerPendingTXs(t *testing.T) {
+	source, sourceDataDir := newTestP2PNode(t, common.Address{}, 8085)
+	defer fs.RemoveDir(sourceDataDir)
+	defer source.state.Close()
+
+	addTestPendingTXs(t, source, 1, 2, 3)
+
+	n, dataDir := newTestP2PNode(t, common.Address{}, 8086)
+	defer fs.RemoveDir(dataDir)
+	defer n.state.Close()
+
+	peer := NewPeerNode("127.0.0.1", 1, false, common.Address{}, false, nodeVersion)
+	peer.P2PPort = uint64(source.p2pServer.Addr().(*net.TCPAddr).Port)
+
+	status, err := n.peerStatus(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.ID = status.NodeID
+
+	if status.PendingCount != 3 {
+		t.Fatalf("expected the peer to have 3 pending TXs, got %d", status.PendingCount)
+	}
+
+	txs, err := n.peerPendingTXs(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(txs) != 3 {
+		t.Fatalf("expected 3 pending TXs over p2p, got %d", len(txs))
+	}
+
+	// Without a p2p connection the TXs are paged through HTTP
+	e := echo.New()
+	e.GET(endpointMempoolTxs, func(c echo.Context) error {
+		return mempoolTxsHandler(c, source)
+	})
+
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	httpPeer := NewPeerNode("127.0.0.1", uint64(server.Listener.Addr().(*net.TCPAddr).Port), false, common.Address{}, false, nodeVersion)
+
+	txs, err = n.peerPendingTXs(httpPeer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(txs) != 3 {
+		t.Fatalf("expected 3 pending TXs over HTTP, got %d", len(txs))
+	}
+}
+
+// addTestPendingTXs funds a new account by mining a block per TX and adds its TXs with the given nonces.
+func addTestPendingTXs(t *testing.T, n *Node, nonces ...uint) []database.SignedTx {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := crypto.PubkeyToAddress(key.PublicKey)
+
+	mineTestBlocks(t, n, sender, len(nonces))
+
+	txs := make([]database.SignedTx, 0, len(nonces))
+	for _, nonce := range nonces {
+		tx, err := wallet.SignTx(database.NewTx(sender, common.Address{}, 1, nonce, ""), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = n.AddPendingTX(tx, n.info)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		txs = append(txs, tx)
+	}
+
+	return txs
+}
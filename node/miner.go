@@ -17,9 +17,9 @@ package node
 
 import (
 	"context"
-	"fmt"
 	"time"
 
+	"github.com/IacopoMelani/the-blockchain-pub/consensus/pow"
 	"github.com/IacopoMelani/the-blockchain-pub/database"
 	"github.com/ethereum/go-ethereum/common"
 )
@@ -37,49 +37,12 @@ func NewPendingBlock(parent database.Hash, number uint64, miner common.Address,
 	return PendingBlock{parent, number, uint64(time.Now().Unix()), miner, difficulty, txs}
 }
 
-func Mine(ctx context.Context, pb PendingBlock) (database.Block, error) {
-
-	start := time.Now()
-	attempt := 0
-	var block database.Block
-	var hash database.Hash
-	var nonce uint32
-
-	for !database.IsBlockHashValid(hash, pb.difficulty) {
-		select {
-		case <-ctx.Done():
-			fmt.Println("Mining cancelled!")
-
-			return database.Block{}, fmt.Errorf("mining cancelled. %s", ctx.Err())
-		default:
-		}
-
-		nonce = uint32(attempt)
-		attempt++
-
-		if attempt%1000000 == 0 || attempt == 1 {
-			fmt.Printf("Mining %d Pending TXs. Attempt: %d\n", len(pb.txs), attempt)
-		}
-
-		block = database.NewBlock(pb.parent, pb.number, nonce, pb.time, pb.miner, pb.difficulty, pb.txs)
-		blockHash, err := block.Hash()
-		if err != nil {
-			return database.Block{}, fmt.Errorf("couldn't mine block. %s", err.Error())
-		}
-
-		hash = blockHash
-	}
-
-	fmt.Printf("\nMined new Block '%x' using PoW 🎉🎉🎉\n", hash)
-	fmt.Printf("\tHeight: '%v'\n", block.Header.Number)
-	fmt.Printf("\tNonce: '%v'\n", block.Header.Nonce)
-	fmt.Printf("\tDifficulty: '%v'\n", block.Header.Difficulty)
-	fmt.Printf("\tCreated: '%v'\n", block.Header.Time)
-	fmt.Printf("\tMiner: '%v'\n", block.Header.Miner.String())
-	fmt.Printf("\tParent: '%v'\n\n", block.Header.Parent.Hex())
-
-	fmt.Printf("\tAttempt: '%v'\n", attempt)
-	fmt.Printf("\tTime: %s\n\n", time.Since(start))
+// Block returns the pending block as an unsealed block.
+func (pb PendingBlock) Block() database.Block {
+	return database.NewBlock(pb.parent, pb.number, 0, pb.time, pb.miner, pb.difficulty, pb.txs)
+}
 
-	return block, nil
+// Mine seals the pending block using the Proof of Work consensus engine.
+func Mine(ctx context.Context, pb PendingBlock) (database.Block, error) {
+	return pow.New().Seal(ctx, pb.Block())
 }
@@ -24,13 +24,15 @@ import (
 	"testing"
 	"time"
 
+	"github.com/IacopoMelani/the-blockchain-pub/consensus/pow"
 	"github.com/IacopoMelani/the-blockchain-pub/database"
 	"github.com/IacopoMelani/the-blockchain-pub/wallet"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
 )
 
-const defaultTestMiningDifficulty = 2
+// The hash must start with 2 zero bytes
+const defaultTestMiningDifficulty = 1 << 16
 
 func TestValidBlockHash(t *testing.T) {
 	hexHash := "0000fa04f8160395c387277f8b2f14837603383d33809a4db586086168edfa"
@@ -38,7 +40,7 @@ func TestValidBlockHash(t *testing.T) {
 
 	hex.Decode(hash[:], []byte(hexHash))
 
-	isValid := database.IsBlockHashValid(hash, defaultTestMiningDifficulty)
+	isValid := pow.IsBlockHashValid(hash, defaultTestMiningDifficulty)
 	if !isValid {
 		t.Fatalf("hash '%s' starting with 4 zeroes is suppose to be valid", hexHash)
 	}
@@ -50,7 +52,7 @@ func TestInvalidBlockHash(t *testing.T) {
 
 	hex.Decode(hash[:], []byte(hexHash))
 
-	isValid := database.IsBlockHashValid(hash, defaultTestMiningDifficulty)
+	isValid := pow.IsBlockHashValid(hash, defaultTestMiningDifficulty)
 	if isValid {
 		t.Fatal("hash is not suppose to be valid")
 	}
@@ -79,7 +81,7 @@ func TestMine(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if !database.IsBlockHashValid(minedBlockHash, defaultTestMiningDifficulty) {
+	if !pow.IsBlockHashValid(minedBlockHash, defaultTestMiningDifficulty) {
 		t.Fatal()
 	}
 
@@ -0,0 +1,136 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package node
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/IacopoMelani/the-blockchain-pub/consensus"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+type miningStats struct {
+	blocksFound    uint64
+	blocksLost     uint64
+	externalBlocks uint64
+}
+
+type MiningStatsRes struct {
+	Enabled        bool           `json:"enabled"`
+	IsMining       bool           `json:"is_mining"`
+	Miner          common.Address `json:"miner"`
+	Attempts       uint64         `json:"attempts"`
+	Hashrate       float64        `json:"hashrate"`
+	BlocksFound    uint64         `json:"blocks_found"`
+	BlocksLost     uint64         `json:"blocks_lost"`
+	ExternalBlocks uint64         `json:"external_blocks"`
+	Difficulty     uint64         `json:"difficulty"`
+}
+
+type MiningMinerReq struct {
+	Account string `json:"account"`
+}
+
+// StartMining resumes the mining of new blocks at the next mining interval.
+func (n *Node) StartMining() error {
+	n.miningLock.Lock()
+	defer n.miningLock.Unlock()
+
+	if n.info.Account == (common.Address{}) {
+		return fmt.Errorf("configure a miner account before starting the mining")
+	}
+
+	n.miningEnabled = true
+	fmt.Println("Mining started")
+
+	return nil
+}
+
+// StopMining pauses the mining, cancelling the block currently being mined.
+func (n *Node) StopMining() {
+	n.miningLock.Lock()
+	n.miningEnabled = false
+	n.miningLock.Unlock()
+
+	n.cancelCurrentMining()
+	fmt.Println("Mining stopped")
+}
+
+// SetMiner changes the account receiving the rewards of the next mined blocks.
+func (n *Node) SetMiner(miner common.Address) {
+	n.miningLock.Lock()
+	defer n.miningLock.Unlock()
+
+	n.info.Account = miner
+	fmt.Printf("Miner account changed to: %s\n", miner.Hex())
+}
+
+func (n *Node) Miner() common.Address {
+	n.miningLock.Lock()
+	defer n.miningLock.Unlock()
+
+	return n.info.Account
+}
+
+func (n *Node) IsMiningEnabled() bool {
+	n.miningLock.Lock()
+	defer n.miningLock.Unlock()
+
+	return n.miningEnabled
+}
+
+func (n *Node) MiningStats() MiningStatsRes {
+	n.chainLock.RLock()
+	difficulty := n.miningDifficulty
+	n.chainLock.RUnlock()
+
+	n.miningLock.Lock()
+	defer n.miningLock.Unlock()
+
+	stats := MiningStatsRes{
+		Enabled:        n.miningEnabled,
+		IsMining:       n.isMining,
+		Miner:          n.info.Account,
+		BlocksFound:    n.miningStats.blocksFound,
+		BlocksLost:     n.miningStats.blocksLost,
+		ExternalBlocks: n.miningStats.externalBlocks,
+		Difficulty:     difficulty,
+	}
+
+	if miner, ok := n.engine.(consensus.Miner); ok {
+		stats.Attempts = miner.Attempts()
+		stats.Hashrate = miner.Hashrate()
+	}
+
+	return stats
+}
+
+func (n *Node) setStopCurrentMining(stopCurrentMining context.CancelFunc) {
+	n.miningLock.Lock()
+	defer n.miningLock.Unlock()
+
+	n.stopCurrentMining = stopCurrentMining
+}
+
+func (n *Node) cancelCurrentMining() {
+	n.miningLock.Lock()
+	defer n.miningLock.Unlock()
+
+	if n.stopCurrentMining != nil {
+		n.stopCurrentMining()
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package node
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/IacopoMelani/the-blockchain-pub/database"
+	"github.com/IacopoMelani/the-blockchain-pub/fs"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/labstack/echo/v4"
+)
+
+func TestNode_MiningControl(t *testing.T) {
+	n, dataDir := newTestNode(t, database.NewAccount(DefaultMiner))
+	defer fs.RemoveDir(dataDir)
+	defer n.state.Close()
+
+	if n.IsMiningEnabled() {
+		t.Fatal("the node is not suppose to mine without a miner account")
+	}
+
+	if err := n.StartMining(); err == nil {
+		t.Fatal("the mining is not suppose to start without a miner account")
+	}
+
+	babaYaga := database.NewAccount(testKsBabaYagaAccount)
+	n.SetMiner(babaYaga)
+
+	if err := n.StartMining(); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := n.MiningStats()
+	if !stats.Enabled || stats.Miner != babaYaga || stats.Difficulty != defaultTestMiningDifficulty {
+		t.Fatalf("unexpected mining stats %+v", stats)
+	}
+
+	n.StopMining()
+
+	if n.IsMiningEnabled() || n.Miner() == (common.Address{}) {
+		t.Fatal("the mining is suppose to be stopped, keeping the miner account")
+	}
+}
+
+func TestNode_AdminAuth(t *testing.T) {
+	n, dataDir := newTestNode(t, database.NewAccount(DefaultMiner))
+	defer fs.RemoveDir(dataDir)
+	defer n.state.Close()
+
+	// Without a token only the local requests are accepted
+	if code := postTestAdmin(n.httpHandler(), endpointAdminMiningStop, "192.0.2.1:1234", nil); code != http.StatusForbidden {
+		t.Fatalf("expected a remote request to be forbidden, got %d", code)
+	}
+
+	// The votes of the Proof of Authority signer too
+	for _, endpoint := range []string{endpointPoAPropose, endpointPoADiscard} {
+		if code := postTestAdmin(n.httpHandler(), endpoint, "192.0.2.1:1234", nil); code != http.StatusForbidden {
+			t.Fatalf("expected a remote request to %s to be forbidden, got %d", endpoint, code)
+		}
+	}
+
+	if code := postTestAdmin(n.httpHandler(), endpointAdminMiningStop, "127.0.0.1:1234", http.Header{echo.HeaderXForwardedFor: {"192.0.2.1"}}); code != http.StatusForbidden {
+		t.Fatalf("expected a forwarded request to be forbidden, got %d", code)
+	}
+
+	if code := postTestAdmin(n.httpHandler(), endpointAdminMiningStop, "127.0.0.1:1234", nil); code != http.StatusOK {
+		t.Fatalf("expected a local request to be accepted, got %d", code)
+	}
+
+	n.SetAdminToken("secret")
+
+	if code := postTestAdmin(n.httpHandler(), endpointAdminMiningStop, "127.0.0.1:1234", http.Header{echo.HeaderAuthorization: {"Bearer wrong"}}); code != http.StatusUnauthorized {
+		t.Fatalf("expected a wrong token to be unauthorized, got %d", code)
+	}
+
+	if code := postTestAdmin(n.httpHandler(), endpointAdminMiningStop, "192.0.2.1:1234", http.Header{echo.HeaderAuthorization: {"Bearer secret"}}); code != http.StatusOK {
+		t.Fatalf("expected a remote request with the token to be accepted, got %d", code)
+	}
+}
+
+func postTestAdmin(handler http.Handler, endpoint string, remoteAddr string, header http.Header) int {
+	req := httptest.NewRequest(http.MethodPost, endpoint, nil)
+	req.RemoteAddr = remoteAddr
+
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	return rec.Code
+}
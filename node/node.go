@@ -17,19 +17,26 @@ package node
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
-	"sort"
+	"sync"
 	"time"
 
-	"github.com/caddyserver/certmagic"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 
+	"github.com/IacopoMelani/the-blockchain-pub/consensus"
+	"github.com/IacopoMelani/the-blockchain-pub/consensus/poa"
 	"github.com/IacopoMelani/the-blockchain-pub/database"
+	"github.com/IacopoMelani/the-blockchain-pub/mempool"
+	"github.com/IacopoMelani/the-blockchain-pub/p2p"
 )
 
 const DefaultBootstrapIp = "node.tbb.web3.coach"
@@ -53,11 +60,43 @@ const endpointSyncQueryKeyLast = "last"
 const endpointSyncQueryKeyModeAfter = "after"
 const endpointSyncQueryKeyModeBefore = "before"
 
+const endpointHeaders = "/node/headers"
+const endpointSyncProgress = "/node/sync/progress"
+
+const endpointBlockHash = "/node/block/hash"
+const endpointBlockHashQueryKeyNumber = "number"
+
+const endpointAnnounceBlock = "/node/announce/block"
+const endpointAnnounceTx = "/node/announce/tx"
+
+const endpointPendingTx = "/node/tx/pending"
+const endpointPendingTxQueryKeyHash = "hash"
+
+const endpointBlock = "/block/:id"
+const endpointBlockQueryKeyTxs = "txs"
+const endpointBlockLatest = "latest"
+
+const endpointTx = "/tx/:hash"
+const endpointTxReceipt = "/tx/:hash/receipt"
+const endpointTxWait = "/tx/:hash/wait"
+const endpointTxWaitQueryKeyConfirmations = "confirmations"
+const endpointTxWaitQueryKeyTimeout = "timeout"
+
+const endpointMempool = "/mempool"
+const endpointMempoolTxs = "/mempool/txs"
+const endpointMempoolTxsQueryKeyFrom = "from"
+const endpointMempoolTxsQueryKeyTo = "to"
+const endpointMempoolTxsQueryKeyMinFee = "min_fee"
+const endpointMempoolTxsQueryKeyMinNonce = "min_nonce"
+const endpointMempoolTxsQueryKeyMaxNonce = "max_nonce"
+const endpointMempoolTxsQueryKeyStatus = "status"
+const endpointMempoolTxsQueryKeyOffset = "offset"
+const endpointMempoolTxsQueryKeyLimit = "limit"
+const endpointMempoolTx = "/mempool/tx/:hash"
+
+const endpointSubscriptions = "/ws"
+
 const endpointAddPeer = "/node/peer"
-const endpointAddPeerQueryKeyIP = "ip"
-const endpointAddPeerQueryKeyPort = "port"
-const endpointAddPeerQueryKeyMiner = "miner"
-const endpointAddPeerQueryKeyVersion = "version"
 
 const endpointNextNonce = "/address/nonce/next"
 
@@ -65,16 +104,36 @@ const endtpointAddressBalance = "/address/balance"
 
 const endpointAddressTransactions = "/address/transactions"
 
+const endpointMiningWork = "/mining/work"
+const endpointMiningWorkQueryKeyMiner = "miner"
+const endpointMiningSubmit = "/mining/submit"
+
+const endpointMiningStats = "/mining/stats"
+const endpointAdminMiningStart = "/admin/mining/start"
+const endpointAdminMiningStop = "/admin/mining/stop"
+const endpointAdminMiningMiner = "/admin/mining/miner"
+
+const endpointPoASigners = "/poa/signers"
+const endpointPoAPropose = "/poa/propose"
+const endpointPoADiscard = "/poa/discard"
+
 const miningIntervalSeconds = 3
-const DefaultMiningDifficulty = 2
+
+// Expected number of hashes to mine a block, i.e: the hash must start with 2 zero bytes
+const DefaultMiningDifficulty = 1 << 16
 
 type PeerNode struct {
+	// Public identity key of the node, hex encoded and compressed. Empty until the handshake
+	ID          string         `json:"id,omitempty"`
 	IP          string         `json:"ip"`
 	Port        uint64         `json:"port"`
 	IsBootstrap bool           `json:"is_bootstrap"`
 	Account     common.Address `json:"account"`
 	NodeVersion string         `json:"node_version"`
 
+	// TCP port of the peer to peer protocol, 0 if the node speaks HTTP only
+	P2PPort uint64 `json:"p2p_port,omitempty"`
+
 	// Whenever my node already established connection, sync with this Peer
 	connected bool
 }
@@ -83,6 +142,15 @@ func (pn PeerNode) TcpAddress() string {
 	return fmt.Sprintf("%s:%d", pn.IP, pn.Port)
 }
 
+// Key identifies the peer by node ID once known, by its address before the handshake.
+func (pn PeerNode) Key() string {
+	if pn.ID != "" {
+		return pn.ID
+	}
+
+	return pn.TcpAddress()
+}
+
 func (pn PeerNode) ApiProtocol() string {
 	if pn.Port == HttpSSLPort {
 		return "https"
@@ -95,22 +163,103 @@ type Node struct {
 	dataDir string
 	info    PeerNode
 
+	// The network the node belongs to, peers must share it
+	genesisHash database.Hash
+	chainID     string
+
+	// Required by the peers' handshake when not empty
+	networkSecret string
+
+	// Signs the handshake and status payloads, its public key is the node ID
+	nodeKey *ecdsa.PrivateKey
+
+	// Connections of the peer to peer protocol, by node ID
+	p2pEncrypt bool
+	p2pServer  *p2p.Server
+	p2pPeers   map[string]*p2p.Peer
+	p2pLock    sync.Mutex
+
+	// The consensus engine selected from the genesis
+	engine consensus.Engine
+
+	// The key sealing the blocks on Proof of Authority networks
+	signerKey *ecdsa.PrivateKey
+
+	// Number of goroutines mining in parallel, all CPUs if 0
+	minerThreads int
+
 	// The main blockchain state after all TXs from mined blocks were applied
-	state *database.State
+	state     *database.State
+	chainLock sync.RWMutex
+
+	// Serializes the blocks syncing, polled or announced by peers
+	syncLock         sync.Mutex
+	syncProgress     syncProgress
+	syncProgressLock sync.Mutex
 
-	// temporary pending state validating new incoming TXs but reset after the block is mined
-	pendingState *database.State
+	// TXs not mined yet, re-validated against the state after every block
+	mempool *mempool.Pool
 
 	knownPeers      map[string]PeerNode
-	pendingTXs      map[string]database.SignedTx
-	archivedTXs     map[string]database.SignedTx
+	inboundPeers    map[string]struct{}
+	peersLock       sync.RWMutex
+	peerBook        *peerBook
 	newSyncedBlocks chan database.Block
-	newPendingTXs   chan database.SignedTx
 	nodeVersion     string
 
-	// Number of zeroes the hash must start with to be considered valid. Default 3
+	// Blocks received before their parent, added as soon as it is
+	orphans *orphanPool
+
+	// Publishes the new blocks, the pending TXs and the reorgs, see eventBus
+	events *eventBus
+
+	// Hashes of the blocks and TXs already announced to or by the peers
+	seenHashes     map[database.Hash]struct{}
+	seenHashesList []database.Hash
+	seenLock       sync.Mutex
+
+	// Announces waiting for the workers to fetch the blocks and TXs, see queueAnnounce
+	announces chan func()
+
+	// Block templates served to external miners, by work ID
+	works     map[database.Hash]database.Block
+	worksLock sync.Mutex
+
+	// Expected number of hashes to mine the next block, the hash must be below 2^256 / miningDifficulty
 	miningDifficulty uint64
 	isMining         bool
+
+	// Whenever the node mines new blocks, can be toggled at runtime
+	miningEnabled     bool
+	stopCurrentMining context.CancelFunc
+	miningStats       miningStats
+	miningLock        sync.Mutex
+
+	// Required by the admin endpoints when not empty
+	adminToken string
+
+	// Web pages allowed to open the WebSocket subscriptions besides the node's own, see SetWsOrigins
+	wsOrigins []string
+
+	// Address the HTTP API binds to, all the interfaces on the node's port if empty
+	listenAddr string
+
+	// Host and port the peers know the node by, its IP and port if empty, see SetAdvertiseAddr
+	advertisedIP   string
+	advertisedPort uint64
+
+	// Peers registering with the node and peers the node syncs with, unlimited if 0
+	maxInboundPeers  int
+	maxOutboundPeers int
+
+	// Lifecycle of the running node, see Start and Stop
+	running       bool
+	runCtx        context.Context
+	stopRun       context.CancelFunc
+	runWg         sync.WaitGroup
+	httpServer    *http.Server
+	httpErr       chan error
+	lifecycleLock sync.Mutex
 }
 
 func New(dataDir string, ip string, port uint64, acc common.Address, bootstrap PeerNode, version string, miningDifficulty uint64) *Node {
@@ -120,12 +269,20 @@ func New(dataDir string, ip string, port uint64, acc common.Address, bootstrap P
 		dataDir:          dataDir,
 		info:             NewPeerNode(ip, port, false, acc, true, version),
 		knownPeers:       knownPeers,
-		pendingTXs:       make(map[string]database.SignedTx),
-		archivedTXs:      make(map[string]database.SignedTx),
+		inboundPeers:     make(map[string]struct{}),
+		peerBook:         newPeerBook(dataDir),
+		mempool:          mempool.New(mempool.DefaultConfig),
 		newSyncedBlocks:  make(chan database.Block),
-		newPendingTXs:    make(chan database.SignedTx, 10000),
+		runCtx:           context.Background(),
+		orphans:          newOrphanPool(),
+		events:           newEventBus(),
+		works:            make(map[database.Hash]database.Block),
+		seenHashes:       make(map[database.Hash]struct{}),
+		announces:        make(chan func(), maxQueuedAnnounces),
+		p2pPeers:         make(map[string]*p2p.Peer),
 		nodeVersion:      version,
 		isMining:         false,
+		miningEnabled:    acc != common.Address{},
 		miningDifficulty: miningDifficulty,
 	}
 
@@ -135,50 +292,58 @@ func New(dataDir string, ip string, port uint64, acc common.Address, bootstrap P
 }
 
 func NewPeerNode(ip string, port uint64, isBootstrap bool, acc common.Address, connected bool, version string) PeerNode {
-	return PeerNode{ip, port, isBootstrap, acc, version, connected}
+	return PeerNode{IP: ip, Port: port, IsBootstrap: isBootstrap, Account: acc, NodeVersion: version, connected: connected}
 }
 
-func (n *Node) Run(ctx context.Context, isSSLDisabled bool, sslEmail string) error {
-	fmt.Printf("Listening on: %s:%d\n", n.info.IP, n.info.Port)
-
-	state, err := database.NewStateFromDisk(n.dataDir, n.miningDifficulty)
-	if err != nil {
-		return err
-	}
-	defer state.Close()
+// SetSignerKey configures the key sealing the blocks, the node's miner account becomes the key's account.
+func (n *Node) SetSignerKey(key *ecdsa.PrivateKey) {
+	n.signerKey = key
+	n.info.Account = crypto.PubkeyToAddress(key.PublicKey)
+	n.miningEnabled = true
+}
 
-	n.state = state
+// SetAdminToken protects the admin endpoints with a bearer token.
+func (n *Node) SetAdminToken(token string) {
+	n.adminToken = token
+}
 
-	pendingState := state.Copy()
-	n.pendingState = &pendingState
+// SetWsOrigins allows the web pages of the origins, e.g: "https://example.com", or of any origin with "*",
+// to open the WebSocket subscriptions. Only the node's own origin and the clients sending none are allowed by default.
+func (n *Node) SetWsOrigins(origins []string) {
+	n.wsOrigins = origins
+}
 
-	if err = func() error {
+// SetMempoolConfig configures the limits of the pending TXs, before the node starts.
+func (n *Node) SetMempoolConfig(cfg mempool.Config) {
+	n.mempool = mempool.New(cfg)
+}
 
-		if err := n.CheckDifficulty(); err != nil {
-			return err
-		}
+// SetMinerThreads configures how many goroutines split the nonce space while mining.
+func (n *Node) SetMinerThreads(threads int) {
+	n.minerThreads = threads
+}
 
-		return nil
-	}(); err != nil {
-		return err
+func (n *Node) status() StatusRes {
+	pending, _ := n.mempool.Count()
+
+	return StatusRes{
+		NodeID:        n.info.ID,
+		Hash:          n.state.LatestBlockHash(),
+		Number:        n.state.LatestBlock().Header.Number,
+		KnownPeers:    n.KnownPeers(),
+		PendingCount:  pending,
+		PendingDigest: n.mempool.Digest(),
+		NodeVersion:   n.nodeVersion,
+		Account:       n.info.Account,
 	}
-
-	fmt.Println("Blockchain state:")
-	fmt.Printf("	- height: %d\n", n.state.LatestBlock().Header.Number)
-	fmt.Printf("	- hash: %s\n", n.state.LatestBlockHash().Hex())
-	fmt.Printf("	- difficulty: %d\n", n.state.LatestBlock().Header.Difficulty)
-
-	go n.sync(ctx)
-	go n.mine(ctx)
-
-	return n.serveHttp(ctx, isSSLDisabled, sslEmail)
 }
 
 func (n *Node) LatestBlockHash() database.Hash {
 	return n.state.LatestBlockHash()
 }
 
-func (n *Node) serveHttp(ctx context.Context, isSSLDisabled bool, sslEmail string) error {
+// httpHandler routes the HTTP API.
+func (n *Node) httpHandler() http.Handler {
 
 	e := echo.New()
 
@@ -204,7 +369,63 @@ func (n *Node) serveHttp(ctx context.Context, isSSLDisabled bool, sslEmail strin
 		return syncHandler(c, n)
 	})
 
-	e.GET(endpointAddPeer, func(c echo.Context) error {
+	e.GET(endpointHeaders, func(c echo.Context) error {
+		return headersHandler(c, n)
+	})
+
+	e.GET(endpointBlockHash, func(c echo.Context) error {
+		return blockHashHandler(c, n)
+	})
+
+	e.GET(endpointSyncProgress, func(c echo.Context) error {
+		return syncProgressHandler(c, n)
+	})
+
+	e.GET(endpointBlock, func(c echo.Context) error {
+		return blockHandler(c, n)
+	})
+
+	e.GET(endpointTx, func(c echo.Context) error {
+		return txHandler(c, n)
+	})
+
+	e.GET(endpointTxReceipt, func(c echo.Context) error {
+		return txReceiptHandler(c, n)
+	})
+
+	e.GET(endpointTxWait, func(c echo.Context) error {
+		return txWaitHandler(c, n)
+	})
+
+	e.GET(endpointMempool, func(c echo.Context) error {
+		return mempoolHandler(c, n)
+	})
+
+	e.GET(endpointMempoolTxs, func(c echo.Context) error {
+		return mempoolTxsHandler(c, n)
+	})
+
+	e.GET(endpointMempoolTx, func(c echo.Context) error {
+		return mempoolTxHandler(c, n)
+	})
+
+	e.GET(endpointSubscriptions, func(c echo.Context) error {
+		return subscriptionsHandler(c, n)
+	})
+
+	e.POST(endpointAnnounceBlock, func(c echo.Context) error {
+		return announceBlockHandler(c, n)
+	})
+
+	e.POST(endpointAnnounceTx, func(c echo.Context) error {
+		return announceTxHandler(c, n)
+	})
+
+	e.GET(endpointPendingTx, func(c echo.Context) error {
+		return pendingTxHandler(c, n)
+	})
+
+	e.POST(endpointAddPeer, func(c echo.Context) error {
 		return addPeerHandler(c, n)
 	})
 
@@ -216,50 +437,100 @@ func (n *Node) serveHttp(ctx context.Context, isSSLDisabled bool, sslEmail strin
 		return transactionsHandler(c, n)
 	})
 
-	if isSSLDisabled {
-		server := &http.Server{Addr: fmt.Sprintf(":%d", n.info.Port), Handler: e}
+	e.GET(endpointMiningWork, func(c echo.Context) error {
+		return miningWorkHandler(c, n)
+	})
 
-		go func() {
-			<-ctx.Done()
-			_ = server.Close()
-		}()
+	e.POST(endpointMiningSubmit, func(c echo.Context) error {
+		return miningSubmitHandler(c, n)
+	})
 
-		err := server.ListenAndServe()
-		// This shouldn't be an error!
-		if err != http.ErrServerClosed {
-			panic(err)
-		}
+	e.GET(endpointMiningStats, func(c echo.Context) error {
+		return miningStatsHandler(c, n)
+	})
 
-		return nil
+	adminAuth := n.adminAuthMiddlewares()
+
+	e.POST(endpointAdminMiningStart, func(c echo.Context) error {
+		return miningStartHandler(c, n)
+	}, adminAuth...)
 
-	} else {
+	e.POST(endpointAdminMiningStop, func(c echo.Context) error {
+		return miningStopHandler(c, n)
+	}, adminAuth...)
 
-		certmagic.DefaultACME.Email = sslEmail
+	e.POST(endpointAdminMiningMiner, func(c echo.Context) error {
+		return miningMinerHandler(c, n)
+	}, adminAuth...)
 
-		return certmagic.HTTPS([]string{n.info.IP}, e)
+	e.GET(endpointPoASigners, func(c echo.Context) error {
+		return poaSignersHandler(c, n)
+	})
+
+	e.POST(endpointPoAPropose, func(c echo.Context) error {
+		return poaProposeHandler(c, n)
+	}, adminAuth...)
+
+	e.POST(endpointPoADiscard, func(c echo.Context) error {
+		return poaDiscardHandler(c, n)
+	}, adminAuth...)
+
+	return e
+}
+
+// adminAuthMiddlewares requires the admin token as bearer token, or a loopback caller if no token is configured.
+func (n *Node) adminAuthMiddlewares() []echo.MiddlewareFunc {
+	if n.adminToken == "" {
+		return []echo.MiddlewareFunc{loopbackOnly}
+	}
+
+	return []echo.MiddlewareFunc{
+		middleware.KeyAuth(func(key string, c echo.Context) (bool, error) {
+			return subtle.ConstantTimeCompare([]byte(key), []byte(n.adminToken)) == 1, nil
+		}),
 	}
 }
 
-func (n *Node) mine(ctx context.Context) error {
-	var miningCtx context.Context
-	var stopCurrentMining context.CancelFunc
+// loopbackOnly rejects the requests not coming from the node's host, forwarded ones included.
+func loopbackOnly(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		host, _, err := net.SplitHostPort(c.Request().RemoteAddr)
+		ip := net.ParseIP(host)
+
+		if err != nil || ip == nil || !ip.IsLoopback() || c.Request().Header.Get(echo.HeaderXForwardedFor) != "" {
+			return c.JSON(http.StatusForbidden, ErrRes{"admin endpoints accept local requests only, unless an admin token is configured"})
+		}
+
+		return next(c)
+	}
+}
 
+func (n *Node) mine(ctx context.Context) error {
 	ticker := time.NewTicker(time.Second * miningIntervalSeconds)
 
 	for {
 		select {
 		case <-ticker.C:
+			if !n.IsMiningEnabled() {
+				continue
+			}
+
+			n.runWg.Add(1)
 			go func() {
+				defer n.runWg.Done()
 
 				if !n.IsMining() {
 					n.setMining(true)
 
-					miningCtx, stopCurrentMining = context.WithCancel(ctx)
+					miningCtx, stopCurrentMining := context.WithCancel(ctx)
+					n.setStopCurrentMining(stopCurrentMining)
+
 					err := n.minePendingTXs(miningCtx)
 					if err != nil {
 						fmt.Printf("ERROR: %s\n", err)
 					}
 
+					stopCurrentMining()
 					n.setMining(false)
 				}
 			}()
@@ -269,8 +540,12 @@ func (n *Node) mine(ctx context.Context) error {
 				blockHash, _ := block.Hash()
 				fmt.Printf("\nPeer mined next Block '%s' faster :(\n", blockHash.Hex())
 
+				n.miningLock.Lock()
+				n.miningStats.blocksLost++
+				n.miningLock.Unlock()
+
 				n.removeMinedPendingTXs(block)
-				stopCurrentMining()
+				n.cancelCurrentMining()
 			}
 
 		case <-ctx.Done():
@@ -280,19 +555,45 @@ func (n *Node) mine(ctx context.Context) error {
 	}
 }
 
-func (n *Node) minePendingTXs(ctx context.Context) error {
+// notifySyncedBlock lets the mining loop drop the block it's mining in favour of the synced one.
+// It doesn't wait for the loop once the node stops, the loop doesn't read anymore.
+func (n *Node) notifySyncedBlock(block database.Block) {
+	select {
+	case n.newSyncedBlocks <- block:
+	case <-n.runCtx.Done():
+	}
+}
 
-	difficulty := n.miningDifficulty
+func (n *Node) minePendingTXs(ctx context.Context) error {
 
+	// The template is built on a consistent latest block and difficulty, the sync may add blocks meanwhile
+	n.chainLock.RLock()
 	blockToMine := NewPendingBlock(
 		n.state.LatestBlockHash(),
 		n.state.NextBlockNumber(),
-		n.info.Account,
-		difficulty,
-		n.getPendingTXsAsArray(),
+		n.Miner(),
+		n.miningDifficulty,
+		n.mempool.Pending(),
 	)
 
-	minedBlock, err := Mine(ctx, blockToMine)
+	block := blockToMine.Block()
+
+	err := n.engine.Prepare(n.state, &block.Header)
+	n.chainLock.RUnlock()
+
+	if errors.Is(err, poa.ErrUnauthorizedSigner) {
+		// Not our business to seal blocks on this network
+		return nil
+	}
+	if errors.Is(err, poa.ErrRecentlySigned) {
+		// Tried again on the next tick, once the other signers sealed their blocks
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	minedBlock, err := n.engine.Seal(ctx, block)
 	if err != nil {
 		return err
 	}
@@ -304,116 +605,128 @@ func (n *Node) minePendingTXs(ctx context.Context) error {
 		return err
 	}
 
+	n.miningLock.Lock()
+	n.miningStats.blocksFound++
+	n.miningLock.Unlock()
+
+	n.announceBlock(minedBlock, n.info)
+
 	return nil
 }
 
 func (n *Node) removeMinedPendingTXs(block database.Block) {
 
-	if len(block.TXs) > 0 && len(n.pendingTXs) > 0 {
+	if pending, _ := n.mempool.Count(); len(block.TXs) > 0 && pending > 0 {
 		fmt.Println("Updating in-memory Pending TXs Pool:")
 	}
 
 	for _, tx := range block.TXs {
 		txHash, _ := tx.Hash()
-		if _, exists := n.pendingTXs[txHash.Hex()]; exists {
+		if n.mempool.Remove(txHash) {
 			fmt.Printf("\t-archiving mined TX: %s\n", txHash.Hex())
-
-			n.archivedTXs[txHash.Hex()] = tx
-			delete(n.pendingTXs, txHash.Hex())
 		}
 	}
 }
 
 func (n *Node) setMining(value bool) {
+	n.miningLock.Lock()
+	defer n.miningLock.Unlock()
+
 	n.isMining = value
 }
 
+// CheckDifficulty retargets the mining difficulty on top of the latest block.
+//
+// The caller must hold the chainLock once the node is running.
 func (n *Node) CheckDifficulty() error {
 
-	if n.state.LatestBlock().Header.Number%uint64(database.BlockNumberToCheckDifficulty) == 0 {
-		difficulty, err := n.GetNewDifficulty()
-		if err != nil {
-			return err
-		}
+	difficulty, err := n.engine.CalcDifficulty(n.state, n.miningDifficulty)
+	if err != nil {
+		return err
+	}
+
+	if difficulty != n.miningDifficulty {
 		n.ChangeMiningDifficulty(difficulty)
 	}
 
 	return nil
 }
 
-func (n *Node) GetAproximateBlockResolutionTime() (time.Duration, error) {
+func (n *Node) ChangeMiningDifficulty(newDifficulty uint64) {
+	n.miningDifficulty = newDifficulty
+	fmt.Printf("Change mining difficulty to: %d\n", newDifficulty)
+}
 
-	blocks, err := database.GetBlocksBefore(n.LatestBlockHash(), database.BlockNumberToCheckDifficulty, n.dataDir)
-	if err != nil {
-		return 0, err
+// AddPeer adds the peer to the known peers and the peer book, unless it's banned.
+func (n *Node) AddPeer(peer PeerNode) {
+	if n.peerBook.isBanned(peer, time.Now()) {
+		return
 	}
 
-	// diff time beetween first and last block mined in blocks slice
-
-	if len(blocks) == 0 {
-		return 0, nil
+	n.peersLock.Lock()
+	// The peer was known by its address only, until the handshake revealed its node ID
+	if addrPeer, ok := n.knownPeers[peer.TcpAddress()]; ok && peer.ID != "" {
+		delete(n.knownPeers, peer.TcpAddress())
+		n.peerBook.rename(addrPeer, peer)
 	}
+	n.knownPeers[peer.Key()] = peer
+	n.peersLock.Unlock()
 
-	firstBlock := blocks[0]
-	lastBlock := blocks[len(blocks)-1]
-
-	firstBlockTime := time.Unix(int64(firstBlock.Value.Header.Time), 0)
-	lastBlockTime := time.Unix(int64(lastBlock.Value.Header.Time), 0)
+	n.peerBook.add(peer)
+}
 
-	diff := lastBlockTime.Sub(firstBlockTime)
+func (n *Node) RemovePeer(peer PeerNode) {
+	n.peersLock.Lock()
+	delete(n.knownPeers, peer.Key())
+	delete(n.inboundPeers, peer.Key())
+	n.peersLock.Unlock()
 
-	return diff / time.Duration(len(blocks)), nil
+	n.peerBook.remove(peer)
 }
 
-func (n *Node) GetNewDifficulty() (uint64, error) {
+// KnownPeers returns a copy of the known peers, safe to iterate while peers come and go.
+func (n *Node) KnownPeers() map[string]PeerNode {
+	n.peersLock.RLock()
+	defer n.peersLock.RUnlock()
 
-	if n.miningDifficulty == 0 {
-		return 0, errors.New("mining difficulty is 0")
+	peers := make(map[string]PeerNode, len(n.knownPeers))
+	for addr, peer := range n.knownPeers {
+		peers[addr] = peer
 	}
 
-	average, err := n.GetAproximateBlockResolutionTime()
-	if err != nil {
-		return 0, err
-	}
+	return peers
+}
 
-	if average == 0 {
-		return n.miningDifficulty, nil
+func (n *Node) IsKnownPeer(peer PeerNode) bool {
+	if n.isSelf(peer) {
+		return true
 	}
 
-	if average < database.MiningAproxTime {
-		return (n.miningDifficulty + 1), nil
-	} else if average > database.MiningAproxTime {
-		return (n.miningDifficulty - 1), nil
-	} else {
-		return n.miningDifficulty, nil
+	if peer.ID != "" && peer.ID == n.info.ID {
+		return true
 	}
-}
-
-func (n *Node) ChangeMiningDifficulty(newDifficulty uint64) {
-	n.miningDifficulty = newDifficulty
-	n.state.ChangeMiningDifficulty(newDifficulty)
-	fmt.Printf("Change mining difficulty to: %d\n", newDifficulty)
-}
 
-func (n *Node) AddPeer(peer PeerNode) {
-	n.knownPeers[peer.TcpAddress()] = peer
-}
+	n.peersLock.RLock()
+	defer n.peersLock.RUnlock()
 
-func (n *Node) RemovePeer(peer PeerNode) {
-	delete(n.knownPeers, peer.TcpAddress())
-}
-
-func (n *Node) IsKnownPeer(peer PeerNode) bool {
-	if peer.IP == n.info.IP && peer.Port == n.info.Port {
+	if _, isKnownPeer := n.knownPeers[peer.Key()]; isKnownPeer {
 		return true
 	}
 
-	_, isKnownPeer := n.knownPeers[peer.TcpAddress()]
+	// Peers may be known by node ID while others still refer to them by address
+	for _, knownPeer := range n.knownPeers {
+		if knownPeer.TcpAddress() == peer.TcpAddress() {
+			return true
+		}
+	}
 
-	return isKnownPeer
+	return false
 }
 
 func (n *Node) IsMining() bool {
+	n.miningLock.Lock()
+	defer n.miningLock.Unlock()
+
 	return n.isMining
 }
 
@@ -428,25 +741,24 @@ func (n *Node) AddPendingTX(tx database.SignedTx, fromPeer PeerNode) error {
 		return err
 	}
 
-	_, isAlreadyPending := n.pendingTXs[txHash.Hex()]
-	_, isArchived := n.archivedTXs[txHash.Hex()]
+	// Mined, replaced or expired TXs relayed again by the peers don't come back
+	if !n.mempool.Has(txHash) && !n.mempool.Recent(txHash) {
 
-	for _, pendingTx := range n.pendingTXs {
-		if tx.From.Hash() == pendingTx.From.Hash() && pendingTx.Nonce == tx.Nonce {
-			return fmt.Errorf("TX with same nonce already pending")
-		}
-	}
-
-	if !isAlreadyPending && !isArchived {
-
-		err = n.validateTxBeforeAddingToMempool(tx)
+		replaced, err := n.mempool.Add(tx)
 		if err != nil {
 			return err
 		}
 
 		fmt.Printf("Added Pending TX %s from Peer %s\n", txJson, fromPeer.TcpAddress())
-		n.pendingTXs[txHash.Hex()] = tx
-		n.newPendingTXs <- tx
+
+		n.events.publish(event{kind: EventPendingTx, txHash: txHash, tx: tx})
+
+		if replaced != nil {
+			replacedHash, _ := replaced.Hash()
+			fmt.Printf("\t-replacing Pending TX %s, fee %d TBB -> %d TBB\n", replacedHash.Hex(), replaced.EffectiveFee(), tx.EffectiveFee())
+		}
+
+		n.announceTx(tx, txHash, fromPeer)
 	}
 
 	return nil
@@ -455,18 +767,18 @@ func (n *Node) AddPendingTX(tx database.SignedTx, fromPeer PeerNode) error {
 // addBlock is a wrapper around the n.state.AddBlock() to have a single function for changing the main state
 // from the Node perspective, so we can also reset the pending state in the same time.
 func (n *Node) addBlock(block database.Block) error {
+	n.chainLock.Lock()
+	defer n.chainLock.Unlock()
 
-	defer func() {
-		// Reset the pending state
-		pendingState := n.state.Copy()
-		n.pendingState = &pendingState
-	}()
+	defer n.resetMempool()
 
-	_, err := n.state.AddBlock(block)
+	hash, err := n.state.AddBlock(block)
 	if err != nil {
 		return err
 	}
 
+	n.events.publish(event{kind: EventNewHead, block: database.BlockFS{Key: hash, Value: block}})
+
 	if err := n.CheckDifficulty(); err != nil {
 		fmt.Printf("Error checking difficulty: %s\n", err)
 	}
@@ -476,94 +788,49 @@ func (n *Node) addBlock(block database.Block) error {
 
 // resetChain is a wrapper around the n.state.ResetChain() to have a single function for changing the main state
 func (n *Node) resetChain() error {
+	n.chainLock.Lock()
+	defer n.chainLock.Unlock()
 
-	n.state.ResetChain(n.dataDir)
-	pendingState := n.state.Copy()
-	n.pendingState = &pendingState
-
-	return nil
-}
-
-// validateTxBeforeAddingToMempool ensures the TX is authentic, with correct nonce, and the sender has sufficient
-// funds so we waste PoW resources on TX we can tell in advance are wrong.
-func (n *Node) validateTxBeforeAddingToMempool(tx database.SignedTx) error {
-	return database.ApplyTx(tx, n.pendingState)
-}
-
-func (n *Node) getPendingTXsAsArray() []database.SignedTx {
-	txs := make([]database.SignedTx, len(n.pendingTXs))
-
-	i := 0
-	for _, tx := range n.pendingTXs {
-		txs[i] = tx
-		i++
-	}
+	oldHead, oldNumber := n.state.LatestBlockHash(), n.state.LatestBlock().Header.Number
 
-	sort.Slice(txs, func(i, j int) bool {
-		return txs[i].Nonce < txs[j].Nonce
-	})
-
-	return txs
-}
-
-func (n *Node) GetPendingTXsExtendedAsArrayByAccount(acc common.Address) ([]database.SignedTxExtended, error) {
-	txs := make([]database.SignedTxExtended, 0)
+	n.state.ResetChain(n.dataDir)
+	n.resetMempool()
 
-	for _, tx := range n.pendingTXs {
-		if tx.From == acc {
-			txExtended, err := database.NewSignedTxExtended(tx, database.Block{})
-			if err != nil {
-				return nil, err
-			}
-			txs = append(txs, txExtended)
-		}
+	if !oldHead.IsEmpty() {
+		n.events.publish(event{kind: EventReorg, reorg: ReorgRes{OldHead: oldHead, OldNumber: oldNumber}})
 	}
 
-	return txs, nil
+	return nil
 }
 
-func (n *Node) GetTxsByAccountAndType(account common.Address, txType string, last int) ([]database.SignedTxExtended, error) {
+// rewindChain is a wrapper around the n.state.RewindTo() to have a single function for changing the main state
+func (n *Node) rewindChain(number uint64) error {
+	n.chainLock.Lock()
+	defer n.chainLock.Unlock()
 
-	txs := make([]database.SignedTxExtended, 0)
-	count := 0
+	oldHead, oldNumber := n.state.LatestBlockHash(), n.state.LatestBlock().Header.Number
 
-	blocks, err := database.GetBlocksBefore(n.LatestBlockHash(), int64(n.state.LatestBlock().Header.Number), n.dataDir)
+	err := n.state.RewindTo(number)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-loopBlocks:
-	for _, block := range blocks {
-
-		for _, tx := range block.Value.TXs {
-
-			switch txType {
-			case "in":
-				if tx.To == account {
-					txExtended, err := database.NewSignedTxExtended(tx, block.Value)
-					if err != nil {
-						return nil, err
-					}
-					txs = append(txs, txExtended)
-					count++
-
-				}
-			case "out":
-				if tx.From == account {
-					txExtended, err := database.NewSignedTxExtended(tx, block.Value)
-					if err != nil {
-						return nil, err
-					}
-					txs = append(txs, txExtended)
-					count++
-				}
-			}
+	n.resetMempool()
 
-			if last > 0 && count >= last {
-				break loopBlocks
-			}
-		}
+	if n.state.LatestBlockHash() != oldHead {
+		n.events.publish(event{kind: EventReorg, reorg: ReorgRes{
+			OldHead:   oldHead,
+			OldNumber: oldNumber,
+			NewHead:   n.state.LatestBlockHash(),
+			NewNumber: n.state.LatestBlock().Header.Number,
+		}})
 	}
 
-	return txs, nil
+	return nil
+}
+
+// resetMempool re-validates the pending TXs against a copy of the state, the mined ones are dropped.
+func (n *Node) resetMempool() {
+	state := n.state.Copy()
+	n.mempool.Reset(&state)
 }
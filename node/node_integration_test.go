@@ -30,6 +30,7 @@ import (
 
 	"github.com/IacopoMelani/the-blockchain-pub/database"
 	"github.com/IacopoMelani/the-blockchain-pub/fs"
+	"github.com/IacopoMelani/the-blockchain-pub/mempool"
 	"github.com/IacopoMelani/the-blockchain-pub/wallet"
 )
 
@@ -315,7 +316,8 @@ func TestNode_ReplayedTx(t *testing.T) {
 				// Execute the attack by replaying the TX again!
 				if !wasReplayedTxAdded {
 					// Simulate the TX was submitted to different node
-					n.archivedTXs = make(map[string]database.SignedTx)
+					n.SetMempoolConfig(mempool.DefaultConfig)
+					n.resetMempool()
 					// Execute the attack
 					err = n.AddPendingTX(signedTx, babaYagaPeerNode)
 					t.Log(err)
@@ -399,7 +401,7 @@ func TestNode_MiningStopsOnNewSyncedBlock(t *testing.T) {
 	)
 
 	// Start mining with a high mining difficulty, just to be slow on purpose and let a synced block arrive first
-	n := New(dataDir, nInfo.IP, nInfo.Port, babaYaga, nInfo, nodeVersion, uint64(5))
+	n := New(dataDir, nInfo.IP, nInfo.Port, babaYaga, nInfo, nodeVersion, uint64(1<<40))
 
 	// Allow the test to run for 30 mins, in the worst case
 	ctx, closeNode := context.WithTimeout(context.Background(), time.Minute*30)
@@ -482,9 +484,9 @@ func TestNode_MiningStopsOnNewSyncedBlock(t *testing.T) {
 		}
 
 		// Mined TX1 by Andrej should be removed from the Mempool
-		_, onlyTX2IsPending := n.pendingTXs[tx2Hash.Hex()]
+		onlyTX2IsPending := n.mempool.Has(tx2Hash)
 
-		if len(n.pendingTXs) != 1 && !onlyTX2IsPending {
+		if pending, _ := n.mempool.Count(); pending != 1 && !onlyTX2IsPending {
 			errs <- errors.New("synced block should have canceled mining of already mined TX")
 			return
 		}
@@ -543,7 +545,7 @@ func TestNode_MiningStopsOnNewSyncedBlock(t *testing.T) {
 		t.Fatal("was suppose to mine 2 pending TX into 2 valid blocks under 30m")
 	}
 
-	if len(n.pendingTXs) != 0 {
+	if pending, queued := n.mempool.Count(); pending+queued != 0 {
 		t.Fatal("no pending TXs should be left to mine")
 	}
 
@@ -0,0 +1,254 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package node
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/IacopoMelani/the-blockchain-pub/consensus/pow"
+	"github.com/IacopoMelani/the-blockchain-pub/database"
+)
+
+// Max number of blocks waiting for their parent, the oldest one is dropped to make room
+const maxOrphanBlocks = 256
+
+// Max number of orphans sent by the same peer, its oldest one is dropped to make room
+// so a peer pushing blocks that never connect can't evict the orphans of the others
+const maxOrphansPerPeer = 32
+
+// How long a block waits for its parent before being dropped
+const orphanBlockLifetime = 10 * time.Minute
+
+type orphanBlock struct {
+	hash    database.Hash
+	block   database.Block
+	peer    PeerNode
+	addedAt time.Time
+}
+
+// orphanPool holds the blocks received before their parent, keyed by the parent hash.
+type orphanPool struct {
+	blocks   map[database.Hash]orphanBlock
+	byParent map[database.Hash][]database.Hash
+	lock     sync.Mutex
+}
+
+func newOrphanPool() *orphanPool {
+	return &orphanPool{
+		blocks:   make(map[database.Hash]orphanBlock),
+		byParent: make(map[database.Hash][]database.Hash),
+	}
+}
+
+// add stores the block until its parent arrives and reports whether it wasn't known yet.
+func (p *orphanPool) add(orphan orphanBlock) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if _, ok := p.blocks[orphan.hash]; ok {
+		return false
+	}
+
+	fromPeer := func(o orphanBlock) bool { return o.peer.TcpAddress() == orphan.peer.TcpAddress() }
+	anyPeer := func(o orphanBlock) bool { return true }
+
+	if p.count(fromPeer) >= maxOrphansPerPeer {
+		p.remove(p.oldest(fromPeer).hash)
+	} else if len(p.blocks) >= maxOrphanBlocks {
+		p.remove(p.oldest(anyPeer).hash)
+	}
+
+	p.blocks[orphan.hash] = orphan
+	p.byParent[orphan.block.Header.Parent] = append(p.byParent[orphan.block.Header.Parent], orphan.hash)
+
+	return true
+}
+
+func (p *orphanPool) has(hash database.Hash) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	_, ok := p.blocks[hash]
+
+	return ok
+}
+
+func (p *orphanPool) len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return len(p.blocks)
+}
+
+// takeChildren removes and returns the blocks waiting for the parent.
+func (p *orphanPool) takeChildren(parent database.Hash) []orphanBlock {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	children := make([]orphanBlock, 0, len(p.byParent[parent]))
+	for _, hash := range p.byParent[parent] {
+		children = append(children, p.blocks[hash])
+		delete(p.blocks, hash)
+	}
+
+	delete(p.byParent, parent)
+
+	return children
+}
+
+// prune drops the blocks that can no longer be connected: the expired ones and the ones
+// not above the local chain, either already added or on a fork the node moved past.
+func (p *orphanPool) prune(latestNumber uint64, now time.Time) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	pruned := 0
+	for hash, o := range p.blocks {
+		if o.block.Header.Number <= latestNumber || now.Sub(o.addedAt) > orphanBlockLifetime {
+			p.remove(hash)
+			pruned++
+		}
+	}
+
+	return pruned
+}
+
+// roots returns the orphans whose parent is missing too, the ones to request from the peers.
+func (p *orphanPool) roots() []orphanBlock {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	roots := make([]orphanBlock, 0)
+	for _, o := range p.blocks {
+		if _, ok := p.blocks[o.block.Header.Parent]; !ok {
+			roots = append(roots, o)
+		}
+	}
+
+	return roots
+}
+
+func (p *orphanPool) count(match func(orphanBlock) bool) int {
+	count := 0
+	for _, o := range p.blocks {
+		if match(o) {
+			count++
+		}
+	}
+
+	return count
+}
+
+func (p *orphanPool) oldest(match func(orphanBlock) bool) orphanBlock {
+	oldest := orphanBlock{}
+	for _, o := range p.blocks {
+		if match(o) && (oldest.addedAt.IsZero() || o.addedAt.Before(oldest.addedAt)) {
+			oldest = o
+		}
+	}
+
+	return oldest
+}
+
+func (p *orphanPool) remove(hash database.Hash) {
+	o, ok := p.blocks[hash]
+	if !ok {
+		return
+	}
+
+	delete(p.blocks, hash)
+
+	siblings := p.byParent[o.block.Header.Parent]
+	for i, sibling := range siblings {
+		if sibling == hash {
+			siblings = append(siblings[:i], siblings[i+1:]...)
+			break
+		}
+	}
+
+	if len(siblings) == 0 {
+		delete(p.byParent, o.block.Header.Parent)
+	} else {
+		p.byParent[o.block.Header.Parent] = siblings
+	}
+}
+
+// addOrphan parks the block arrived before its parent and reports whether its missing
+// ancestors have to be requested, they don't if they are already waiting in the pool.
+//
+// The engine verifies the header on top of the parent state, missing until the block connects,
+// so only the Proof of Work is checked meanwhile, a block not worth its hash isn't parked.
+func (n *Node) addOrphan(peer PeerNode, hash database.Hash, block database.Block) (bool, error) {
+	if _, isPoW := n.engine.(*pow.PoW); isPoW && !pow.IsBlockHashValid(hash, block.Header.Difficulty) {
+		return false, fmt.Errorf("invalid orphan Block %d hash '%x' for difficulty %d", block.Header.Number, hash, block.Header.Difficulty)
+	}
+
+	if !n.orphans.add(orphanBlock{hash: hash, block: block, peer: peer, addedAt: time.Now()}) {
+		return false, nil
+	}
+
+	fmt.Printf("Block %d '%s' arrived before its parent, waiting for it\n", block.Header.Number, hash.Hex())
+
+	return !n.orphans.has(block.Header.Parent), nil
+}
+
+// connectOrphans adds the orphans extending the latest block, recursively, and returns them.
+//
+// The caller must hold the syncLock.
+func (n *Node) connectOrphans() []orphanBlock {
+	n.orphans.prune(n.state.LatestBlock().Header.Number, time.Now())
+
+	connected := make([]orphanBlock, 0)
+	for parents := []database.Hash{n.state.LatestBlockHash()}; len(parents) > 0; {
+		parent := parents[0]
+		parents = parents[1:]
+
+		for _, o := range n.orphans.takeChildren(parent) {
+			// A sibling got connected first
+			if n.state.LatestBlockHash() != parent {
+				continue
+			}
+
+			err := n.addBlock(o.block)
+			if err != nil {
+				n.penalizePeer(o.peer, PeerScoreInvalidBlock, err)
+				continue
+			}
+
+			fmt.Printf("Connected orphan Block %d '%s'\n", o.block.Header.Number, o.hash.Hex())
+
+			n.notifySyncedBlock(o.block)
+			connected = append(connected, o)
+			parents = append(parents, o.hash)
+		}
+	}
+
+	return connected
+}
+
+// requestOrphans drops the expired orphans and asks the peers that sent the remaining ones for their missing ancestors.
+func (n *Node) requestOrphans() {
+	n.orphans.prune(n.state.LatestBlock().Header.Number, time.Now())
+
+	for _, o := range n.orphans.roots() {
+		err := n.syncBlocks(o.peer, StatusRes{Hash: o.hash, Number: o.block.Header.Number})
+		if err != nil {
+			fmt.Printf("ERROR: unable to request the parent of orphan Block '%s' from Peer %s. %s\n", o.hash.Hex(), o.peer.TcpAddress(), err)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package node
+
+import (
+	"testing"
+	"time"
+
+	"github.com/IacopoMelani/the-blockchain-pub/database"
+	"github.com/IacopoMelani/the-blockchain-pub/fs"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestOrphanPool(t *testing.T) {
+	p := newOrphanPool()
+	now := time.Now()
+
+	parent := database.Hash{1}
+	first := orphanBlock{hash: database.Hash{2}, block: database.Block{Header: database.BlockHeader{Parent: parent, Number: 5}}, addedAt: now}
+	second := orphanBlock{hash: database.Hash{3}, block: database.Block{Header: database.BlockHeader{Parent: first.hash, Number: 6}}, addedAt: now}
+
+	if !p.add(first) || !p.add(second) || p.add(first) {
+		t.Fatal("expected each orphan to be added once")
+	}
+
+	if roots := p.roots(); len(roots) != 1 || roots[0].hash != first.hash {
+		t.Fatalf("expected only the first orphan to miss its parent, got %d roots", len(roots))
+	}
+
+	children := p.takeChildren(parent)
+	if len(children) != 1 || children[0].hash != first.hash || p.has(first.hash) {
+		t.Fatal("expected to take the first orphan out of the pool")
+	}
+
+	if p.prune(5, now) != 0 || p.prune(6, now) != 1 || p.len() != 0 {
+		t.Fatal("expected the orphans not above the latest block to be pruned")
+	}
+
+	p.add(first)
+	if p.prune(0, now.Add(orphanBlockLifetime+time.Second)) != 1 {
+		t.Fatal("expected the expired orphan to be pruned")
+	}
+
+	for i := 0; i < maxOrphanBlocks+1; i++ {
+		p.add(orphanBlock{
+			hash:    database.Hash{byte(i), byte(i >> 8), 1},
+			block:   database.Block{Header: database.BlockHeader{Parent: parent, Number: uint64(i)}},
+			peer:    NewPeerNode("127.0.0.1", uint64(i), false, common.Address{}, false, nodeVersion),
+			addedAt: now.Add(time.Duration(i) * time.Second),
+		})
+	}
+
+	if p.len() != maxOrphanBlocks || p.has(database.Hash{0, 0, 1}) {
+		t.Fatal("expected the oldest orphan to be dropped once the pool is full")
+	}
+}
+
+func TestOrphanPool_PeerLimit(t *testing.T) {
+	p := newOrphanPool()
+	now := time.Now()
+
+	honest := orphanBlock{
+		hash:    database.Hash{1},
+		block:   database.Block{Header: database.BlockHeader{Parent: database.Hash{2}, Number: 5}},
+		peer:    NewPeerNode("127.0.0.1", 1, false, common.Address{}, false, nodeVersion),
+		addedAt: now,
+	}
+	p.add(honest)
+
+	spammer := NewPeerNode("127.0.0.2", 1, false, common.Address{}, false, nodeVersion)
+	for i := 0; i < maxOrphansPerPeer+1; i++ {
+		p.add(orphanBlock{
+			hash:    database.Hash{byte(i), 3},
+			block:   database.Block{Header: database.BlockHeader{Parent: database.Hash{byte(i), 4}, Number: uint64(i)}},
+			peer:    spammer,
+			addedAt: now.Add(time.Duration(i+1) * time.Second),
+		})
+	}
+
+	if p.len() != maxOrphansPerPeer+1 || p.has(database.Hash{0, 3}) {
+		t.Fatalf("expected the oldest orphan of the peer to be dropped once it reaches its limit, got %d orphans", p.len())
+	}
+
+	if !p.has(honest.hash) {
+		t.Fatal("expected the orphans of the other peers to be kept")
+	}
+}
+
+func TestNode_OrphanBlocks(t *testing.T) {
+	miner := database.NewAccount(testKsBabaYagaAccount)
+
+	source, sourceDataDir := newTestNode(t, miner)
+	defer fs.RemoveDir(sourceDataDir)
+	defer source.state.Close()
+
+	mineTestBlocks(t, source, miner, 4)
+
+	blocks, err := database.GetBlocksAfter(database.Hash{}, 4, sourceDataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, dataDir := newTestNode(t, miner)
+	defer fs.RemoveDir(dataDir)
+	defer n.state.Close()
+
+	go func() {
+		for range n.newSyncedBlocks {
+		}
+	}()
+
+	// Nothing listens on the peer, requesting the missing parents fails
+	peer := NewPeerNode("127.0.0.1", 1, false, common.Address{}, false, nodeVersion)
+
+	for _, i := range []int{0, 3, 2} {
+		n.handleNewBlock(peer, blocks[i])
+	}
+
+	if n.state.LatestBlockHash() != blocks[0].Key || n.orphans.len() != 2 {
+		t.Fatalf("expected Blocks 2 and 3 to wait for their parent, got %d orphans", n.orphans.len())
+	}
+
+	n.handleNewBlock(peer, blocks[1])
+
+	if n.state.LatestBlockHash() != blocks[3].Key {
+		t.Fatalf("expected the orphans to be connected up to Block 3, got Block %d", n.state.LatestBlock().Header.Number)
+	}
+
+	if n.orphans.len() != 0 {
+		t.Fatalf("expected no orphans left, got %d", n.orphans.len())
+	}
+}
+
+func TestNode_OrphanBlockInvalidPoW(t *testing.T) {
+	miner := database.NewAccount(testKsBabaYagaAccount)
+
+	n, dataDir := newTestNode(t, miner)
+	defer fs.RemoveDir(dataDir)
+	defer n.state.Close()
+
+	mineTestBlocks(t, n, miner, 1)
+
+	// Claims a difficulty its hash doesn't meet, to be parked for free
+	block := database.Block{Header: database.BlockHeader{
+		Parent:     database.Hash{1},
+		Number:     5,
+		Miner:      miner,
+		Difficulty: 1 << 62,
+	}}
+
+	hash, err := block.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer := NewPeerNode("127.0.0.1", 1, false, common.Address{}, false, nodeVersion)
+	n.handleNewBlock(peer, database.BlockFS{Key: hash, Value: block})
+
+	if n.orphans.len() != 0 {
+		t.Fatalf("expected the orphan without a valid Proof of Work to be rejected, got %d orphans", n.orphans.len())
+	}
+
+	if !n.peerBook.isBanned(peer, time.Now()) {
+		t.Fatal("expected the peer sending the invalid orphan to be banned")
+	}
+}
@@ -0,0 +1,542 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/IacopoMelani/the-blockchain-pub/database"
+	"github.com/IacopoMelani/the-blockchain-pub/mempool"
+	"github.com/IacopoMelani/the-blockchain-pub/p2p"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// Messages of the peer to peer protocol.
+//
+// Requests are RLP encoded, responses carrying blocks, headers or TXs are JSON encoded
+// as it's the encoding their hashes are computed over.
+const (
+	// Handshake → p2pStatusRes
+	statusMsg p2p.MsgCode = iota + 1
+	// p2pRangeReq → []database.HeaderFS
+	getHeadersMsg
+	// p2pRangeReq → []database.BlockFS
+	getBlocksMsg
+	// p2pBlockHashReq → p2pBlockHashRes
+	getBlockHashMsg
+	// database.BlockFS, notification
+	newBlockMsg
+	// database.SignedTx, notification
+	newTxMsg
+	// empty → empty
+	pingMsg
+	// p2pPageReq → MempoolTxsRes
+	getPendingTxsMsg
+)
+
+const p2pRequestTimeout = 30 * time.Second
+const p2pPingInterval = 15 * time.Second
+
+type p2pStatusRes struct {
+	Handshake Handshake `json:"handshake"`
+	Status    StatusRes `json:"status"`
+}
+
+type p2pRangeReq struct {
+	From database.Hash
+	Last uint64
+}
+
+type p2pBlockHashReq struct {
+	Number uint64
+}
+
+type p2pBlockHashRes struct {
+	Found bool
+	Hash  database.Hash
+}
+
+// SetP2P enables the peer to peer protocol on the TCP port, asking the peers to encrypt the connections if encrypt.
+func (n *Node) SetP2P(port uint64, encrypt bool) {
+	n.info.P2PPort = port
+	n.p2pEncrypt = encrypt
+}
+
+func (n *Node) p2pConfig() p2p.Config {
+	return p2p.Config{Key: n.nodeKey, Encrypt: n.p2pEncrypt, Handler: n.handleP2P}
+}
+
+// startP2P accepts the peers connecting to the address.
+func (n *Node) startP2P(addr string) error {
+	server, err := p2p.Listen(addr, n.p2pConfig(), func(p *p2p.Peer) error {
+		err := n.acceptInboundSession()
+		if err != nil {
+			return err
+		}
+
+		n.addP2PSession(p)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	n.p2pServer = server
+
+	fmt.Printf("Listening for p2p Peers on: %s\n", server.Addr())
+
+	return nil
+}
+
+// closeP2P stops accepting the peers and closes the open connections.
+func (n *Node) closeP2P() {
+	if n.p2pServer != nil {
+		n.p2pServer.Close()
+	}
+
+	n.p2pLock.Lock()
+	sessions := make([]*p2p.Peer, 0, len(n.p2pPeers))
+	for _, session := range n.p2pPeers {
+		sessions = append(sessions, session)
+	}
+	n.p2pLock.Unlock()
+
+	for _, session := range sessions {
+		session.Close()
+	}
+}
+
+// p2pSession returns the open connection to the peer, if any.
+func (n *Node) p2pSession(peer PeerNode) *p2p.Peer {
+	if peer.ID == "" {
+		return nil
+	}
+
+	n.p2pLock.Lock()
+	defer n.p2pLock.Unlock()
+
+	return n.p2pPeers[peer.ID]
+}
+
+// openP2PSession connects to the peer if it speaks the peer to peer protocol and isn't connected yet.
+func (n *Node) openP2PSession(peer PeerNode) (*p2p.Peer, error) {
+	if session := n.p2pSession(peer); session != nil {
+		return session, nil
+	}
+
+	if peer.P2PPort == 0 {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p2pRequestTimeout)
+	defer cancel()
+
+	session, err := p2p.Dial(ctx, fmt.Sprintf("%s:%d", peer.IP, peer.P2PPort), peer.ID, n.p2pConfig())
+	if err != nil {
+		return nil, err
+	}
+
+	reqBody, err := rlp.EncodeToBytes(n.handshake())
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	resBody, err := session.Request(ctx, statusMsg, reqBody)
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	res := p2pStatusRes{}
+	err = json.Unmarshal(resBody, &res)
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	err = n.checkP2PHandshake(session, res.Handshake)
+	if err != nil {
+		session.Close()
+		n.penalizePeer(peer, PeerScoreIncompatible, err)
+		return nil, err
+	}
+
+	n.addP2PSession(session)
+
+	fmt.Printf("Connected to p2p Peer %s (encrypted: %t)\n", session.ID(), session.Encrypted())
+
+	return session, nil
+}
+
+func (n *Node) addP2PSession(session *p2p.Peer) {
+	n.p2pLock.Lock()
+	if old, ok := n.p2pPeers[session.ID()]; ok && old != session {
+		old.Close()
+	}
+	n.p2pPeers[session.ID()] = session
+	n.p2pLock.Unlock()
+
+	go n.keepAlive(session)
+}
+
+// keepAlive pings the peer and forgets the connection once closed.
+func (n *Node) keepAlive(session *p2p.Peer) {
+	ticker := time.NewTicker(p2pPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), p2pRequestTimeout)
+			_, err := session.Request(ctx, pingMsg, nil)
+			cancel()
+
+			if err != nil {
+				fmt.Printf("ERROR: p2p Peer %s is unresponsive. %s\n", session.ID(), err)
+				session.Close()
+			}
+
+		case <-session.Done():
+			n.p2pLock.Lock()
+			if n.p2pPeers[session.ID()] == session {
+				delete(n.p2pPeers, session.ID())
+			}
+			n.p2pLock.Unlock()
+
+			return
+		}
+	}
+}
+
+// checkP2PHandshake verifies the peer's handshake and that it comes from the node authenticated by the connection.
+func (n *Node) checkP2PHandshake(session *p2p.Peer, h Handshake) error {
+	err := n.checkHandshake(h)
+	if err != nil {
+		return err
+	}
+
+	if h.Peer.ID != session.ID() {
+		return fmt.Errorf("handshake of node %s sent by node %s", h.Peer.ID, session.ID())
+	}
+
+	return nil
+}
+
+// sessionPeer returns the known peer behind the connection.
+func (n *Node) sessionPeer(session *p2p.Peer) PeerNode {
+	peer, ok := n.KnownPeers()[session.ID()]
+	if !ok {
+		peer.ID = session.ID()
+	}
+
+	return peer
+}
+
+// handleP2P serves the messages of the peer to peer protocol.
+func (n *Node) handleP2P(session *p2p.Peer, code p2p.MsgCode, payload []byte) ([]byte, error) {
+	switch code {
+	case statusMsg:
+		h := Handshake{}
+		err := rlp.DecodeBytes(payload, &h)
+		if err != nil {
+			return nil, err
+		}
+
+		err = n.checkP2PHandshake(session, h)
+		if err != nil {
+			go session.Close()
+			return nil, err
+		}
+
+		if n.peerBook.isBanned(h.Peer, time.Now()) {
+			go session.Close()
+			return nil, fmt.Errorf("peer '%s' is banned", h.Peer.TcpAddress())
+		}
+
+		peer := h.Peer
+		peer.IsBootstrap = false
+		peer.connected = true
+		n.AddPeer(peer)
+
+		return json.Marshal(p2pStatusRes{Handshake: n.handshake(), Status: n.status()})
+
+	case getHeadersMsg:
+		req := p2pRangeReq{}
+		err := rlp.DecodeBytes(payload, &req)
+		if err != nil {
+			return nil, err
+		}
+
+		if req.Last == 0 || req.Last > maxHeadersPerRequest {
+			req.Last = maxHeadersPerRequest
+		}
+
+		headers, err := database.GetHeadersAfter(req.From, int64(req.Last), n.dataDir)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(headers)
+
+	case getBlocksMsg:
+		req := p2pRangeReq{}
+		err := rlp.DecodeBytes(payload, &req)
+		if err != nil {
+			return nil, err
+		}
+
+		if req.Last == 0 || req.Last > uint64(maxBlocksPerRequest) {
+			req.Last = uint64(maxBlocksPerRequest)
+		}
+
+		blocks, err := database.GetBlocksAfter(req.From, int64(req.Last), n.dataDir)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(blocks)
+
+	case getBlockHashMsg:
+		req := p2pBlockHashReq{}
+		err := rlp.DecodeBytes(payload, &req)
+		if err != nil {
+			return nil, err
+		}
+
+		hash, found := n.state.BlockHash(req.Number)
+
+		return rlp.EncodeToBytes(p2pBlockHashRes{Found: found, Hash: hash})
+
+	case newBlockMsg:
+		blockFs := database.BlockFS{}
+		err := json.Unmarshal(payload, &blockFs)
+		if err != nil {
+			return nil, err
+		}
+
+		n.handleNewBlock(n.sessionPeer(session), blockFs)
+
+		return nil, nil
+
+	case newTxMsg:
+		tx := database.SignedTx{}
+		err := json.Unmarshal(payload, &tx)
+		if err != nil {
+			return nil, err
+		}
+
+		n.handleNewTx(n.sessionPeer(session), tx)
+
+		return nil, nil
+
+	case pingMsg:
+		return nil, nil
+
+	case getPendingTxsMsg:
+		req := p2pPageReq{}
+		err := rlp.DecodeBytes(payload, &req)
+		if err != nil {
+			return nil, err
+		}
+
+		if req.Limit == 0 || req.Limit > maxMempoolTxsPerRequest {
+			req.Limit = maxMempoolTxsPerRequest
+		}
+
+		return json.Marshal(n.mempoolTxs(mempool.Filter{Status: mempool.StatusPending}, int(req.Offset), int(req.Limit)))
+	}
+
+	return nil, fmt.Errorf("unknown message 0x%x", code)
+}
+
+// handleNewBlock adds the pushed block if it extends the local chain, otherwise parks it
+// until its parent arrives and syncs up to it.
+func (n *Node) handleNewBlock(peer PeerNode, blockFs database.BlockFS) {
+	hash, err := blockFs.Value.Hash()
+	if err != nil || hash != blockFs.Key {
+		n.penalizePeer(peer, PeerScoreInvalidBlock, fmt.Errorf("block '%x' doesn't match its hash", blockFs.Key))
+		return
+	}
+
+	if n.markSeen(hash) {
+		return
+	}
+
+	block := blockFs.Value
+	if block.Header.Number <= n.state.LatestBlock().Header.Number && !n.state.LatestBlockHash().IsEmpty() {
+		return
+	}
+
+	requestParent := false
+
+	n.syncLock.Lock()
+	isNext := block.Header.Parent == n.state.LatestBlockHash() && block.Header.Number == n.state.NextBlockNumber()
+	if isNext {
+		err = n.addBlock(block)
+	} else {
+		requestParent, err = n.addOrphan(peer, hash, block)
+	}
+	n.syncLock.Unlock()
+
+	if err != nil {
+		n.penalizePeer(peer, PeerScoreInvalidBlock, err)
+		return
+	}
+
+	if !isNext {
+		// The missing ancestors are already requested
+		if !requestParent {
+			return
+		}
+
+		err = n.syncBlocks(peer, StatusRes{Hash: hash, Number: block.Header.Number})
+		if err != nil {
+			fmt.Printf("ERROR: %s\n", err)
+		}
+
+		if n.state.LatestBlockHash() == hash {
+			n.announceBlock(block, peer)
+		}
+
+		return
+	}
+
+	n.notifySyncedBlock(block)
+	n.announceBlock(block, peer)
+
+	n.syncLock.Lock()
+	connected := n.connectOrphans()
+	n.syncLock.Unlock()
+
+	for _, o := range connected {
+		n.announceBlock(o.block, o.peer)
+	}
+}
+
+// handleNewTx adds the pushed TX to the pending TXs.
+func (n *Node) handleNewTx(peer PeerNode, tx database.SignedTx) {
+	hash, err := tx.Hash()
+	if err != nil {
+		return
+	}
+
+	if n.markSeen(hash) {
+		return
+	}
+
+	err = n.checkPeerTx(peer, tx)
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		return
+	}
+
+	err = n.AddPendingTX(tx, peer)
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+	}
+}
+
+func (n *Node) p2pRequest(session *p2p.Peer, code p2p.MsgCode, req interface{}) ([]byte, error) {
+	reqBody, err := rlp.EncodeToBytes(req)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p2pRequestTimeout)
+	defer cancel()
+
+	return session.Request(ctx, code, reqBody)
+}
+
+// peerStatus queries the peer's status, connecting to its p2p port if it has one and falling back to HTTP otherwise.
+func (n *Node) peerStatus(peer PeerNode) (StatusRes, error) {
+	session, err := n.openP2PSession(peer)
+	if err != nil {
+		fmt.Printf("ERROR: unable to connect to p2p Peer %s. %s\n", peer.TcpAddress(), err)
+	}
+
+	if session == nil {
+		return queryPeerStatus(peer)
+	}
+
+	resBody, err := n.p2pRequest(session, statusMsg, n.handshake())
+	if err != nil {
+		return StatusRes{}, err
+	}
+
+	res := p2pStatusRes{}
+	err = json.Unmarshal(resBody, &res)
+	if err != nil {
+		return StatusRes{}, err
+	}
+
+	return res.Status, nil
+}
+
+func (n *Node) peerHeaders(peer PeerNode, from database.Hash) ([]database.HeaderFS, error) {
+	session := n.p2pSession(peer)
+	if session == nil {
+		return fetchHeadersFromPeer(peer, from)
+	}
+
+	resBody, err := n.p2pRequest(session, getHeadersMsg, p2pRangeReq{From: from, Last: maxHeadersPerRequest})
+	if err != nil {
+		return nil, err
+	}
+
+	headers := make([]database.HeaderFS, 0)
+	err = json.Unmarshal(resBody, &headers)
+
+	return headers, err
+}
+
+func (n *Node) peerBlocks(peer PeerNode, from database.Hash, last int) ([]database.BlockFS, error) {
+	session := n.p2pSession(peer)
+	if session == nil {
+		return fetchBlocksFromPeer(peer, from, last)
+	}
+
+	resBody, err := n.p2pRequest(session, getBlocksMsg, p2pRangeReq{From: from, Last: uint64(last)})
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := make([]database.BlockFS, 0)
+	err = json.Unmarshal(resBody, &blocks)
+
+	return blocks, err
+}
+
+func (n *Node) peerBlockHash(peer PeerNode, number uint64) (database.Hash, bool, error) {
+	session := n.p2pSession(peer)
+	if session == nil {
+		return fetchBlockHashFromPeer(peer, number)
+	}
+
+	resBody, err := n.p2pRequest(session, getBlockHashMsg, p2pBlockHashReq{Number: number})
+	if err != nil {
+		return database.Hash{}, false, err
+	}
+
+	res := p2pBlockHashRes{}
+	err = rlp.DecodeBytes(resBody, &res)
+
+	return res.Hash, res.Found, err
+}
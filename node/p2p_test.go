@@ -0,0 +1,153 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package node
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/IacopoMelani/the-blockchain-pub/database"
+	"github.com/IacopoMelani/the-blockchain-pub/fs"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+func TestNode_P2PSync(t *testing.T) {
+	miner := database.NewAccount(testKsBabaYagaAccount)
+
+	source, sourceDataDir := newTestP2PNode(t, miner, 8085)
+	defer fs.RemoveDir(sourceDataDir)
+	defer source.state.Close()
+	source.miningDifficulty = 1 << 8
+
+	n, dataDir := newTestP2PNode(t, miner, 8086)
+	defer fs.RemoveDir(dataDir)
+	defer n.state.Close()
+	n.p2pEncrypt = true
+
+	synced := make(chan database.Block, 100)
+	go func() {
+		for block := range n.newSyncedBlocks {
+			synced <- block
+		}
+	}()
+
+	mineTestBlocks(t, source, miner, 10)
+
+	// The source doesn't serve HTTP, everything goes through the p2p connection
+	peer := NewPeerNode("127.0.0.1", 1, false, common.Address{}, false, nodeVersion)
+	peer.P2PPort = uint64(source.p2pServer.Addr().(*net.TCPAddr).Port)
+
+	status, err := n.peerStatus(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status.NodeID != source.info.ID {
+		t.Fatalf("expected status of node %s, got %s", source.info.ID, status.NodeID)
+	}
+
+	peer.ID = status.NodeID
+
+	session := n.p2pSession(peer)
+	if session == nil || !session.Encrypted() {
+		t.Fatal("an encrypted p2p connection is suppose to be open")
+	}
+
+	if !source.IsKnownPeer(n.info) {
+		t.Fatal("the p2p handshake is suppose to join the source's KnownPeers")
+	}
+
+	err = n.syncBlocks(peer, status)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n.state.LatestBlockHash() != source.state.LatestBlockHash() {
+		t.Fatalf("expected to sync up to block %d, got %d", status.Number, n.state.LatestBlock().Header.Number)
+	}
+
+	// New blocks are pushed over the connection
+	mineTestBlocks(t, source, miner, 1)
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case block := <-synced:
+			if block.Header.Number == source.state.LatestBlock().Header.Number {
+				return
+			}
+
+		case <-timeout:
+			t.Fatal("the new block was never pushed")
+		}
+	}
+}
+
+func newTestP2PNode(t *testing.T, miner common.Address, port uint64) (*Node, string) {
+	n, dataDir := newTestNode(t, miner)
+	n.info.Port = port
+
+	err := n.loadGenesis()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = n.startP2P("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { n.p2pServer.Close() })
+
+	n.info.P2PPort = uint64(n.p2pServer.Addr().(*net.TCPAddr).Port)
+
+	return n, dataDir
+}
+
+func TestNode_P2PGetBlocksLimit(t *testing.T) {
+	n, dataDir := newTestNode(t, common.Address{})
+	defer fs.RemoveDir(dataDir)
+	defer n.state.Close()
+
+	mineTestBlocks(t, n, common.Address{}, 3)
+
+	defer func(max int) { maxBlocksPerRequest = max }(maxBlocksPerRequest)
+	maxBlocksPerRequest = 2
+
+	for _, last := range []uint64{0, 3} {
+		payload, err := rlp.EncodeToBytes(p2pRangeReq{From: database.Hash{}, Last: last})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := n.handleP2P(nil, getBlocksMsg, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		blocks := make([]database.BlockFS, 0)
+		err = json.Unmarshal(res, &blocks)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(blocks) != maxBlocksPerRequest {
+			t.Fatalf("expected %d blocks for last %d, got %d", maxBlocksPerRequest, last, len(blocks))
+		}
+	}
+}
@@ -0,0 +1,369 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const peerBookFile = "peers.json"
+
+const (
+	peerScoreMax = 100
+	peerScoreBan = -100
+
+	// Score adjustments on every interaction with a peer
+	PeerScoreResponsive   = 1
+	PeerScoreUnresponsive = -5
+	PeerScoreInvalidTx    = -20
+	PeerScoreInvalidBlock = -100
+	PeerScoreIncompatible = -200
+)
+
+const peerBanDuration = time.Hour
+
+// Exponential backoff between the attempts to reach a failing peer
+const peerBackoffBase = 5 * time.Second
+const peerBackoffMax = 30 * time.Minute
+
+// A peer failing this many times in a row is forgotten, unless it's a bootstrap node
+const peerMaxFailures = 16
+
+// PeerRecord is what the node remembers about a peer across restarts.
+type PeerRecord struct {
+	Peer        PeerNode `json:"peer"`
+	Score       int      `json:"score"`
+	Failures    uint     `json:"failures"`
+	LastSeen    uint64   `json:"last_seen"`
+	NextAttempt uint64   `json:"next_attempt"`
+	BannedUntil uint64   `json:"banned_until"`
+}
+
+func (r PeerRecord) IsBanned(now time.Time) bool {
+	return r.BannedUntil > uint64(now.Unix())
+}
+
+func (r PeerRecord) CanDial(now time.Time) bool {
+	return !r.IsBanned(now) && r.NextAttempt <= uint64(now.Unix())
+}
+
+type peerBookFS struct {
+	Peers []PeerRecord `json:"peers"`
+}
+
+// peerBook scores the peers and persists them in the data dir.
+type peerBook struct {
+	path    string
+	records map[string]*PeerRecord
+	dirty   bool
+	lock    sync.Mutex
+}
+
+func newPeerBook(dataDir string) *peerBook {
+	return &peerBook{
+		path:    filepath.Join(dataDir, peerBookFile),
+		records: make(map[string]*PeerRecord),
+	}
+}
+
+// load reads the peers file, a missing file is an empty book.
+func (b *peerBook) load() ([]PeerRecord, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	content, err := ioutil.ReadFile(b.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	bookFS := peerBookFS{}
+	err = json.Unmarshal(content, &bookFS)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal peers file '%s'. %s", b.path, err.Error())
+	}
+
+	for _, record := range bookFS.Peers {
+		record := record
+		b.records[record.Peer.Key()] = &record
+	}
+
+	return bookFS.Peers, nil
+}
+
+// save writes the peers file if anything changed since the last save.
+func (b *peerBook) save() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if !b.dirty {
+		return nil
+	}
+
+	bookFS := peerBookFS{Peers: make([]PeerRecord, 0, len(b.records))}
+	for _, record := range b.records {
+		bookFS.Peers = append(bookFS.Peers, *record)
+	}
+
+	content, err := json.MarshalIndent(bookFS, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := b.path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, content, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpPath, b.path)
+	if err != nil {
+		return err
+	}
+
+	b.dirty = false
+
+	return nil
+}
+
+func (b *peerBook) record(peer PeerNode) *PeerRecord {
+	record, ok := b.records[peer.Key()]
+	if !ok {
+		record = &PeerRecord{Peer: peer}
+		b.records[peer.Key()] = record
+	}
+
+	return record
+}
+
+// add remembers the peer, refreshing its info if already known.
+func (b *peerBook) add(peer PeerNode) {
+	if peer.IP == "" {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.record(peer).Peer = peer
+	b.dirty = true
+}
+
+func (b *peerBook) remove(peer PeerNode) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	delete(b.records, peer.Key())
+	b.dirty = true
+}
+
+// rename moves the record of a peer known by address under its node ID.
+func (b *peerBook) rename(old PeerNode, peer PeerNode) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	record, ok := b.records[old.Key()]
+	if !ok {
+		return
+	}
+
+	delete(b.records, old.Key())
+	record.Peer = peer
+	b.records[peer.Key()] = record
+	b.dirty = true
+}
+
+func (b *peerBook) get(peer PeerNode) (PeerRecord, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	record, ok := b.records[peer.Key()]
+	if !ok {
+		return PeerRecord{}, false
+	}
+
+	return *record, true
+}
+
+func (b *peerBook) isBanned(peer PeerNode, now time.Time) bool {
+	record, ok := b.get(peer)
+
+	return ok && record.IsBanned(now)
+}
+
+func (b *peerBook) canDial(peer PeerNode, now time.Time) bool {
+	record, ok := b.get(peer)
+
+	return !ok || record.CanDial(now)
+}
+
+// success rewards a responsive peer and clears its backoff.
+func (b *peerBook) success(peer PeerNode, now time.Time) {
+	if peer.IP == "" {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	record := b.record(peer)
+	record.Failures = 0
+	record.NextAttempt = 0
+	record.LastSeen = uint64(now.Unix())
+	record.Score = clampScore(record.Score + PeerScoreResponsive)
+	b.dirty = true
+}
+
+// failure penalizes an unresponsive peer and backs off exponentially.
+// It returns true once the peer failed too many times to keep it around.
+func (b *peerBook) failure(peer PeerNode, now time.Time) bool {
+	if peer.IP == "" {
+		return false
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	record := b.record(peer)
+	record.Failures++
+	record.NextAttempt = uint64(now.Add(peerBackoff(record.Failures)).Unix())
+	record.Score = clampScore(record.Score + PeerScoreUnresponsive)
+	b.dirty = true
+
+	return record.Failures >= peerMaxFailures && !record.Peer.IsBootstrap
+}
+
+// penalize lowers the peer's score for sending invalid data.
+// It returns true when the peer got banned.
+func (b *peerBook) penalize(peer PeerNode, delta int, now time.Time) bool {
+	if peer.IP == "" {
+		return false
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	record := b.record(peer)
+	record.Score = clampScore(record.Score + delta)
+	b.dirty = true
+
+	if record.Score > peerScoreBan {
+		return false
+	}
+
+	record.BannedUntil = uint64(now.Add(peerBanDuration).Unix())
+	record.Score = 0
+
+	return true
+}
+
+// unbanned returns the peers whose ban expired and are dialable again.
+func (b *peerBook) unbanned(now time.Time) []PeerNode {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	peers := make([]PeerNode, 0)
+	for _, record := range b.records {
+		if record.BannedUntil != 0 && !record.IsBanned(now) {
+			record.BannedUntil = 0
+			peers = append(peers, record.Peer)
+			b.dirty = true
+		}
+	}
+
+	return peers
+}
+
+func peerBackoff(failures uint) time.Duration {
+	backoff := peerBackoffBase
+	for i := uint(1); i < failures && backoff < peerBackoffMax; i++ {
+		backoff *= 2
+	}
+
+	if backoff > peerBackoffMax {
+		return peerBackoffMax
+	}
+
+	return backoff
+}
+
+func clampScore(score int) int {
+	if score > peerScoreMax {
+		return peerScoreMax
+	}
+
+	if score < peerScoreBan {
+		return peerScoreBan
+	}
+
+	return score
+}
+
+// loadPeerBook restores the peers remembered from the previous runs.
+func (n *Node) loadPeerBook() error {
+	records, err := n.peerBook.load()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, record := range records {
+		if record.IsBanned(now) || n.IsKnownPeer(record.Peer) {
+			continue
+		}
+
+		n.peersLock.Lock()
+		n.knownPeers[record.Peer.Key()] = record.Peer
+		n.peersLock.Unlock()
+	}
+
+	fmt.Printf("Loaded %d Peers from the peer book\n", len(records))
+
+	return nil
+}
+
+// penalizePeer lowers the peer's score and drops it from the known peers once banned.
+func (n *Node) penalizePeer(peer PeerNode, delta int, reason error) {
+	fmt.Printf("Peer %s sent invalid data: %s\n", peer.TcpAddress(), reason)
+
+	if !n.peerBook.penalize(peer, delta, time.Now()) {
+		return
+	}
+
+	fmt.Printf("Peer %s was banned for %s\n", peer.TcpAddress(), peerBanDuration)
+
+	n.peersLock.Lock()
+	delete(n.knownPeers, peer.Key())
+	n.peersLock.Unlock()
+}
+
+// restoreUnbannedPeers brings back the peers whose ban expired.
+func (n *Node) restoreUnbannedPeers() {
+	for _, peer := range n.peerBook.unbanned(time.Now()) {
+		fmt.Printf("Ban of Peer %s expired\n", peer.TcpAddress())
+
+		peer.connected = false
+		n.AddPeer(peer)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package node
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestPeerBook_Backoff(t *testing.T) {
+	book := newPeerBook(t.TempDir())
+	peer := NewPeerNode("127.0.0.1", 8081, false, common.Address{}, true, nodeVersion)
+	now := time.Now()
+
+	book.failure(peer, now)
+	if book.canDial(peer, now) {
+		t.Fatal("a failing peer is not suppose to be dialed before its backoff")
+	}
+
+	if !book.canDial(peer, now.Add(peerBackoffBase)) {
+		t.Fatal("a failing peer is suppose to be dialed after its backoff")
+	}
+
+	book.failure(peer, now)
+	if book.canDial(peer, now.Add(peerBackoffBase)) {
+		t.Fatal("the backoff is suppose to double on every failure")
+	}
+
+	book.success(peer, now)
+	if !book.canDial(peer, now) {
+		t.Fatal("a responsive peer is suppose to be dialed right away")
+	}
+
+	if peerBackoff(100) != peerBackoffMax {
+		t.Fatalf("the backoff is suppose to be capped at %s", peerBackoffMax)
+	}
+}
+
+func TestPeerBook_BanAndPersist(t *testing.T) {
+	dataDir := t.TempDir()
+	book := newPeerBook(dataDir)
+	peer := NewPeerNode("127.0.0.1", 8081, false, common.Address{}, true, nodeVersion)
+	now := time.Now()
+
+	book.add(peer)
+	if book.penalize(peer, PeerScoreInvalidTx, now) {
+		t.Fatal("a single invalid TX is not suppose to ban the peer")
+	}
+
+	if !book.penalize(peer, PeerScoreInvalidBlock, now) {
+		t.Fatal("an invalid block is suppose to ban the peer")
+	}
+
+	err := book.save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(book.path); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := newPeerBook(dataDir)
+	records, err := reloaded.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 1 {
+		t.Fatalf("expected 1 peer in the book, got %d", len(records))
+	}
+
+	if !reloaded.isBanned(peer, now) {
+		t.Fatal("the ban is suppose to survive a restart")
+	}
+
+	if unbanned := reloaded.unbanned(now.Add(peerBanDuration)); len(unbanned) != 1 {
+		t.Fatal("the peer is suppose to be unbanned once the ban expires")
+	}
+}
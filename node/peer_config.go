@@ -0,0 +1,217 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package node
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// SetListenAddr binds the HTTP API to the address instead of all the interfaces on the node's port.
+func (n *Node) SetListenAddr(addr string) {
+	n.listenAddr = addr
+}
+
+// SetAdvertiseAddr advertises the host and port to the peers, the HTTP API keeps listening on the node's port.
+//
+// Nodes behind a NAT or in a container advertise their public address and listen on the local one.
+func (n *Node) SetAdvertiseAddr(ip string, port uint64) {
+	n.advertisedIP = ip
+	n.advertisedPort = port
+}
+
+// advertised is the node as its peers know it, by the advertised address if any.
+func (n *Node) advertised() PeerNode {
+	info := n.info
+	if n.advertisedIP != "" {
+		info.IP = n.advertisedIP
+		info.Port = n.advertisedPort
+	}
+
+	return info
+}
+
+// isSelf reports whether the peer address is the node's own, the local or the advertised one.
+func (n *Node) isSelf(peer PeerNode) bool {
+	if peer.IP == n.info.IP && peer.Port == n.info.Port {
+		return true
+	}
+
+	return n.advertisedIP != "" && peer.IP == n.advertisedIP && peer.Port == n.advertisedPort
+}
+
+// SetPeerLimits caps the peers connecting to the node and the peers the node syncs with, unlimited if 0.
+func (n *Node) SetPeerLimits(maxInbound int, maxOutbound int) {
+	n.maxInboundPeers = maxInbound
+	n.maxOutboundPeers = maxOutbound
+}
+
+// AddStaticPeers adds peers the node always keeps dialing, like the bootstrap one.
+func (n *Node) AddStaticPeers(peers []PeerNode) {
+	for _, peer := range peers {
+		peer.IsBootstrap = true
+		n.AddPeer(peer)
+	}
+}
+
+// httpListenAddr is the address the HTTP API binds to.
+func (n *Node) httpListenAddr() string {
+	if n.listenAddr != "" {
+		return n.listenAddr
+	}
+
+	return fmt.Sprintf(":%d", n.info.Port)
+}
+
+// p2pListenAddr is the address the peer to peer protocol binds to, on the HTTP API listening host.
+func (n *Node) p2pListenAddr() string {
+	host, _, err := net.SplitHostPort(n.httpListenAddr())
+	if err != nil {
+		host = ""
+	}
+
+	return net.JoinHostPort(host, strconv.FormatUint(n.info.P2PPort, 10))
+}
+
+// ParsePeerAddress parses a "host:port" peer address.
+func ParsePeerAddress(addr string) (PeerNode, error) {
+	host, portStr, err := net.SplitHostPort(strings.TrimSpace(addr))
+	if err != nil {
+		return PeerNode{}, fmt.Errorf("invalid peer address '%s'. %s", addr, err.Error())
+	}
+
+	if host == "" {
+		return PeerNode{}, fmt.Errorf("invalid peer address '%s'. missing host", addr)
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return PeerNode{}, fmt.Errorf("invalid peer address '%s'. invalid port '%s'", addr, portStr)
+	}
+
+	return NewPeerNode(host, port, false, common.Address{}, false, ""), nil
+}
+
+// LoadPeersFile reads the "host:port" peer addresses of the file, one per line.
+//
+// Empty lines and lines starting with # are skipped.
+func LoadPeersFile(path string) ([]PeerNode, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	peers := make([]PeerNode, 0)
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		addr := strings.TrimSpace(scanner.Text())
+		if addr == "" || strings.HasPrefix(addr, "#") {
+			continue
+		}
+
+		peer, err := ParsePeerAddress(addr)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err.Error())
+		}
+
+		peers = append(peers, peer)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return peers, nil
+}
+
+// outboundPeers returns the known peers to sync with, the bootstrap and static ones first
+// and then by their peer book score.
+func (n *Node) outboundPeers() []PeerNode {
+	peers := make([]PeerNode, 0)
+	scores := make(map[string]int)
+
+	for key, peer := range n.KnownPeers() {
+		peers = append(peers, peer)
+
+		if record, ok := n.peerBook.get(peer); ok {
+			scores[key] = record.Score
+		}
+	}
+
+	sort.SliceStable(peers, func(i, j int) bool {
+		if peers[i].IsBootstrap != peers[j].IsBootstrap {
+			return peers[i].IsBootstrap
+		}
+
+		if scores[peers[i].Key()] != scores[peers[j].Key()] {
+			return scores[peers[i].Key()] > scores[peers[j].Key()]
+		}
+
+		return peers[i].Key() < peers[j].Key()
+	})
+
+	return peers
+}
+
+// acceptInboundPeer registers the peer connecting to the node, unless the inbound peers are full.
+func (n *Node) acceptInboundPeer(peer PeerNode) error {
+	n.peersLock.Lock()
+	defer n.peersLock.Unlock()
+
+	if _, ok := n.inboundPeers[peer.Key()]; ok {
+		return nil
+	}
+
+	if n.maxInboundPeers > 0 && len(n.inboundPeers) >= n.maxInboundPeers {
+		return fmt.Errorf("too many inbound peers, limit is %d", n.maxInboundPeers)
+	}
+
+	n.inboundPeers[peer.Key()] = struct{}{}
+
+	return nil
+}
+
+// acceptInboundSession checks the limit of inbound peer to peer connections.
+func (n *Node) acceptInboundSession() error {
+	if n.maxInboundPeers == 0 {
+		return nil
+	}
+
+	n.p2pLock.Lock()
+	defer n.p2pLock.Unlock()
+
+	inbound := 0
+	for _, session := range n.p2pPeers {
+		if session.Inbound() {
+			inbound++
+		}
+	}
+
+	if inbound >= n.maxInboundPeers {
+		return fmt.Errorf("too many inbound p2p peers, limit is %d", n.maxInboundPeers)
+	}
+
+	return nil
+}
@@ -0,0 +1,161 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package node
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/IacopoMelani/the-blockchain-pub/fs"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestParsePeerAddress(t *testing.T) {
+	peer, err := ParsePeerAddress("node.tbb.web3.coach:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if peer.IP != "node.tbb.web3.coach" || peer.Port != 443 {
+		t.Fatalf("expected peer node.tbb.web3.coach:443, got %s", peer.TcpAddress())
+	}
+
+	for _, addr := range []string{"127.0.0.1", ":8080", "127.0.0.1:0", "127.0.0.1:port", "127.0.0.1:70000"} {
+		if _, err := ParsePeerAddress(addr); err == nil {
+			t.Errorf("peer address '%s' is suppose to be invalid", addr)
+		}
+	}
+}
+
+func TestLoadPeersFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers.txt")
+	err := ioutil.WriteFile(path, []byte("# static peers\n127.0.0.1:8080\n\n  10.0.0.2:8081  \n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peers, err := LoadPeersFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(peers) != 2 || peers[0].TcpAddress() != "127.0.0.1:8080" || peers[1].TcpAddress() != "10.0.0.2:8081" {
+		t.Fatalf("unexpected peers %v", peers)
+	}
+
+	err = ioutil.WriteFile(path, []byte("127.0.0.1:8080\n127.0.0.1\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = LoadPeersFile(path)
+	if err == nil {
+		t.Fatal("the invalid peer address on line 2 is suppose to be rejected")
+	}
+}
+
+func TestNode_ListenAddr(t *testing.T) {
+	n := New("", "203.0.113.7", 8080, common.Address{}, PeerNode{}, nodeVersion, defaultTestMiningDifficulty)
+	n.SetP2P(8090, false)
+
+	if n.httpListenAddr() != ":8080" || n.p2pListenAddr() != ":8090" {
+		t.Fatalf("expected to listen on all the interfaces, got %s and %s", n.httpListenAddr(), n.p2pListenAddr())
+	}
+
+	n.SetListenAddr("10.0.0.5:9000")
+
+	if n.httpListenAddr() != "10.0.0.5:9000" || n.p2pListenAddr() != "10.0.0.5:8090" {
+		t.Fatalf("expected to listen on 10.0.0.5, got %s and %s", n.httpListenAddr(), n.p2pListenAddr())
+	}
+
+	if n.info.TcpAddress() != "203.0.113.7:8080" {
+		t.Fatalf("the advertised address is not suppose to change, got %s", n.info.TcpAddress())
+	}
+}
+
+func TestNode_PeerLimits(t *testing.T) {
+	n, dataDir := newTestNode(t, common.Address{})
+	defer fs.RemoveDir(dataDir)
+	defer n.state.Close()
+
+	n.SetPeerLimits(1, 1)
+
+	static := NewPeerNode("127.0.0.1", 8081, false, common.Address{}, false, nodeVersion)
+	other := NewPeerNode("127.0.0.1", 8082, false, common.Address{}, false, nodeVersion)
+	n.AddPeer(other)
+	n.AddStaticPeers([]PeerNode{static})
+
+	peers := n.outboundPeers()
+	if len(peers) == 0 || peers[0].TcpAddress() != static.TcpAddress() {
+		t.Fatalf("the static peer is suppose to be synced first, got %v", peers)
+	}
+
+	inbound := NewPeerNode("127.0.0.1", 8083, false, common.Address{}, true, nodeVersion)
+	inbound.ID = "inbound"
+
+	err := n.acceptInboundPeer(inbound)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Registering again doesn't take a new slot
+	err = n.acceptInboundPeer(inbound)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	full := NewPeerNode("127.0.0.1", 8084, false, common.Address{}, true, nodeVersion)
+	full.ID = "full"
+
+	err = n.acceptInboundPeer(full)
+	if err == nil {
+		t.Fatal("the inbound peers are suppose to be full")
+	}
+
+	n.AddPeer(inbound)
+	n.RemovePeer(inbound)
+
+	err = n.acceptInboundPeer(full)
+	if err != nil {
+		t.Fatalf("removing an inbound peer is suppose to free its slot. %s", err)
+	}
+}
+
+func TestNode_AdvertiseAddr(t *testing.T) {
+	n, dataDir := newTestNode(t, common.Address{})
+	defer fs.RemoveDir(dataDir)
+	defer n.state.Close()
+
+	local := n.info
+	n.SetAdvertiseAddr("203.0.113.7", local.Port+10000)
+
+	if n.httpListenAddr() != fmt.Sprintf(":%d", local.Port) {
+		t.Fatalf("expected the node to listen on its local port %d, got '%s'", local.Port, n.httpListenAddr())
+	}
+
+	advertised := fmt.Sprintf("203.0.113.7:%d", local.Port+10000)
+	if n.handshake().Peer.TcpAddress() != advertised {
+		t.Fatalf("expected the handshake to advertise '%s', got '%s'", advertised, n.handshake().Peer.TcpAddress())
+	}
+
+	for _, self := range []PeerNode{local, n.advertised()} {
+		if !n.isSelf(self) || !n.IsKnownPeer(self) {
+			t.Fatalf("expected '%s' to be the node itself", self.TcpAddress())
+		}
+	}
+}
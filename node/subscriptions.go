@@ -0,0 +1,315 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IacopoMelani/the-blockchain-pub/database"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/gorilla/websocket"
+)
+
+// The TXs sent and received by an address and its block rewards, mined or pending
+const SubscriptionAddressActivity = "addressActivity"
+
+const (
+	wsMethodSubscribe   = "subscribe"
+	wsMethodUnsubscribe = "unsubscribe"
+)
+
+// Max subscriptions open on a single connection
+const maxWsSubscriptions = 32
+
+// Max requests a connection sends per wsRequestsWindow, the client is disconnected past it
+const maxWsRequests = 60
+const wsRequestsWindow = time.Minute
+
+// A client not answering the pings for wsPongWait is disconnected
+const wsPingInterval = 30 * time.Second
+const wsPongWait = 60 * time.Second
+const wsWriteWait = 10 * time.Second
+
+// WsReq subscribes to the events named in the first param, e.g: ["addressActivity", "0x..."],
+// or unsubscribes the subscription ID in the first param.
+type WsReq struct {
+	ID     uint64   `json:"id"`
+	Method string   `json:"method"`
+	Params []string `json:"params"`
+}
+
+// WsRes answers the request with the same ID, the result is the subscription ID.
+type WsRes struct {
+	ID     uint64 `json:"id"`
+	Result string `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// WsNotification delivers an event of a subscription, the result is a BlockRes for newHeads,
+// a TxRes for pendingTransactions, a HistoryEntry for addressActivity and a ReorgRes for reorg.
+type WsNotification struct {
+	Subscription string      `json:"subscription"`
+	Type         string      `json:"type"`
+	Result       interface{} `json:"result"`
+}
+
+type wsSubscription struct {
+	kind    string
+	account common.Address
+}
+
+func (n *Node) wsUpgrader() *websocket.Upgrader {
+	return &websocket.Upgrader{CheckOrigin: n.checkWsOrigin}
+}
+
+// checkWsOrigin accepts the clients sending no origin, the node's own origin and the allowed ones.
+func (n *Node) checkWsOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	originUrl, err := url.Parse(origin)
+	if err == nil && strings.EqualFold(originUrl.Host, r.Host) {
+		return true
+	}
+
+	for _, allowed := range n.wsOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// serveSubscriptions pushes the events of the node to the WebSocket client until it disconnects or the ctx is done.
+func (n *Node) serveSubscriptions(ctx context.Context, conn *websocket.Conn) {
+	defer conn.Close()
+
+	sub := n.events.subscribe()
+	defer n.events.unsubscribe(sub)
+
+	msgs := make(chan []byte)
+	readErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		})
+
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				readErr <- err
+				return
+			}
+
+			select {
+			case msgs <- msg:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+
+	subs := make(map[string]wsSubscription)
+	lastID := uint64(0)
+
+	requests := 0
+	windowStart := time.Now()
+
+	for {
+		var err error
+
+		select {
+		case msg := <-msgs:
+			if time.Since(windowStart) > wsRequestsWindow {
+				requests, windowStart = 0, time.Now()
+			}
+
+			requests++
+			if requests > maxWsRequests {
+				closeWs(conn, websocket.ClosePolicyViolation, fmt.Sprintf("at most %d requests per %s", maxWsRequests, wsRequestsWindow))
+				return
+			}
+
+			err = writeWs(conn, wsRequest(msg, subs, &lastID))
+
+		case e := <-sub.events:
+			err = notifySubscriptions(conn, subs, e)
+
+		case <-sub.dropped:
+			closeWs(conn, websocket.CloseTryAgainLater, "too many events not read")
+			return
+
+		case <-ping.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait))
+
+		case err = <-readErr:
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				fmt.Printf("ERROR: WebSocket client %s disconnected. %s\n", conn.RemoteAddr(), err)
+			}
+
+			return
+
+		case <-ctx.Done():
+			closeWs(conn, websocket.CloseGoingAway, "node shutting down")
+			return
+		}
+
+		if err != nil {
+			fmt.Printf("ERROR: unable to write to WebSocket client %s. %s\n", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+func writeWs(conn *websocket.Conn, v interface{}) error {
+	conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+
+	return conn.WriteJSON(v)
+}
+
+func closeWs(conn *websocket.Conn, code int, reason string) {
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(wsWriteWait))
+}
+
+// wsRequest subscribes or unsubscribes, the subscription IDs are unique within the connection.
+func wsRequest(msg []byte, subs map[string]wsSubscription, lastID *uint64) WsRes {
+	req := WsReq{}
+	err := json.Unmarshal(msg, &req)
+	if err != nil {
+		return WsRes{Error: fmt.Sprintf("invalid request. %s", err)}
+	}
+
+	if len(req.Params) == 0 {
+		return WsRes{ID: req.ID, Error: "missing params"}
+	}
+
+	switch req.Method {
+	case wsMethodSubscribe:
+		s, err := newWsSubscription(req.Params)
+		if err != nil {
+			return WsRes{ID: req.ID, Error: err.Error()}
+		}
+
+		if len(subs) >= maxWsSubscriptions {
+			return WsRes{ID: req.ID, Error: fmt.Sprintf("at most %d subscriptions per connection", maxWsSubscriptions)}
+		}
+
+		*lastID++
+		id := strconv.FormatUint(*lastID, 10)
+		subs[id] = s
+
+		return WsRes{ID: req.ID, Result: id}
+
+	case wsMethodUnsubscribe:
+		id := req.Params[0]
+		if _, ok := subs[id]; !ok {
+			return WsRes{ID: req.ID, Error: fmt.Sprintf("subscription '%s' not found", id)}
+		}
+
+		delete(subs, id)
+
+		return WsRes{ID: req.ID, Result: id}
+	}
+
+	return WsRes{ID: req.ID, Error: fmt.Sprintf("unknown method '%s'", req.Method)}
+}
+
+func newWsSubscription(params []string) (wsSubscription, error) {
+	switch params[0] {
+	case EventNewHead, EventPendingTx, EventReorg:
+		return wsSubscription{kind: params[0]}, nil
+
+	case SubscriptionAddressActivity:
+		if len(params) < 2 || !common.IsHexAddress(params[1]) {
+			return wsSubscription{}, fmt.Errorf("%s requires an address", SubscriptionAddressActivity)
+		}
+
+		return wsSubscription{kind: params[0], account: database.NewAccount(params[1])}, nil
+	}
+
+	return wsSubscription{}, fmt.Errorf("unknown subscription '%s'", params[0])
+}
+
+func notifySubscriptions(conn *websocket.Conn, subs map[string]wsSubscription, e event) error {
+	for id, s := range subs {
+		for _, result := range s.results(e) {
+			err := writeWs(conn, WsNotification{Subscription: id, Type: s.kind, Result: result})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// results are the notifications of the event for the subscription, none if it doesn't match.
+func (s wsSubscription) results(e event) []interface{} {
+	results := make([]interface{}, 0)
+
+	if s.kind == SubscriptionAddressActivity {
+		switch e.kind {
+		case EventNewHead:
+			for _, entry := range blockActivity(s.account, e.block) {
+				results = append(results, entry)
+			}
+		case EventPendingTx:
+			if e.tx.From == s.account || e.tx.To == s.account {
+				results = append(results, newPendingHistoryEntry(s.account, e.txHash, e.tx))
+			}
+		}
+
+		return results
+	}
+
+	if s.kind != e.kind {
+		return results
+	}
+
+	switch e.kind {
+	case EventNewHead:
+		results = append(results, BlockRes{
+			Hash:          e.block.Key,
+			Header:        e.block.Value.Header,
+			TxCount:       len(e.block.Value.TXs),
+			Confirmations: 1,
+		})
+	case EventPendingTx:
+		tx := e.tx
+		results = append(results, TxRes{Hash: e.txHash, Status: TxStatusPending, Tx: &tx})
+	case EventReorg:
+		results = append(results, e.reorg)
+	}
+
+	return results
+}
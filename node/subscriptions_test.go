@@ -0,0 +1,251 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package node
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IacopoMelani/the-blockchain-pub/database"
+	"github.com/IacopoMelani/the-blockchain-pub/fs"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/gorilla/websocket"
+)
+
+// testWsMsg decodes both the responses and the notifications
+type testWsMsg struct {
+	ID           uint64          `json:"id"`
+	Result       json.RawMessage `json:"result"`
+	Error        string          `json:"error"`
+	Subscription string          `json:"subscription"`
+	Type         string          `json:"type"`
+}
+
+func TestNode_Subscriptions(t *testing.T) {
+	n, dataDir := newTestNode(t, common.Address{})
+	defer fs.RemoveDir(dataDir)
+	defer n.state.Close()
+
+	server := httptest.NewServer(n.httpHandler())
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+endpointSubscriptions, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, params := range [][]string{{"newBlocks"}, {SubscriptionAddressActivity}, {SubscriptionAddressActivity, "0x123"}} {
+		res := sendTestWsReq(t, conn, WsReq{ID: 1, Method: wsMethodSubscribe, Params: params})
+		if res.Error == "" {
+			t.Fatalf("expected subscribing to %v to fail", params)
+		}
+	}
+
+	subs := make(map[string]string)
+	for i, params := range [][]string{{EventNewHead}, {EventPendingTx}, {SubscriptionAddressActivity, common.Address{}.Hex()}, {EventReorg}} {
+		res := sendTestWsReq(t, conn, WsReq{ID: uint64(i), Method: wsMethodSubscribe, Params: params})
+		if res.Error != "" || res.ID != uint64(i) {
+			t.Fatalf("expected subscribing to %v to succeed, got %+v", params, res)
+		}
+
+		var id string
+		err = json.Unmarshal(res.Result, &id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		subs[params[0]] = id
+	}
+
+	// Block 0 funding the sender, then its TX to the zero address pending and mined in block 1
+	tx := addTestPendingTXs(t, n, 1)[0]
+	txHash, err := tx.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mineTestBlocks(t, n, common.Address{}, 1)
+
+	err = n.rewindChain(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	notifications := make(map[string][]json.RawMessage)
+	for i := 0; i < 7; i++ {
+		msg := readTestWsMsg(t, conn)
+		if subs[msg.Type] != msg.Subscription {
+			t.Fatalf("expected the %s notification from subscription '%s', got '%s'", msg.Type, subs[msg.Type], msg.Subscription)
+		}
+
+		notifications[msg.Type] = append(notifications[msg.Type], msg.Result)
+	}
+
+	heads := notifications[EventNewHead]
+	if len(heads) != 2 {
+		t.Fatalf("expected 2 new heads, got %d", len(heads))
+	}
+
+	head := BlockRes{}
+	err = json.Unmarshal(heads[1], &head)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if head.Header.Number != 1 || head.TxCount != 1 || head.Confirmations != 1 {
+		t.Fatalf("expected block 1 with the TX as the new head, got %+v", head)
+	}
+
+	pending := make([]TxRes, 0)
+	for _, result := range notifications[EventPendingTx] {
+		res := TxRes{}
+		err = json.Unmarshal(result, &res)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pending = append(pending, res)
+	}
+
+	if len(pending) != 1 || pending[0].Hash != txHash || pending[0].Status != TxStatusPending {
+		t.Fatalf("expected TX %s pending, got %+v", txHash.Hex(), pending)
+	}
+
+	activity := make([]HistoryEntry, 0)
+	for _, result := range notifications[SubscriptionAddressActivity] {
+		entry := HistoryEntry{}
+		err = json.Unmarshal(result, &entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		activity = append(activity, entry)
+	}
+
+	if len(activity) != 3 {
+		t.Fatalf("expected the pending TX, the mined TX and the block reward, got %+v", activity)
+	}
+
+	if activity[0].Status != TxStatusPending || activity[0].Direction != DirectionIn || activity[0].Hash != txHash {
+		t.Fatalf("expected the TX received pending first, got %+v", activity[0])
+	}
+
+	if activity[1].Status != TxStatusMined || activity[1].Hash != txHash || activity[1].BlockNumber != 1 {
+		t.Fatalf("expected the TX mined in block 1, got %+v", activity[1])
+	}
+
+	if activity[2].Direction != DirectionReward || activity[2].Value != database.BlockReward+tx.EffectiveFee() {
+		t.Fatalf("expected the reward of block 1, got %+v", activity[2])
+	}
+
+	reorg := ReorgRes{}
+	err = json.Unmarshal(notifications[EventReorg][0], &reorg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reorg.OldNumber != 1 || reorg.OldHead != head.Hash || reorg.NewNumber != 0 || reorg.NewHead != n.state.LatestBlockHash() {
+		t.Fatalf("expected the chain rewound from block 1 to 0, got %+v", reorg)
+	}
+
+	res := sendTestWsReq(t, conn, WsReq{ID: 5, Method: wsMethodUnsubscribe, Params: []string{subs[EventNewHead]}})
+	if res.Error != "" {
+		t.Fatalf("expected unsubscribing to succeed, got %s", res.Error)
+	}
+
+	res = sendTestWsReq(t, conn, WsReq{ID: 6, Method: wsMethodUnsubscribe, Params: []string{subs[EventNewHead]}})
+	if res.Error == "" {
+		t.Fatal("expected unsubscribing twice to fail")
+	}
+}
+
+func TestNode_SubscriptionsLimits(t *testing.T) {
+	n, dataDir := newTestNode(t, common.Address{})
+	defer fs.RemoveDir(dataDir)
+	defer n.state.Close()
+
+	server := httptest.NewServer(n.httpHandler())
+	defer server.Close()
+
+	wsUrl := "ws" + strings.TrimPrefix(server.URL, "http") + endpointSubscriptions
+
+	// A web page of another origin can't subscribe on behalf of its visitors
+	_, res, err := websocket.DefaultDialer.Dial(wsUrl, http.Header{"Origin": {"https://wallet.example"}})
+	if err == nil || res == nil || res.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected the foreign origin to be refused, got %v", err)
+	}
+
+	n.SetWsOrigins([]string{"https://wallet.example"})
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsUrl, http.Header{"Origin": {"https://wallet.example"}})
+	if err != nil {
+		t.Fatalf("expected the allowed origin to subscribe, got %v", err)
+	}
+	defer conn.Close()
+
+	for i := 0; i < maxWsSubscriptions; i++ {
+		res := sendTestWsReq(t, conn, WsReq{ID: uint64(i), Method: wsMethodSubscribe, Params: []string{EventNewHead}})
+		if res.Error != "" {
+			t.Fatalf("expected subscription %d to succeed, got %+v", i, res)
+		}
+	}
+
+	if res := sendTestWsReq(t, conn, WsReq{ID: 1, Method: wsMethodSubscribe, Params: []string{EventNewHead}}); res.Error == "" {
+		t.Fatal("expected the subscriptions past the limit to fail")
+	}
+
+	// The requests past the limit close the connection
+	for i := maxWsSubscriptions + 1; i < maxWsRequests; i++ {
+		sendTestWsReq(t, conn, WsReq{ID: 1, Method: wsMethodUnsubscribe, Params: []string{"0"}})
+	}
+
+	err = conn.WriteJSON(WsReq{ID: 1, Method: wsMethodUnsubscribe, Params: []string{"0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Fatalf("expected the connection to be closed past %d requests, got %v", maxWsRequests, err)
+	}
+}
+
+func sendTestWsReq(t *testing.T, conn *websocket.Conn, req WsReq) testWsMsg {
+	err := conn.WriteJSON(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return readTestWsMsg(t, conn)
+}
+
+func readTestWsMsg(t *testing.T, conn *websocket.Conn) testWsMsg {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	msg := testWsMsg{}
+	err := conn.ReadJSON(&msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return msg
+}
@@ -19,7 +19,6 @@ import (
 	"context"
 	"fmt"
 	"net/http"
-	"net/url"
 	"time"
 
 	"github.com/IacopoMelani/the-blockchain-pub/database"
@@ -37,13 +36,22 @@ func (n *Node) sync(ctx context.Context) error {
 
 		case <-ctx.Done():
 			ticker.Stop()
+			return nil
 		}
 	}
 }
 
 func (n *Node) doSync() {
-	for _, peer := range n.knownPeers {
-		if n.info.IP == peer.IP && n.info.Port == peer.Port {
+	n.restoreUnbannedPeers()
+
+	statuses := make([]peerStatus, 0)
+
+	for _, peer := range n.outboundPeers() {
+		if n.maxOutboundPeers > 0 && len(statuses) >= n.maxOutboundPeers {
+			break
+		}
+
+		if n.isSelf(peer) {
 			continue
 		}
 
@@ -51,101 +59,84 @@ func (n *Node) doSync() {
 			continue
 		}
 
+		if !n.peerBook.canDial(peer, time.Now()) {
+			continue
+		}
+
 		fmt.Printf("Searching for new Peers and their Blocks and Peers: '%s'\n", peer.TcpAddress())
 
-		status, err := queryPeerStatus(peer)
+		status, err := n.peerStatus(peer)
 		if err != nil {
 			fmt.Printf("ERROR: %s\n", err)
-			fmt.Printf("Peer '%s' was removed from KnownPeers\n", peer.TcpAddress())
 
-			n.RemovePeer(peer)
+			if n.peerBook.failure(peer, time.Now()) {
+				fmt.Printf("Peer '%s' was removed from KnownPeers\n", peer.TcpAddress())
 
-			continue
-		}
+				n.RemovePeer(peer)
+			}
 
-		err = n.joinKnownPeers(peer)
-		if err != nil {
-			fmt.Printf("ERROR: %s\n", err)
 			continue
 		}
 
-		err = n.syncBlocks(peer, status)
-		if err != nil {
-			fmt.Printf("ERROR: %s\n", err)
-			continue
-		}
+		n.peerBook.success(peer, time.Now())
 
-		err = n.syncKnownPeers(status)
-		if err != nil {
-			fmt.Printf("ERROR: %s\n", err)
-			continue
+		peer.ID = status.NodeID
+
+		// The p2p handshake already joined the peer's KnownPeers
+		if n.p2pSession(peer) != nil {
+			peer.connected = true
+			n.AddPeer(peer)
 		}
 
-		err = n.syncPendingTXs(peer, status.PendingTXs)
+		err = n.joinKnownPeers(peer)
 		if err != nil {
 			fmt.Printf("ERROR: %s\n", err)
 			continue
 		}
-	}
-}
-
-func (n *Node) syncBlocks(peer PeerNode, status StatusRes) error {
-	localBlockNumber := n.state.LatestBlock().Header.Number
-
-	// If the peer has no blocks, ignore it
-	if status.Hash.IsEmpty() {
-		return nil
-	}
-
-	// If the peer has less blocks than us, ignore it
-	if status.Number <= localBlockNumber {
-		return nil
-	}
-
-	// If it's the genesis block and we already synced it, ignore it
-	if status.Number == 0 && !n.state.LatestBlockHash().IsEmpty() {
-		return nil
-	}
 
-	// Display found 1 new block if we sync the genesis block 0
-	newBlocksCount := status.Number - localBlockNumber
-	if localBlockNumber == 0 && status.Number == 0 {
-		newBlocksCount = 1
+		statuses = append(statuses, peerStatus{peer, status})
 	}
-	fmt.Printf("Found %d new blocks from Peer %s\n", newBlocksCount, peer.TcpAddress())
 
-	blocks, err := fetchBlocksFromPeer(peer, n.state.LatestBlockHash())
+	err := n.syncBestChain(statuses)
 	if err != nil {
-		return err
+		fmt.Printf("ERROR: %s\n", err)
 	}
 
-	// accidental forks happen when a peer has one or more blocks than us and 0 blocks are found
-	if len(blocks) == 0 {
+	n.requestOrphans()
 
-		// fetch from genesis blocks
-		blocks, err = fetchBlocksFromPeer(peer, database.Hash{})
+	for _, s := range statuses {
+		err = n.syncKnownPeers(s.status)
 		if err != nil {
-			return err
+			fmt.Printf("ERROR: %s\n", err)
+			continue
 		}
 
-		n.resetChain()
-	}
+		// Same digest, same pending TXs: nothing to fetch
+		if s.status.PendingCount == 0 || s.status.PendingDigest == n.mempool.Digest() {
+			continue
+		}
 
-	for _, block := range blocks {
-		err = n.addBlock(block.Value)
+		txs, err := n.peerPendingTXs(s.peer)
 		if err != nil {
-			return err
+			fmt.Printf("ERROR: unable to fetch the Pending TXs of Peer %s. %s\n", s.peer.TcpAddress(), err)
 		}
 
-		n.newSyncedBlocks <- block.Value
+		err = n.syncPendingTXs(s.peer, txs)
+		if err != nil {
+			fmt.Printf("ERROR: %s\n", err)
+			continue
+		}
 	}
 
-	return nil
+	err = n.peerBook.save()
+	if err != nil {
+		fmt.Printf("ERROR: unable to save the peer book. %s\n", err)
+	}
 }
 
 func (n *Node) syncKnownPeers(status StatusRes) error {
 	for _, statusPeer := range status.KnownPeers {
-		if !n.IsKnownPeer(statusPeer) {
+		if !n.IsKnownPeer(statusPeer) && !n.peerBook.isBanned(statusPeer, time.Now()) {
 			fmt.Printf("Found new Peer %s\n", statusPeer.TcpAddress())
 
 			n.AddPeer(statusPeer)
@@ -157,10 +148,33 @@ func (n *Node) syncKnownPeers(status StatusRes) error {
 
 func (n *Node) syncPendingTXs(peer PeerNode, txs []database.SignedTx) error {
 	for _, tx := range txs {
-		err := n.AddPendingTX(tx, peer)
+		err := n.checkPeerTx(peer, tx)
 		if err != nil {
 			return err
 		}
+
+		// The peer may not know yet the TX was mined or replaced
+		err = n.AddPendingTX(tx, peer)
+		if err != nil {
+			fmt.Printf("Skipping Pending TX of Peer %s. %s\n", peer.TcpAddress(), err)
+		}
+	}
+
+	return nil
+}
+
+// checkPeerTx penalizes the peer for relaying a TX with a forged signature.
+func (n *Node) checkPeerTx(peer PeerNode, tx database.SignedTx) error {
+	isAuthentic, err := tx.IsAuthentic()
+	if err != nil {
+		return err
+	}
+
+	if !isAuthentic {
+		err = fmt.Errorf("wrong TX. Sender '%s' is forged", tx.From.String())
+		n.penalizePeer(peer, PeerScoreInvalidTx, err)
+
+		return err
 	}
 
 	return nil
@@ -171,43 +185,24 @@ func (n *Node) joinKnownPeers(peer PeerNode) error {
 		return nil
 	}
 
-	p_url := fmt.Sprintf(
-		"%s://%s%s?%s=%s&%s=%d&%s=%s&%s=%s",
-		peer.ApiProtocol(),
-		peer.TcpAddress(),
-		endpointAddPeer,
-		endpointAddPeerQueryKeyIP,
-		n.info.IP,
-		endpointAddPeerQueryKeyPort,
-		n.info.Port,
-		endpointAddPeerQueryKeyMiner,
-		n.info.Account.String(),
-		endpointAddPeerQueryKeyVersion,
-		url.QueryEscape(n.info.NodeVersion),
-	)
-
-	res, err := http.Get(p_url)
+	handshake, err := n.sendHandshake(peer)
 	if err != nil {
 		return err
 	}
 
-	addPeerRes := AddPeerRes{}
-	err = readRes(res, &addPeerRes)
+	err = n.checkHandshake(handshake)
 	if err != nil {
-		return err
-	}
-	if addPeerRes.Error != "" {
-		return fmt.Errorf(addPeerRes.Error)
+		n.penalizePeer(peer, PeerScoreIncompatible, err)
+		return fmt.Errorf("unable to join KnownPeers of '%s'. %s", peer.TcpAddress(), err.Error())
 	}
 
-	knownPeer := n.knownPeers[peer.TcpAddress()]
-	knownPeer.connected = addPeerRes.Success
+	peer.ID = handshake.Peer.ID
+	peer.Account = handshake.Peer.Account
+	peer.NodeVersion = handshake.Peer.NodeVersion
+	peer.P2PPort = handshake.Peer.P2PPort
+	peer.connected = true
 
-	n.AddPeer(knownPeer)
-
-	if !addPeerRes.Success {
-		return fmt.Errorf("unable to join KnownPeers of '%s'", peer.TcpAddress())
-	}
+	n.AddPeer(peer)
 
 	return nil
 }
@@ -220,15 +215,23 @@ func queryPeerStatus(peer PeerNode) (StatusRes, error) {
 	}
 
 	statusRes := StatusRes{}
-	err = readRes(res, &statusRes)
+	signer, err := readSignedRes(res, &statusRes)
 	if err != nil {
 		return StatusRes{}, err
 	}
 
+	if signer != statusRes.NodeID {
+		return StatusRes{}, fmt.Errorf("status of '%s' is not signed by node %s", peer.TcpAddress(), statusRes.NodeID)
+	}
+
+	if peer.ID != "" && peer.ID != signer {
+		return StatusRes{}, fmt.Errorf("node at '%s' changed identity from %s to %s", peer.TcpAddress(), peer.ID, signer)
+	}
+
 	return statusRes, nil
 }
 
-func fetchBlocksFromPeer(peer PeerNode, fromBlock database.Hash) ([]database.BlockFS, error) {
+func fetchBlocksFromPeer(peer PeerNode, fromBlock database.Hash, last int) ([]database.BlockFS, error) {
 	fmt.Printf("Importing blocks from Peer %s...\n", peer.TcpAddress())
 
 	url := fmt.Sprintf(
@@ -241,7 +244,7 @@ func fetchBlocksFromPeer(peer PeerNode, fromBlock database.Hash) ([]database.Blo
 		endpointSyncQueryKeyMode,
 		endpointSyncQueryKeyModeAfter,
 		endpointSyncQueryKeyLast,
-		100,
+		last,
 	)
 
 	res, err := http.Get(url)
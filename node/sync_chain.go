@@ -0,0 +1,533 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package node
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/IacopoMelani/the-blockchain-pub/consensus"
+	"github.com/IacopoMelani/the-blockchain-pub/database"
+)
+
+const maxHeadersPerRequest = 2000
+
+// Number of blocks downloaded per request, a variable so tests can split small chains in many ranges
+var blocksPerRequest = 100
+
+// Max number of blocks served per request, a variable so tests can exceed it with small chains
+var maxBlocksPerRequest = 500
+
+// Number of peers downloading the blocks in parallel and attempts per range of blocks
+const maxSyncPeers = 8
+const maxBlocksRetries = 5
+
+type HeadersRes struct {
+	Headers []database.HeaderFS `json:"headers"`
+}
+
+type SyncProgressRes struct {
+	Syncing  bool   `json:"syncing"`
+	Starting uint64 `json:"starting_block"`
+	Current  uint64 `json:"current_block"`
+	Highest  uint64 `json:"highest_block"`
+	ETA      uint64 `json:"eta_seconds"`
+}
+
+type syncProgress struct {
+	syncing   bool
+	starting  uint64
+	highest   uint64
+	startedAt time.Time
+}
+
+type peerStatus struct {
+	peer   PeerNode
+	status StatusRes
+}
+
+type blocksJob struct {
+	index   int
+	retries int
+}
+
+type blocksResult struct {
+	index  int
+	blocks []database.Block
+	err    error
+}
+
+// SyncProgress reports how far the node is from the highest block known by its peers.
+func (n *Node) SyncProgress() SyncProgressRes {
+	n.syncProgressLock.Lock()
+	progress := n.syncProgress
+	n.syncProgressLock.Unlock()
+
+	current := n.state.LatestBlock().Header.Number
+
+	res := SyncProgressRes{
+		Syncing:  progress.syncing,
+		Starting: progress.starting,
+		Current:  current,
+		Highest:  progress.highest,
+	}
+
+	if res.Highest < current {
+		res.Highest = current
+	}
+
+	// Extrapolate the time left from the pace of the blocks imported so far
+	if progress.syncing && current > progress.starting {
+		perBlock := time.Since(progress.startedAt) / time.Duration(current-progress.starting)
+		res.ETA = uint64((perBlock * time.Duration(res.Highest-current)).Seconds())
+	}
+
+	return res
+}
+
+func (n *Node) setSyncProgress(syncing bool, starting uint64, highest uint64) {
+	n.syncProgressLock.Lock()
+	defer n.syncProgressLock.Unlock()
+
+	n.syncProgress.syncing = syncing
+	if !syncing {
+		return
+	}
+
+	n.syncProgress.starting = starting
+	n.syncProgress.highest = highest
+	n.syncProgress.startedAt = time.Now()
+}
+
+// syncBestChain syncs the chain of the highest peer, downloading the blocks from every peer at its height.
+func (n *Node) syncBestChain(statuses []peerStatus) error {
+	if len(statuses) == 0 {
+		return nil
+	}
+
+	best := statuses[0]
+	for _, s := range statuses {
+		if s.status.Number > best.status.Number {
+			best = s
+		}
+	}
+
+	peers := []PeerNode{best.peer}
+	for _, s := range statuses {
+		if s.peer.Key() != best.peer.Key() && s.status.Number >= best.status.Number && len(peers) < maxSyncPeers {
+			peers = append(peers, s.peer)
+		}
+	}
+
+	return n.syncChain(best.peer, best.status, peers)
+}
+
+func (n *Node) syncBlocks(peer PeerNode, status StatusRes) error {
+	return n.syncChain(peer, status, []PeerNode{peer})
+}
+
+// syncChain downloads and verifies the header chain of the peer first, then the blocks in parallel from the peers.
+func (n *Node) syncChain(peer PeerNode, status StatusRes, peers []PeerNode) error {
+	n.syncLock.Lock()
+	defer n.syncLock.Unlock()
+
+	localBlockNumber := n.state.LatestBlock().Header.Number
+
+	// If the peer has no blocks, ignore it
+	if status.Hash.IsEmpty() {
+		return nil
+	}
+
+	// If the peer has less blocks than us, ignore it
+	if status.Number <= localBlockNumber {
+		return nil
+	}
+
+	// If it's the genesis block and we already synced it, ignore it
+	if status.Number == 0 && !n.state.LatestBlockHash().IsEmpty() {
+		return nil
+	}
+
+	// Display found 1 new block if we sync the genesis block 0
+	newBlocksCount := status.Number - localBlockNumber
+	if localBlockNumber == 0 && status.Number == 0 {
+		newBlocksCount = 1
+	}
+	fmt.Printf("Found %d new blocks from Peer %s\n", newBlocksCount, peer.TcpAddress())
+
+	from := n.state.LatestBlockHash()
+	next := localBlockNumber + 1
+	if from.IsEmpty() {
+		next = 0
+	}
+
+	headers, err := n.fetchHeaderChain(peer, from, status.Number)
+	if err != nil {
+		return err
+	}
+
+	// accidental forks happen when a peer has one or more blocks than us and 0 blocks are found
+	var rewind func() error
+	var replaced []database.BlockFS
+	if len(headers) == 0 {
+		ancestor, found, err := n.findCommonAncestor(peer)
+		if err != nil {
+			return err
+		}
+
+		if found {
+			fmt.Printf("Found common ancestor Block %d with Peer %s\n", ancestor, peer.TcpAddress())
+
+			from, _ = n.state.BlockHash(ancestor)
+			next = ancestor + 1
+			rewind = func() error {
+				return n.rewindChain(ancestor)
+			}
+		} else {
+			// not even the genesis block is shared, fetch from genesis blocks
+			from = database.Hash{}
+			next = 0
+			rewind = n.resetChain
+		}
+
+		// the local blocks after the fork point, kept to restore them if the fork fails to import
+		replaced, err = database.GetBlocksAfter(from, 0, n.dataDir)
+		if err != nil {
+			return err
+		}
+
+		headers, err = n.fetchHeaderChain(peer, from, status.Number)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(headers) == 0 {
+		return nil
+	}
+
+	err = n.verifyHeaderChain(from, next, headers)
+	if err != nil {
+		n.penalizePeer(peer, PeerScoreInvalidBlock, err)
+		return err
+	}
+
+	// a fork replaces the local blocks only when it carries more work, not just more blocks
+	if rewind != nil && !isHeavierFork(headers, replaced) {
+		fmt.Printf("Ignoring the fork of Peer %s, it's not heavier than the local chain\n", peer.TcpAddress())
+		return nil
+	}
+
+	starting := localBlockNumber
+	if next > 0 && next-1 < starting {
+		starting = next - 1
+	}
+
+	n.setSyncProgress(true, starting, headers[len(headers)-1].Value.Number)
+	defer n.setSyncProgress(false, 0, 0)
+
+	err = n.importBlocks(peer, from, headers, peers, rewind, replaced)
+
+	// The imported blocks may be the parents the orphans wait for
+	n.connectOrphans()
+
+	return err
+}
+
+// verifyHeaderChain checks the headers link to each other, starting from the parent, and pass the engine header verification.
+//
+// Engines verifying only full blocks, like the PoA signatures, leave the headers to the blocks verification on import.
+func (n *Node) verifyHeaderChain(from database.Hash, next uint64, headers []database.HeaderFS) error {
+	parent := from
+	for _, header := range headers {
+		if header.Value.Number != next {
+			return fmt.Errorf("next expected header must be '%d' not '%d'", next, header.Value.Number)
+		}
+
+		if header.Value.Parent != parent {
+			return fmt.Errorf("header '%d' parent hash must be '%x' not '%x'", next, parent, header.Value.Parent)
+		}
+
+		parent = header.Key
+		next++
+	}
+
+	verifier, ok := n.engine.(consensus.HeaderVerifier)
+	if !ok {
+		return nil
+	}
+
+	parents, err := n.recentHeadersAt(from)
+	if err != nil {
+		return err
+	}
+
+	return verifier.VerifyHeaders(parents, headers)
+}
+
+// recentHeadersAt returns up to RecentHeadersLimit headers of the local chain ending at the block hash, oldest first.
+func (n *Node) recentHeadersAt(hash database.Hash) ([]database.BlockHeader, error) {
+	if hash.IsEmpty() {
+		return nil, nil
+	}
+
+	n.chainLock.RLock()
+	defer n.chainLock.RUnlock()
+
+	if hash == n.state.LatestBlockHash() {
+		return n.state.RecentHeaders(), nil
+	}
+
+	blocks, err := n.state.GetBlocksBefore(hash, database.RecentHeadersLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := make([]database.BlockHeader, len(blocks))
+	for i, block := range blocks {
+		headers[len(blocks)-1-i] = block.Value.Header
+	}
+
+	return headers, nil
+}
+
+// importBlocks downloads the blocks of the verified headers from the peers in parallel and adds them in order.
+//
+// The rewind, if any, drops the local blocks after the fork point right before the first downloaded block is added,
+// if the fork then fails to download or verify the replaced local blocks are restored.
+func (n *Node) importBlocks(peer PeerNode, from database.Hash, headers []database.HeaderFS, peers []PeerNode, rewind func() error, replaced []database.BlockFS) error {
+	chunks := (len(headers) + blocksPerRequest - 1) / blocksPerRequest
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	jobs := make(chan blocksJob, chunks)
+	results := make(chan blocksResult, chunks)
+
+	for i := 0; i < chunks; i++ {
+		jobs <- blocksJob{index: i}
+	}
+
+	for _, p := range peers {
+		go n.fetchBlocksWorker(ctx, p, from, headers, jobs, results)
+	}
+
+	ready := make(map[int][]database.Block)
+	rewound := false
+
+	fail := func(err error) error {
+		if !rewound {
+			return err
+		}
+
+		fmt.Printf("Restoring the %d local blocks replaced by the fork of Peer %s\n", len(replaced), peer.TcpAddress())
+
+		restoreErr := n.restoreChain(rewind, replaced)
+		if restoreErr != nil {
+			fmt.Printf("ERROR: %s\n", restoreErr)
+		}
+
+		return err
+	}
+
+	for next := 0; next < chunks; {
+		result := <-results
+		if result.err != nil {
+			return fail(result.err)
+		}
+
+		ready[result.index] = result.blocks
+
+		for blocks, ok := ready[next]; ok; blocks, ok = ready[next] {
+			if rewind != nil && !rewound {
+				err := rewind()
+				if err != nil {
+					return err
+				}
+
+				rewound = true
+			}
+
+			for _, block := range blocks {
+				err := n.addBlock(block)
+				if err != nil {
+					n.penalizePeer(peer, PeerScoreInvalidBlock, err)
+					return fail(err)
+				}
+
+				n.notifySyncedBlock(block)
+			}
+
+			delete(ready, next)
+			next++
+		}
+	}
+
+	return nil
+}
+
+// restoreChain drops the blocks of a fork failed to import and adds back the local blocks it replaced.
+func (n *Node) restoreChain(rewind func() error, blocks []database.BlockFS) error {
+	err := rewind()
+	if err != nil {
+		return err
+	}
+
+	for _, block := range blocks {
+		err := n.addBlock(block.Value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isHeavierFork reports whether the fork headers sum up more difficulty than the local blocks they replace.
+func isHeavierFork(headers []database.HeaderFS, replaced []database.BlockFS) bool {
+	forkDifficulty := new(big.Int)
+	for _, header := range headers {
+		forkDifficulty.Add(forkDifficulty, new(big.Int).SetUint64(header.Value.Difficulty))
+	}
+
+	localDifficulty := new(big.Int)
+	for _, block := range replaced {
+		localDifficulty.Add(localDifficulty, new(big.Int).SetUint64(block.Value.Header.Difficulty))
+	}
+
+	return forkDifficulty.Cmp(localDifficulty) > 0
+}
+
+// fetchBlocksWorker downloads ranges of blocks from the peer, ranges failing are retried by any worker.
+func (n *Node) fetchBlocksWorker(ctx context.Context, peer PeerNode, from database.Hash, headers []database.HeaderFS, jobs chan blocksJob, results chan<- blocksResult) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case job := <-jobs:
+			blocks, err := n.fetchBlocksRange(peer, from, headers, job.index)
+			if err == nil {
+				results <- blocksResult{index: job.index, blocks: blocks}
+				continue
+			}
+
+			fmt.Printf("ERROR: %s\n", err)
+
+			job.retries++
+			if job.retries >= maxBlocksRetries {
+				results <- blocksResult{index: job.index, err: err}
+				continue
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Duration(job.retries) * time.Second):
+			}
+
+			jobs <- job
+		}
+	}
+}
+
+// fetchBlocksRange downloads the blocks of the index-th range of headers and checks they match them.
+func (n *Node) fetchBlocksRange(peer PeerNode, from database.Hash, headers []database.HeaderFS, index int) ([]database.Block, error) {
+	start := index * blocksPerRequest
+	end := start + blocksPerRequest
+	if end > len(headers) {
+		end = len(headers)
+	}
+
+	parent := from
+	if start > 0 {
+		parent = headers[start-1].Key
+	}
+
+	blocksFS, err := n.peerBlocks(peer, parent, end-start)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(blocksFS) < end-start {
+		return nil, fmt.Errorf("peer %s returned %d blocks instead of %d", peer.TcpAddress(), len(blocksFS), end-start)
+	}
+
+	blocks := make([]database.Block, end-start)
+	for i, header := range headers[start:end] {
+		hash, err := blocksFS[i].Value.Hash()
+		if err != nil {
+			return nil, err
+		}
+
+		if hash != header.Key {
+			return nil, fmt.Errorf("peer %s returned block '%x' instead of '%x'", peer.TcpAddress(), hash, header.Key)
+		}
+
+		blocks[i] = blocksFS[i].Value
+	}
+
+	return blocks, nil
+}
+
+// fetchHeaderChain downloads the headers after the given block up to the highest block number.
+func (n *Node) fetchHeaderChain(peer PeerNode, from database.Hash, highest uint64) ([]database.HeaderFS, error) {
+	headers := make([]database.HeaderFS, 0)
+
+	for {
+		batch, err := n.peerHeaders(peer, from)
+		if err != nil {
+			return nil, err
+		}
+
+		headers = append(headers, batch...)
+
+		if len(batch) < maxHeadersPerRequest || batch[len(batch)-1].Value.Number >= highest {
+			return headers, nil
+		}
+
+		from = batch[len(batch)-1].Key
+	}
+}
+
+func fetchHeadersFromPeer(peer PeerNode, fromBlock database.Hash) ([]database.HeaderFS, error) {
+	url := fmt.Sprintf(
+		"%s://%s%s?%s=%s&%s=%d",
+		peer.ApiProtocol(),
+		peer.TcpAddress(),
+		endpointHeaders,
+		endpointSyncQueryKeyFromBlock,
+		fromBlock.Hex(),
+		endpointSyncQueryKeyLast,
+		maxHeadersPerRequest,
+	)
+
+	res, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	headersRes := HeadersRes{}
+	err = readRes(res, &headersRes)
+	if err != nil {
+		return nil, err
+	}
+
+	return headersRes.Headers, nil
+}
@@ -0,0 +1,191 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package node
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/IacopoMelani/the-blockchain-pub/consensus/pow"
+	"github.com/IacopoMelani/the-blockchain-pub/database"
+	"github.com/IacopoMelani/the-blockchain-pub/fs"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/labstack/echo/v4"
+)
+
+func TestNode_HeadersFirstSync(t *testing.T) {
+	defer func(size int) { blocksPerRequest = size }(blocksPerRequest)
+	blocksPerRequest = 4
+
+	miner := database.NewAccount(testKsBabaYagaAccount)
+
+	source, sourceDataDir := newTestNode(t, miner)
+	defer fs.RemoveDir(sourceDataDir)
+	defer source.state.Close()
+
+	source.miningDifficulty = 1 << 8
+
+	const blocksCount = 15
+	mineTestBlocks(t, source, miner, blocksCount)
+
+	// The same node served twice, so the blocks are downloaded from two peers
+	peers := []PeerNode{serveTestSyncPeer(t, source), serveTestSyncPeer(t, source)}
+
+	n, dataDir := newTestNode(t, miner)
+	defer fs.RemoveDir(dataDir)
+	defer n.state.Close()
+
+	go func() {
+		for range n.newSyncedBlocks {
+		}
+	}()
+
+	status := StatusRes{Hash: source.state.LatestBlockHash(), Number: source.state.LatestBlock().Header.Number}
+
+	err := n.syncChain(peers[0], status, peers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n.state.LatestBlockHash() != source.state.LatestBlockHash() {
+		t.Fatalf("expected to sync up to block %d, got %d", status.Number, n.state.LatestBlock().Header.Number)
+	}
+
+	progress := n.SyncProgress()
+	if progress.Syncing || progress.Current != blocksCount-1 || progress.Highest != blocksCount-1 {
+		t.Fatalf("unexpected sync progress %+v", progress)
+	}
+}
+
+func TestNode_VerifyHeaderChain(t *testing.T) {
+	n, dataDir := newTestNode(t, database.NewAccount(testKsBabaYagaAccount))
+	defer fs.RemoveDir(dataDir)
+	defer n.state.Close()
+
+	genesis := database.HeaderFS{Key: database.Hash{0x00, 0x01}, Value: database.BlockHeader{Number: 0, Difficulty: 1}}
+	child := database.HeaderFS{Key: database.Hash{0x00, 0x02}, Value: database.BlockHeader{Number: 1, Parent: genesis.Key, Difficulty: 1}}
+
+	err := n.verifyHeaderChain(database.Hash{}, 0, []database.HeaderFS{genesis, child})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orphan := child
+	orphan.Value.Parent = database.Hash{0x00, 0x03}
+	if n.verifyHeaderChain(database.Hash{}, 0, []database.HeaderFS{genesis, orphan}) == nil {
+		t.Fatal("a header not linked to its parent is not suppose to be valid")
+	}
+
+	weak := child
+	weak.Key = database.Hash{0xff}
+	weak.Value.Difficulty = 1 << 16
+	if n.verifyHeaderChain(database.Hash{}, 0, []database.HeaderFS{genesis, weak}) == nil {
+		t.Fatal("a header with an invalid Proof of Work is not suppose to be valid")
+	}
+
+	mineTestBlocks(t, n, database.NewAccount(testKsBabaYagaAccount), 1)
+
+	latest := n.state.LatestBlock()
+	next := database.HeaderFS{Value: database.BlockHeader{Number: latest.Header.Number + 1, Parent: n.state.LatestBlockHash(), Time: latest.Header.Time + 1, Difficulty: latest.Header.Difficulty}}
+
+	err = n.verifyHeaderChain(n.state.LatestBlockHash(), next.Value.Number, []database.HeaderFS{next})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	easy := next
+	easy.Value.Difficulty = 1
+	if n.verifyHeaderChain(n.state.LatestBlockHash(), easy.Value.Number, []database.HeaderFS{easy}) == nil {
+		t.Fatal("a header not following the difficulty retarget is not suppose to be valid")
+	}
+}
+
+// mineTestBlocks mines the given number of empty blocks on top of the node's chain.
+func mineTestBlocks(t *testing.T, n *Node, miner common.Address, count int) {
+	for i := 0; i < count; i++ {
+		work, err := n.GetWork(miner)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		block, err := pow.NewWithThreads(1).Seal(context.Background(), database.Block{Header: work.Header, TXs: work.TXs})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = n.SubmitWork(MiningSubmitReq{work.WorkID, block.Header.Nonce, block.Header.Time})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// serveTestSyncPeer exposes the sync endpoints of the node on a local test server.
+func serveTestSyncPeer(t *testing.T, n *Node) PeerNode {
+	e := echo.New()
+	e.GET(endpointSync, func(c echo.Context) error {
+		return syncHandler(c, n)
+	})
+	e.GET(endpointHeaders, func(c echo.Context) error {
+		return headersHandler(c, n)
+	})
+	e.GET(endpointBlockHash, func(c echo.Context) error {
+		return blockHashHandler(c, n)
+	})
+
+	server := httptest.NewServer(e)
+	t.Cleanup(server.Close)
+
+	serverUrl, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port, err := strconv.ParseUint(serverUrl.Port(), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewPeerNode(serverUrl.Hostname(), port, false, common.Address{}, false, nodeVersion)
+}
+
+func TestIsHeavierFork(t *testing.T) {
+	replaced := []database.BlockFS{
+		{Value: database.Block{Header: database.BlockHeader{Difficulty: 1 << 10}}},
+		{Value: database.Block{Header: database.BlockHeader{Difficulty: 1 << 10}}},
+	}
+
+	lighter := []database.HeaderFS{
+		{Value: database.BlockHeader{Difficulty: 1 << 8}},
+		{Value: database.BlockHeader{Difficulty: 1 << 8}},
+		{Value: database.BlockHeader{Difficulty: 1 << 8}},
+	}
+	if isHeavierFork(lighter, replaced) {
+		t.Fatal("a longer fork with less total difficulty is not suppose to replace the local blocks")
+	}
+
+	if isHeavierFork([]database.HeaderFS{{Value: database.BlockHeader{Difficulty: 1 << 11}}}, replaced) {
+		t.Fatal("a fork with the same total difficulty is not suppose to replace the local blocks")
+	}
+
+	heavier := []database.HeaderFS{{Value: database.BlockHeader{Difficulty: 1<<11 + 1}}}
+	if !isHeavierFork(heavier, replaced) {
+		t.Fatal("a shorter fork with more total difficulty is suppose to replace the local blocks")
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package node
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/IacopoMelani/the-blockchain-pub/database"
+)
+
+// The TX left the mempool without being mined: replaced, evicted or expired
+const TxStatusDropped = "dropped"
+
+// Default and max time a client waits for a TX to be confirmed
+const defaultTxWaitTimeout = time.Minute
+const maxTxWaitTimeout = 10 * time.Minute
+
+// How often a waited TX is looked up, besides every new block, as it can leave the mempool anytime
+const txWaitPollInterval = time.Second
+
+// WaitTx waits until the TX is mined with the given confirmations or dropped, returning its latest status when the ctx is done.
+func (n *Node) WaitTx(ctx context.Context, hash database.Hash, confirmations uint64) (TxRes, error) {
+	sub := n.events.subscribe(EventNewHead, EventReorg)
+	defer func() { n.events.unsubscribe(sub) }()
+
+	ticker := time.NewTicker(txWaitPollInterval)
+	defer ticker.Stop()
+
+	known := false
+
+	for {
+		res, err := n.lookupTx(hash)
+		if err != nil {
+			return TxRes{}, err
+		}
+
+		switch res.Status {
+		case TxStatusMined:
+			if res.Confirmations >= confirmations {
+				return res, nil
+			}
+		case TxStatusUnknown:
+			if known {
+				res.Status = TxStatusDropped
+			}
+
+			return res, nil
+		}
+
+		known = true
+
+		select {
+		case <-sub.events:
+		case <-sub.dropped:
+			sub = n.events.subscribe(EventNewHead, EventReorg)
+		case <-ticker.C:
+		case <-ctx.Done():
+			return res, ctx.Err()
+		}
+	}
+}
+
+// parseTxWaitTimeout accepts a duration, e.g: 1m30s, or a number of seconds.
+func parseTxWaitTimeout(value string) (time.Duration, error) {
+	if value == "" {
+		return defaultTxWaitTimeout, nil
+	}
+
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, secondsErr := strconv.ParseUint(value, 10, 32)
+		if secondsErr != nil {
+			return 0, fmt.Errorf("invalid timeout '%s'. %s", value, err)
+		}
+
+		timeout = time.Duration(seconds) * time.Second
+	}
+
+	if timeout <= 0 || timeout > maxTxWaitTimeout {
+		return 0, fmt.Errorf("timeout must be positive and at most %s", maxTxWaitTimeout)
+	}
+
+	return timeout, nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package node
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/IacopoMelani/the-blockchain-pub/database"
+	"github.com/IacopoMelani/the-blockchain-pub/fs"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestNode_WaitTx(t *testing.T) {
+	n, dataDir := newTestNode(t, common.Address{})
+	defer fs.RemoveDir(dataDir)
+	defer n.state.Close()
+
+	txs := addTestPendingTXs(t, n, 1, 2)
+
+	minedHash, err := txs[0].Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type waitResult struct {
+		res TxRes
+		err error
+	}
+
+	waited := make(chan waitResult, 1)
+	go func() {
+		res, err := n.WaitTx(context.Background(), minedHash, 2)
+		waited <- waitResult{res, err}
+	}()
+
+	mineTestBlocks(t, n, common.Address{}, 2)
+
+	select {
+	case w := <-waited:
+		if w.err != nil || w.res.Status != TxStatusMined || w.res.Confirmations != 2 {
+			t.Fatalf("expected the TX mined with 2 confirmations, got %+v, %v", w.res, w.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the wait never returned")
+	}
+
+	pendingTx := addTestPendingTXs(t, n, 1)[0]
+	pendingHash, err := pendingTx.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	res, err := n.WaitTx(ctx, pendingHash, 1)
+	if !errors.Is(err, context.DeadlineExceeded) || res.Status != TxStatusPending {
+		t.Fatalf("expected the wait to time out with the TX pending, got %+v, %v", res, err)
+	}
+
+	go func() {
+		res, err := n.WaitTx(context.Background(), pendingHash, 1)
+		waited <- waitResult{res, err}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	n.mempool.Remove(pendingHash)
+
+	select {
+	case w := <-waited:
+		if w.err != nil || w.res.Status != TxStatusDropped {
+			t.Fatalf("expected the TX to be dropped, got %+v, %v", w.res, w.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the wait never returned")
+	}
+
+	res, err = n.WaitTx(context.Background(), database.Hash{1}, 1)
+	if err != nil || res.Status != TxStatusUnknown {
+		t.Fatalf("expected an unknown TX not to be waited, got %+v, %v", res, err)
+	}
+}
+
+func TestParseTxWaitTimeout(t *testing.T) {
+	cases := map[string]time.Duration{
+		"":      defaultTxWaitTimeout,
+		"90":    90 * time.Second,
+		"1m30s": 90 * time.Second,
+	}
+
+	for value, expected := range cases {
+		timeout, err := parseTxWaitTimeout(value)
+		if err != nil || timeout != expected {
+			t.Fatalf("expected timeout '%s' to be %s, got %s, %v", value, expected, timeout, err)
+		}
+	}
+
+	for _, value := range []string{"soon", "0", "-1s", "1h"} {
+		if _, err := parseTxWaitTimeout(value); err == nil {
+			t.Fatalf("expected timeout '%s' to be rejected", value)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/IacopoMelani/the-blockchain-pub/consensus/pow"
+	"github.com/IacopoMelani/the-blockchain-pub/database"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Max number of block templates served to external miners and waiting for a solution
+const maxPendingWorks = 64
+
+// How often an external miner checks whether the node's tip moved and its work is stale
+const remoteMinerPollInterval = 3 * time.Second
+
+type MiningWorkRes struct {
+	WorkID database.Hash        `json:"work_id"`
+	Header database.BlockHeader `json:"header"`
+	TXs    []database.SignedTx  `json:"txs"`
+	Target string               `json:"target"`
+}
+
+type MiningSubmitReq struct {
+	WorkID database.Hash `json:"work_id"`
+	Nonce  uint32        `json:"nonce"`
+	Time   uint64        `json:"time"`
+}
+
+type MiningSubmitRes struct {
+	Hash database.Hash `json:"block_hash"`
+}
+
+// GetWork builds a block template on top of the latest block for an external miner.
+func (n *Node) GetWork(miner common.Address) (MiningWorkRes, error) {
+	if _, ok := n.engine.(*pow.PoW); !ok {
+		return MiningWorkRes{}, fmt.Errorf("external mining requires the '%s' consensus", pow.Name)
+	}
+
+	n.chainLock.RLock()
+	block := NewPendingBlock(
+		n.state.LatestBlockHash(),
+		n.state.NextBlockNumber(),
+		miner,
+		n.miningDifficulty,
+		n.mempool.Pending(),
+	).Block()
+
+	err := n.engine.Prepare(n.state, &block.Header)
+	n.chainLock.RUnlock()
+
+	if err != nil {
+		return MiningWorkRes{}, err
+	}
+
+	workID, err := block.Hash()
+	if err != nil {
+		return MiningWorkRes{}, err
+	}
+
+	n.worksLock.Lock()
+	defer n.worksLock.Unlock()
+
+	for id, work := range n.works {
+		if work.Header.Parent != block.Header.Parent || work.Header.Number != block.Header.Number {
+			delete(n.works, id)
+		}
+	}
+
+	if len(n.works) >= maxPendingWorks {
+		var oldestID database.Hash
+		oldestTime := uint64(math.MaxUint64)
+
+		for id, work := range n.works {
+			if work.Header.Time < oldestTime {
+				oldestID, oldestTime = id, work.Header.Time
+			}
+		}
+
+		delete(n.works, oldestID)
+	}
+
+	n.works[workID] = block
+
+	target := pow.Target(block.Header.Difficulty)
+
+	return MiningWorkRes{workID, block.Header, block.TXs, fmt.Sprintf("%064x", target)}, nil
+}
+
+// SubmitWork validates the external miner solution and adds the sealed block to the chain.
+func (n *Node) SubmitWork(req MiningSubmitReq) (database.Hash, error) {
+	n.worksLock.Lock()
+	block, ok := n.works[req.WorkID]
+	n.worksLock.Unlock()
+
+	if !ok {
+		return database.Hash{}, errors.New("unknown or stale work")
+	}
+
+	if req.Time < block.Header.Time {
+		return database.Hash{}, fmt.Errorf("block time can only roll forward from '%d'", block.Header.Time)
+	}
+
+	// The peers would reject the post-dated block, see pow.MaxFutureBlockTime
+	if maxTime := time.Now().Add(pow.MaxFutureBlockTime).Unix(); req.Time > uint64(maxTime) {
+		return database.Hash{}, fmt.Errorf("block time can roll forward up to '%d', not '%d'", maxTime, req.Time)
+	}
+
+	block.Header.Nonce = req.Nonce
+	block.Header.Time = req.Time
+
+	hash, err := block.Hash()
+	if err != nil {
+		return database.Hash{}, err
+	}
+
+	if !pow.IsBlockHashValid(hash, block.Header.Difficulty) {
+		return database.Hash{}, fmt.Errorf("invalid proof of work, block hash %x", hash)
+	}
+
+	n.removeMinedPendingTXs(block)
+
+	err = n.addBlock(block)
+	if err != nil {
+		return database.Hash{}, err
+	}
+
+	n.worksLock.Lock()
+	delete(n.works, req.WorkID)
+	n.worksLock.Unlock()
+
+	fmt.Printf("\nExternal miner '%s' sealed Block '%s' 🎉🎉🎉\n", block.Header.Miner.String(), hash.Hex())
+
+	n.miningLock.Lock()
+	n.miningStats.externalBlocks++
+	n.miningLock.Unlock()
+
+	// Stop the local mining of the same block height
+	n.cancelCurrentMining()
+
+	n.announceBlock(block, n.info)
+
+	return hash, nil
+}
+
+// MineRemotely runs the Mine loop against the node at nodeUrl: it fetches the block templates,
+// seals them locally and submits the solutions, until the ctx is done.
+func MineRemotely(ctx context.Context, nodeUrl string, miner common.Address, threads int) error {
+	engine := pow.NewWithThreads(threads)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+
+		work, err := fetchWork(nodeUrl, miner)
+		if err != nil {
+			fmt.Printf("ERROR: %s\n", err)
+
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(remoteMinerPollInterval):
+			}
+
+			continue
+		}
+
+		fmt.Printf("Received work '%s' for Block %d with %d TXs\n", work.WorkID.Hex(), work.Header.Number, len(work.TXs))
+
+		miningCtx, stopCurrentMining := context.WithCancel(ctx)
+		go watchWork(miningCtx, stopCurrentMining, nodeUrl, work)
+
+		block, err := engine.Seal(miningCtx, database.Block{Header: work.Header, TXs: work.TXs})
+		stopCurrentMining()
+
+		if err != nil {
+			continue
+		}
+
+		submitRes := MiningSubmitRes{}
+		err = postJson(
+			fmt.Sprintf("%s%s", nodeUrl, endpointMiningSubmit),
+			MiningSubmitReq{work.WorkID, block.Header.Nonce, block.Header.Time},
+			&submitRes,
+		)
+		if err != nil {
+			fmt.Printf("ERROR: %s\n", err)
+			continue
+		}
+
+		fmt.Printf("Node accepted Block '%s'\n", submitRes.Hash.Hex())
+	}
+}
+
+// watchWork cancels the mining as soon as the node moves to a new tip.
+func watchWork(ctx context.Context, stopCurrentMining context.CancelFunc, nodeUrl string, work MiningWorkRes) {
+	ticker := time.NewTicker(remoteMinerPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			res, err := http.Get(fmt.Sprintf("%s%s", nodeUrl, endpointStatus))
+			if err != nil {
+				continue
+			}
+
+			status := StatusRes{}
+			err = readRes(res, &status)
+			if err != nil {
+				continue
+			}
+
+			if status.Hash != work.Header.Parent {
+				fmt.Println("Node moved to a new Block, restarting mining...")
+				stopCurrentMining()
+				return
+			}
+		}
+	}
+}
+
+func fetchWork(nodeUrl string, miner common.Address) (MiningWorkRes, error) {
+	workUrl := fmt.Sprintf("%s%s", nodeUrl, endpointMiningWork)
+
+	// Without a miner account the rewards go to the node's one
+	if miner != (common.Address{}) {
+		workUrl = fmt.Sprintf("%s?%s=%s", workUrl, endpointMiningWorkQueryKeyMiner, url.QueryEscape(miner.Hex()))
+	}
+
+	res, err := http.Get(workUrl)
+	if err != nil {
+		return MiningWorkRes{}, err
+	}
+
+	work := MiningWorkRes{}
+	err = readRes(res, &work)
+	if err != nil {
+		return MiningWorkRes{}, err
+	}
+
+	return work, nil
+}
@@ -0,0 +1,158 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/IacopoMelani/the-blockchain-pub/consensus/pow"
+	"github.com/IacopoMelani/the-blockchain-pub/database"
+	"github.com/IacopoMelani/the-blockchain-pub/fs"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestNode_ExternalMining(t *testing.T) {
+	miner := database.NewAccount(testKsBabaYagaAccount)
+
+	n, dataDir := newTestNode(t, miner)
+	defer fs.RemoveDir(dataDir)
+	defer n.state.Close()
+
+	work, err := n.GetWork(miner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if work.Header.Miner != miner || work.Header.Difficulty != defaultTestMiningDifficulty {
+		t.Fatalf("unexpected work header %+v", work.Header)
+	}
+
+	block, err := pow.NewWithThreads(2).Seal(context.Background(), database.Block{Header: work.Header, TXs: work.TXs})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = n.SubmitWork(MiningSubmitReq{work.WorkID, block.Header.Nonce + 1, block.Header.Time})
+	if err == nil {
+		t.Fatal("a wrong nonce is not suppose to be accepted")
+	}
+
+	postDated := database.Block{Header: work.Header, TXs: work.TXs}
+	postDated.Header.Time = uint64(time.Now().Add(pow.MaxFutureBlockTime + time.Minute).Unix())
+
+	postDated, err = pow.NewWithThreads(2).Seal(context.Background(), postDated)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = n.SubmitWork(MiningSubmitReq{work.WorkID, postDated.Header.Nonce, postDated.Header.Time})
+	if err == nil {
+		t.Fatal("a block dated too far in the future is not suppose to be accepted")
+	}
+
+	hash, err := n.SubmitWork(MiningSubmitReq{work.WorkID, block.Header.Nonce, block.Header.Time})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n.state.LatestBlockHash() != hash {
+		t.Fatal("the submitted block is suppose to be the latest one")
+	}
+
+	if n.state.Balances[miner] != database.BlockReward {
+		t.Fatal("the external miner is suppose to receive the block reward")
+	}
+
+	_, err = n.SubmitWork(MiningSubmitReq{work.WorkID, block.Header.Nonce, block.Header.Time})
+	if err == nil {
+		t.Fatal("a stale work is not suppose to be accepted twice")
+	}
+}
+
+// newTestNode initializes a node with an empty chain and its state, without running it.
+//
+// Remember to remove the dir once test finishes: defer fs.RemoveDir(dataDir)
+func newTestNode(t *testing.T, miner common.Address) (*Node, string) {
+	return newTestNodeWithBalances(t, miner, map[common.Address]uint{})
+}
+
+// newTestNodeWithBalances initializes a node like newTestNode, its genesis funds the accounts.
+func newTestNodeWithBalances(t *testing.T, miner common.Address, balances map[common.Address]uint) (*Node, string) {
+	dataDir := t.TempDir()
+
+	genesisJson, err := json.Marshal(database.Genesis{Balances: balances})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = database.InitDataDirIfNotExists(dataDir, genesisJson)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := New(dataDir, "127.0.0.1", 8085, miner, PeerNode{}, nodeVersion, defaultTestMiningDifficulty)
+	n.engine = pow.NewWithThreads(2)
+
+	err = n.loadIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n.state, err = database.NewStateFromDisk(dataDir, n.engine)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n.resetMempool()
+
+	return n, dataDir
+}
+
+// Run with -race, the templates are built while the blocks are added and the difficulty retargeted
+func TestNode_GetWorkWhileAddingBlocks(t *testing.T) {
+	miner := database.NewAccount(testKsBabaYagaAccount)
+
+	n, dataDir := newTestNode(t, miner)
+	defer fs.RemoveDir(dataDir)
+	defer n.state.Close()
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			if _, err := n.GetWork(miner); err != nil {
+				t.Error(err)
+				return
+			}
+			n.MiningStats()
+		}
+	}()
+
+	mineTestBlocks(t, n, miner, 3)
+	close(done)
+	<-stopped
+}
@@ -0,0 +1,134 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package p2p
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// MaxFrameSize bounds a single message, large enough for a full range of blocks
+const MaxFrameSize = 16 * 1024 * 1024
+
+// Frame flags
+const (
+	flagNotify   uint8 = 0
+	flagRequest  uint8 = 1
+	flagResponse uint8 = 2
+	flagError    uint8 = 3
+)
+
+// Frame layout: [length uint32][code uint8][flags uint8][id uint32][payload], the length covers the rest of the frame.
+// On encrypted channels everything after the length is sealed with AES-GCM.
+const frameHeaderSize = 1 + 1 + 4
+
+type frame struct {
+	code    MsgCode
+	flags   uint8
+	id      uint32
+	payload []byte
+}
+
+// frameRW reads and writes frames, optionally encrypted, on a stream.
+type frameRW struct {
+	rw io.ReadWriter
+
+	writeLock sync.Mutex
+
+	// nil on plaintext channels
+	egress       cipher.AEAD
+	ingress      cipher.AEAD
+	egressCount  uint64
+	ingressCount uint64
+}
+
+func (f *frameRW) writeFrame(fr frame) error {
+	body := make([]byte, frameHeaderSize+len(fr.payload))
+	body[0] = byte(fr.code)
+	body[1] = fr.flags
+	binary.BigEndian.PutUint32(body[2:6], fr.id)
+	copy(body[frameHeaderSize:], fr.payload)
+
+	f.writeLock.Lock()
+	defer f.writeLock.Unlock()
+
+	if f.egress != nil {
+		body = f.egress.Seal(nil, counterNonce(f.egress, f.egressCount), body, nil)
+		f.egressCount++
+	}
+
+	if len(body) > MaxFrameSize {
+		return fmt.Errorf("frame of %d bytes exceeds the max size of %d bytes", len(body), MaxFrameSize)
+	}
+
+	buf := make([]byte, 4+len(body))
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(body)))
+	copy(buf[4:], body)
+
+	_, err := f.rw.Write(buf)
+
+	return err
+}
+
+// readFrame is not safe for concurrent use, a single goroutine reads each connection.
+func (f *frameRW) readFrame() (frame, error) {
+	var length [4]byte
+	_, err := io.ReadFull(f.rw, length[:])
+	if err != nil {
+		return frame{}, err
+	}
+
+	size := binary.BigEndian.Uint32(length[:])
+	if size > MaxFrameSize {
+		return frame{}, fmt.Errorf("frame of %d bytes exceeds the max size of %d bytes", size, MaxFrameSize)
+	}
+
+	body := make([]byte, size)
+	_, err = io.ReadFull(f.rw, body)
+	if err != nil {
+		return frame{}, err
+	}
+
+	if f.ingress != nil {
+		body, err = f.ingress.Open(body[:0], counterNonce(f.ingress, f.ingressCount), body, nil)
+		if err != nil {
+			return frame{}, fmt.Errorf("unable to decrypt frame. %s", err.Error())
+		}
+		f.ingressCount++
+	}
+
+	if len(body) < frameHeaderSize {
+		return frame{}, fmt.Errorf("frame of %d bytes is too short", len(body))
+	}
+
+	return frame{
+		code:    MsgCode(body[0]),
+		flags:   body[1],
+		id:      binary.BigEndian.Uint32(body[2:6]),
+		payload: body[frameHeaderSize:],
+	}, nil
+}
+
+// counterNonce derives a unique nonce per frame from the frames counter, the keys are never reused across sessions.
+func counterNonce(aead cipher.AEAD, count uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], count)
+
+	return nonce
+}
@@ -0,0 +1,218 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package p2p
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/crypto/ecies"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// Version of the framing and handshake, bumped on every incompatible change
+const Version = 1
+
+// Reserved codes of the handshake messages
+const (
+	helloMsg MsgCode = 0xf0
+	authMsg  MsgCode = 0xf1
+)
+
+const nonceSize = 32
+
+// hello introduces a node with its identity and the ephemeral key of the session.
+type hello struct {
+	Version   uint
+	ID        []byte
+	Ephemeral []byte
+	Nonce     []byte
+	Encrypt   bool
+}
+
+// auth proves the ownership of the identity key by signing the node's hello along with the remote nonce.
+type auth struct {
+	Signature []byte
+}
+
+// ID is the hex encoded compressed public identity key of a node.
+func ID(pub *ecdsa.PublicKey) string {
+	return hex.EncodeToString(crypto.CompressPubkey(pub))
+}
+
+// handshake authenticates both ends of the connection and, if any of them asks for it, encrypts the following frames.
+func handshake(rw *frameRW, key *ecdsa.PrivateKey, encrypt bool, initiator bool) (string, bool, error) {
+	ephemeral, err := crypto.GenerateKey()
+	if err != nil {
+		return "", false, err
+	}
+
+	nonce := make([]byte, nonceSize)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", false, err
+	}
+
+	local := hello{
+		Version:   Version,
+		ID:        crypto.CompressPubkey(&key.PublicKey),
+		Ephemeral: crypto.FromECDSAPub(&ephemeral.PublicKey),
+		Nonce:     nonce,
+		Encrypt:   encrypt,
+	}
+
+	localHello, err := rlp.EncodeToBytes(local)
+	if err != nil {
+		return "", false, err
+	}
+
+	err = rw.writeFrame(frame{code: helloMsg, payload: localHello})
+	if err != nil {
+		return "", false, err
+	}
+
+	remoteHello, err := readHandshakeFrame(rw, helloMsg)
+	if err != nil {
+		return "", false, err
+	}
+
+	remote := hello{}
+	err = rlp.DecodeBytes(remoteHello, &remote)
+	if err != nil {
+		return "", false, fmt.Errorf("invalid hello. %s", err.Error())
+	}
+
+	if remote.Version != Version {
+		return "", false, fmt.Errorf("incompatible p2p version %d, expected %d", remote.Version, Version)
+	}
+
+	if len(remote.Nonce) != nonceSize || bytes.Equal(remote.Nonce, nonce) {
+		return "", false, fmt.Errorf("invalid hello nonce")
+	}
+
+	remoteID, err := crypto.DecompressPubkey(remote.ID)
+	if err != nil {
+		return "", false, fmt.Errorf("invalid node ID. %s", err.Error())
+	}
+
+	sig, err := crypto.Sign(crypto.Keccak256(localHello, remote.Nonce), key)
+	if err != nil {
+		return "", false, err
+	}
+
+	localAuth, err := rlp.EncodeToBytes(auth{sig})
+	if err != nil {
+		return "", false, err
+	}
+
+	err = rw.writeFrame(frame{code: authMsg, payload: localAuth})
+	if err != nil {
+		return "", false, err
+	}
+
+	remoteAuthBytes, err := readHandshakeFrame(rw, authMsg)
+	if err != nil {
+		return "", false, err
+	}
+
+	remoteAuth := auth{}
+	err = rlp.DecodeBytes(remoteAuthBytes, &remoteAuth)
+	if err != nil {
+		return "", false, fmt.Errorf("invalid auth. %s", err.Error())
+	}
+
+	signer, err := crypto.SigToPub(crypto.Keccak256(remoteHello, nonce), remoteAuth.Signature)
+	if err != nil {
+		return "", false, fmt.Errorf("invalid auth signature. %s", err.Error())
+	}
+
+	if ID(signer) != ID(remoteID) {
+		return "", false, fmt.Errorf("hello of node %s is not signed by it", ID(remoteID))
+	}
+
+	if !local.Encrypt && !remote.Encrypt {
+		return ID(remoteID), false, nil
+	}
+
+	remoteEphemeral, err := crypto.UnmarshalPubkey(remote.Ephemeral)
+	if err != nil {
+		return "", false, fmt.Errorf("invalid ephemeral key. %s", err.Error())
+	}
+
+	secret, err := ecies.ImportECDSA(ephemeral).GenerateShared(ecies.ImportECDSAPublic(remoteEphemeral), 16, 16)
+	if err != nil {
+		return "", false, err
+	}
+
+	initiatorNonce, responderNonce := nonce, remote.Nonce
+	if !initiator {
+		initiatorNonce, responderNonce = remote.Nonce, nonce
+	}
+
+	initiatorCipher, err := newSessionCipher(secret, initiatorNonce, responderNonce, "initiator")
+	if err != nil {
+		return "", false, err
+	}
+
+	responderCipher, err := newSessionCipher(secret, initiatorNonce, responderNonce, "responder")
+	if err != nil {
+		return "", false, err
+	}
+
+	if initiator {
+		rw.egress, rw.ingress = initiatorCipher, responderCipher
+	} else {
+		rw.egress, rw.ingress = responderCipher, initiatorCipher
+	}
+
+	return ID(remoteID), true, nil
+}
+
+func readHandshakeFrame(rw *frameRW, code MsgCode) ([]byte, error) {
+	fr, err := rw.readFrame()
+	if err != nil {
+		return nil, err
+	}
+
+	if fr.code != code {
+		return nil, fmt.Errorf("unexpected handshake message 0x%x, expected 0x%x", fr.code, code)
+	}
+
+	return fr.payload, nil
+}
+
+// newSessionCipher derives the AES-256-GCM key of one direction of the session.
+func newSessionCipher(secret []byte, initiatorNonce []byte, responderNonce []byte, direction string) (cipher.AEAD, error) {
+	h := sha256.New()
+	h.Write(secret)
+	h.Write(initiatorNonce)
+	h.Write(responderNonce)
+	h.Write([]byte(direction))
+
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,136 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package p2p
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"fmt"
+	"net"
+	"time"
+)
+
+const handshakeTimeout = 10 * time.Second
+
+type Config struct {
+	// The node's identity key, its public key is the node ID
+	Key *ecdsa.PrivateKey
+
+	// Asks the peers to encrypt the connection, it's encrypted if any of the two ends asks for it
+	Encrypt bool
+
+	Handler Handler
+}
+
+// Dial connects to the node listening on the address, it fails if the node's ID isn't the expected one, when given.
+func Dial(ctx context.Context, addr string, expectedID string, cfg Config) (*Peer, error) {
+	dialer := net.Dialer{Timeout: handshakeTimeout}
+
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := setup(conn, cfg, false)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if expectedID != "" && p.ID() != expectedID {
+		p.Close()
+		return nil, fmt.Errorf("node at '%s' is %s, expected %s", addr, p.ID(), expectedID)
+	}
+
+	go p.readLoop()
+
+	return p, nil
+}
+
+// Server accepts the connections of the peers.
+type Server struct {
+	listener net.Listener
+	cfg      Config
+	onPeer   func(p *Peer) error
+}
+
+// Listen accepts the peers on the address, onPeer returning an error drops the connection.
+func Listen(addr string, cfg Config, onPeer func(p *Peer) error) (*Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{listener, cfg, onPeer}
+	go s.accept()
+
+	return s, nil
+}
+
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+func (s *Server) Close() error {
+	return s.listener.Close()
+}
+
+func (s *Server) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			p, err := setup(conn, s.cfg, true)
+			if err != nil {
+				fmt.Printf("ERROR: p2p handshake with '%s' failed. %s\n", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+
+			go p.readLoop()
+
+			err = s.onPeer(p)
+			if err != nil {
+				fmt.Printf("ERROR: p2p peer %s rejected. %s\n", p.ID(), err)
+				p.Close()
+			}
+		}()
+	}
+}
+
+func setup(conn net.Conn, cfg Config, inbound bool) (*Peer, error) {
+	err := conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err != nil {
+		return nil, err
+	}
+
+	rw := &frameRW{rw: conn}
+
+	id, encrypted, err := handshake(rw, cfg.Key, cfg.Encrypt, !inbound)
+	if err != nil {
+		return nil, err
+	}
+
+	err = conn.SetDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	return newPeer(id, conn, rw, cfg.Handler, inbound, encrypted), nil
+}
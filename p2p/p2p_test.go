@@ -0,0 +1,169 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const (
+	echoMsg MsgCode = iota + 1
+	failMsg
+	noticeMsg
+)
+
+func TestPeer_Request(t *testing.T) {
+	for _, encrypt := range []bool{false, true} {
+		t.Run(fmt.Sprintf("encrypt=%t", encrypt), func(t *testing.T) {
+			notices := make(chan []byte, 1)
+			server, serverID := listenTestServer(t, encrypt, notices)
+
+			clientKey, err := crypto.GenerateKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			p, err := Dial(context.Background(), server.Addr().String(), serverID, Config{Key: clientKey, Handler: testHandler(notices)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer p.Close()
+
+			if p.ID() != serverID {
+				t.Fatalf("expected peer %s, got %s", serverID, p.ID())
+			}
+
+			if p.Encrypted() != encrypt {
+				t.Fatalf("expected encrypted %t, got %t", encrypt, p.Encrypted())
+			}
+
+			// Many concurrent requests share the same connection
+			var wg sync.WaitGroup
+			for i := 0; i < 50; i++ {
+				wg.Add(1)
+
+				go func(i int) {
+					defer wg.Done()
+
+					payload := bytes.Repeat([]byte{byte(i)}, i*1000)
+
+					res, err := p.Request(context.Background(), echoMsg, payload)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+
+					if !bytes.Equal(res, payload) {
+						t.Errorf("request %d got a wrong response", i)
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			_, err = p.Request(context.Background(), failMsg, nil)
+			if err == nil {
+				t.Fatal("a failing request is suppose to return the peer's error")
+			}
+
+			err = p.Notify(noticeMsg, []byte("hello"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case notice := <-notices:
+				if string(notice) != "hello" {
+					t.Fatalf("unexpected notice '%s'", notice)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("the notice never arrived")
+			}
+		})
+	}
+}
+
+func TestDial_UnexpectedID(t *testing.T) {
+	server, _ := listenTestServer(t, false, nil)
+
+	clientKey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Dial(context.Background(), server.Addr().String(), ID(&clientKey.PublicKey), Config{Key: clientKey, Handler: testHandler(nil)})
+	if err == nil {
+		t.Fatal("a node with another ID is not suppose to be accepted")
+	}
+}
+
+func TestPeer_RequestAfterClose(t *testing.T) {
+	server, serverID := listenTestServer(t, false, nil)
+
+	clientKey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := Dial(context.Background(), server.Addr().String(), serverID, Config{Key: clientKey, Handler: testHandler(nil)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.Close()
+
+	_, err = p.Request(context.Background(), echoMsg, []byte("ping"))
+	if err == nil {
+		t.Fatal("a closed peer is not suppose to serve requests")
+	}
+}
+
+func listenTestServer(t *testing.T, encrypt bool, notices chan []byte) (*Server, string) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := Config{Key: key, Encrypt: encrypt, Handler: testHandler(notices)}
+
+	server, err := Listen("127.0.0.1:0", cfg, func(p *Peer) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	return server, ID(&key.PublicKey)
+}
+
+func testHandler(notices chan []byte) Handler {
+	return func(p *Peer, code MsgCode, payload []byte) ([]byte, error) {
+		switch code {
+		case echoMsg:
+			return payload, nil
+		case noticeMsg:
+			notices <- payload
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("unknown message 0x%x", code)
+	}
+}
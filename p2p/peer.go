@@ -0,0 +1,189 @@
+// Copyright 2020 The the-blockchain-bar Authors
+// This file is part of the the-blockchain-bar library.
+//
+// The the-blockchain-bar library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The the-blockchain-bar library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// MsgCode identifies the kind of a message, its meaning is up to the protocol running over the peers.
+type MsgCode uint8
+
+// ErrPeerClosed is returned by the requests of a disconnected peer.
+var ErrPeerClosed = errors.New("peer connection closed")
+
+// Handler serves the requests and the notifications of a peer, the response of a notification is dropped.
+type Handler func(p *Peer, code MsgCode, payload []byte) ([]byte, error)
+
+// Peer is an authenticated connection to a node, multiplexing any number of concurrent requests.
+type Peer struct {
+	id        string
+	conn      net.Conn
+	rw        *frameRW
+	handler   Handler
+	inbound   bool
+	encrypted bool
+
+	nextID      uint32
+	pending     map[uint32]chan frame
+	pendingLock sync.Mutex
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newPeer(id string, conn net.Conn, rw *frameRW, handler Handler, inbound bool, encrypted bool) *Peer {
+	return &Peer{
+		id:        id,
+		conn:      conn,
+		rw:        rw,
+		handler:   handler,
+		inbound:   inbound,
+		encrypted: encrypted,
+		pending:   make(map[uint32]chan frame),
+		closed:    make(chan struct{}),
+	}
+}
+
+// ID returns the remote node ID, proven by the handshake.
+func (p *Peer) ID() string {
+	return p.id
+}
+
+func (p *Peer) RemoteAddr() string {
+	return p.conn.RemoteAddr().String()
+}
+
+func (p *Peer) Inbound() bool {
+	return p.inbound
+}
+
+func (p *Peer) Encrypted() bool {
+	return p.encrypted
+}
+
+// Done is closed once the connection is closed.
+func (p *Peer) Done() <-chan struct{} {
+	return p.closed
+}
+
+func (p *Peer) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		p.conn.Close()
+	})
+
+	return nil
+}
+
+// Request sends the message and waits for the peer's response.
+func (p *Peer) Request(ctx context.Context, code MsgCode, payload []byte) ([]byte, error) {
+	id := atomic.AddUint32(&p.nextID, 1)
+	res := make(chan frame, 1)
+
+	p.pendingLock.Lock()
+	p.pending[id] = res
+	p.pendingLock.Unlock()
+
+	defer func() {
+		p.pendingLock.Lock()
+		delete(p.pending, id)
+		p.pendingLock.Unlock()
+	}()
+
+	err := p.rw.writeFrame(frame{code: code, flags: flagRequest, id: id, payload: payload})
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+
+	select {
+	case fr := <-res:
+		if fr.flags == flagError {
+			return nil, fmt.Errorf("peer %s: %s", p.id, string(fr.payload))
+		}
+
+		return fr.payload, nil
+
+	case <-p.closed:
+		return nil, ErrPeerClosed
+
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Notify sends the message without waiting for any response.
+func (p *Peer) Notify(code MsgCode, payload []byte) error {
+	err := p.rw.writeFrame(frame{code: code, flags: flagNotify, payload: payload})
+	if err != nil {
+		p.Close()
+	}
+
+	return err
+}
+
+// readLoop dispatches the incoming frames until the connection breaks.
+func (p *Peer) readLoop() {
+	defer p.Close()
+
+	for {
+		fr, err := p.rw.readFrame()
+		if err != nil {
+			return
+		}
+
+		switch fr.flags {
+		case flagRequest:
+			go p.serve(fr)
+
+		case flagNotify:
+			go p.handler(p, fr.code, fr.payload)
+
+		case flagResponse, flagError:
+			p.pendingLock.Lock()
+			res, ok := p.pending[fr.id]
+			p.pendingLock.Unlock()
+
+			if ok {
+				res <- fr
+			}
+
+		default:
+			return
+		}
+	}
+}
+
+func (p *Peer) serve(req frame) {
+	payload, err := p.handler(p, req.code, req.payload)
+
+	res := frame{code: req.code, flags: flagResponse, id: req.id, payload: payload}
+	if err != nil {
+		res.flags = flagError
+		res.payload = []byte(err.Error())
+	}
+
+	err = p.rw.writeFrame(res)
+	if err != nil {
+		p.Close()
+	}
+}